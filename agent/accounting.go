@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// trafficAccount holds the traffic of a peer. The counters of the previous snapshot are kept, so
+// the traffic between two snapshots can be added even across restarts of the daemon. Seen is the
+// time the peer was last seen.
+type trafficAccount struct {
+	Interface string                      `json:"interface"`
+	PublicKey string                      `json:"public-key"`
+	Name      string                      `json:"name,omitempty"`
+	Seen      int64                       `json:"seen"`
+	LastRx    uint64                      `json:"last-rx"`
+	LastTx    uint64                      `json:"last-tx"`
+	Days      map[string]lib.PeerTransfer `json:"days"`
+	Months    map[string]lib.PeerTransfer `json:"months"`
+}
+
+// trafficAccounting accounts the traffic of every Wireguard peer into daily and monthly buckets,
+// which are persisted in the state directory. Counters dropping between two snapshots were reset
+// by a restart of the interface or a reboot, so the Bytes counted since are added. Accounts of
+// peers removed longer than the kept months ago are dropped.
+type trafficAccounting struct {
+	path     string
+	cfg      AccountingConfig
+	last     time.Time
+	Accounts map[string]*trafficAccount `json:"accounts"`
+}
+
+// loadTrafficAccounting reads the accounted traffic from the state directory.
+func loadTrafficAccounting(cfg Config) (*trafficAccounting, error) {
+	result := &trafficAccounting{
+		path:     filepath.Join(cfg.StateDir, "wireguard-traffic.json"),
+		cfg:      cfg.Accounting,
+		Accounts: make(map[string]*trafficAccount),
+	}
+
+	data, err := ioutil.ReadFile(result.path)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return result, fmt.Errorf("Parsing Wireguard traffic failed: %w", err)
+	}
+	if result.Accounts == nil {
+		result.Accounts = make(map[string]*trafficAccount)
+	}
+	return result, nil
+}
+
+// newTrafficAccounting continues the accounting saved in the state directory. It fails if the
+// saved accounting cannot be read, as starting from scratch would overwrite it with the next save.
+func newTrafficAccounting(cfg Config) (*trafficAccounting, error) {
+	result, err := loadTrafficAccounting(cfg)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// record adds the traffic of every peer since the previous snapshot to the buckets of the current
+// day and month. The accounts are saved once the configured interval has passed.
+func (acc *trafficAccounting) record(snap *snapshot) {
+	day, month := snap.Time.Format("2006-01-02"), snap.Time.Format("2006-01")
+
+	for _, peer := range snap.Wireguard {
+		if peer.Change == "vanished" {
+			continue
+		}
+
+		key := peer.Interface + " " + peer.PublicKey
+		account, ok := acc.Accounts[key]
+		if !ok {
+			// Traffic before the first snapshot is not attributable to any period
+			acc.Accounts[key] = &trafficAccount{
+				Interface: peer.Interface,
+				PublicKey: peer.PublicKey,
+				Name:      peer.Name,
+				Seen:      snap.Time.Unix(),
+				LastRx:    peer.Transfer.Rx,
+				LastTx:    peer.Transfer.Tx,
+				Days:      make(map[string]lib.PeerTransfer),
+				Months:    make(map[string]lib.PeerTransfer),
+			}
+			continue
+		}
+
+		rx, _ := counterDelta(account.LastRx, peer.Transfer.Rx, 64)
+		tx, _ := counterDelta(account.LastTx, peer.Transfer.Tx, 64)
+		account.LastRx, account.LastTx, account.Name = peer.Transfer.Rx, peer.Transfer.Tx, peer.Name
+		account.Seen = snap.Time.Unix()
+
+		addTraffic(account.Days, day, rx, tx, acc.cfg.Days)
+		addTraffic(account.Months, month, rx, tx, acc.cfg.Months)
+	}
+
+	// Accounts saved before peers were marked as seen are kept for the full period as well
+	expired := snap.Time.AddDate(0, -acc.cfg.Months, 0).Unix()
+	for key, account := range acc.Accounts {
+		if account.Seen == 0 {
+			account.Seen = snap.Time.Unix()
+		} else if account.Seen < expired {
+			delete(acc.Accounts, key)
+		}
+	}
+
+	if snap.Time.Sub(acc.last) >= time.Duration(acc.cfg.Interval)*time.Second {
+		acc.last = snap.Time
+		acc.save()
+	}
+}
+
+// addTraffic adds traffic to the bucket of the given period and drops the oldest buckets beyond
+// the maximum. Periods are formatted so they sort chronologically.
+func addTraffic(buckets map[string]lib.PeerTransfer, period string, rx uint64, tx uint64, max int) {
+	bucket := buckets[period]
+	bucket.Rx += rx
+	bucket.Tx += tx
+	buckets[period] = bucket
+
+	if len(buckets) > max {
+		periods := make([]string, 0, len(buckets))
+		for p := range buckets {
+			periods = append(periods, p)
+		}
+		sort.Strings(periods)
+		for _, p := range periods[:len(periods)-max] {
+			delete(buckets, p)
+		}
+	}
+}
+
+// save persists the accounted traffic.
+func (acc *trafficAccounting) save() {
+	data, err := json.Marshal(acc)
+	if err == nil {
+		err = replaceFile(acc.path, data)
+	}
+	if err != nil {
+		log.Printf("Saving Wireguard traffic failed: %s", err)
+	}
+}
+
+// queryTraffic answers a query of the /wireguard/traffic route with the daily and monthly traffic
+// of every peer. The current day and month are named as well, so checks do not depend on the
+// clock and time zone of the monitoring host.
+func queryTraffic(cfg Config, now time.Time) ([]lib.WGTraffic, error) {
+	acc, err := loadTrafficAccounting(cfg)
+	if os.IsNotExist(err) {
+		return nil, errors.New("No Wireguard traffic accounted, is the daemon running?")
+	} else if err != nil {
+		return nil, err
+	}
+
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	result := []lib.WGTraffic{}
+	for _, account := range acc.Accounts {
+		result = append(result, lib.WGTraffic{
+			Interface: account.Interface,
+			PublicKey: account.PublicKey,
+			Name:      account.Name,
+			Day:       day,
+			Month:     month,
+			Days:      trafficBuckets(account.Days),
+			Months:    trafficBuckets(account.Months),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Interface != result[j].Interface {
+			return result[i].Interface < result[j].Interface
+		}
+		return result[i].PublicKey < result[j].PublicKey
+	})
+	return result, nil
+}
+
+// trafficBuckets returns the buckets ordered by period.
+func trafficBuckets(buckets map[string]lib.PeerTransfer) []lib.TrafficBucket {
+	result := []lib.TrafficBucket{}
+	for period, bucket := range buckets {
+		result = append(result, lib.TrafficBucket{Period: period, Rx: bucket.Rx, Tx: bucket.Tx})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Period < result[j].Period })
+	return result
+}
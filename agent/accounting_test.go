@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestQueryTrafficCurrentPeriods(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.StateDir = dir
+	cfg.Accounting = AccountingConfig{Enabled: true, Interval: 0, Days: 2, Months: 2}
+	acc, err := newTrafficAccounting(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := lib.WGPeer{Interface: "wg0", PublicKey: "key"}
+	start := time.Date(2026, 1, 31, 22, 0, 0, 0, time.Local)
+	for i, rx := range []uint64{100, 300, 600} {
+		peer.Transfer = lib.PeerTransfer{Rx: rx}
+		acc.record(&snapshot{Time: start.Add(time.Duration(i) * time.Hour), Wireguard: []lib.WGPeer{peer}})
+	}
+
+	// The latest bucket is not current anymore once nothing was accounted in the current period
+	traffic, err := queryTraffic(cfg, start.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffic) != 1 {
+		t.Fatalf("Got %d peers, want 1", len(traffic))
+	}
+	got := traffic[0]
+	if got.Day != "2026-02-02" || got.Month != "2026-02" {
+		t.Errorf("Current periods = %s and %s, want 2026-02-02 and 2026-02", got.Day, got.Month)
+	}
+	if len(got.Days) != 2 || got.Days[1].Period != "2026-02-01" || got.Days[1].Rx != 300 {
+		t.Errorf("Days = %+v", got.Days)
+	}
+}
+
+func TestTrafficAccountingUnreadable(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.StateDir = dir
+	path := filepath.Join(dir, "wireguard-traffic.json")
+	if err := ioutil.WriteFile(path, []byte(`{"accounts": {"wg0 key": {"months": {"2026-01"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The damaged file is neither replaced nor overwritten by an empty account
+	if acc, err := newTrafficAccounting(cfg); err == nil {
+		t.Errorf("Damaged accounting was loaded: %+v", acc)
+	}
+	if _, err := queryTraffic(cfg, time.Now()); err == nil {
+		t.Error("Damaged accounting was queried without error")
+	}
+}
+
+func TestTrafficAccountingExpiry(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.StateDir = dir
+	cfg.Accounting = AccountingConfig{Enabled: true, Interval: 300, Days: 2, Months: 2}
+	acc, err := newTrafficAccounting(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 1, 15, 12, 0, 0, 0, time.Local)
+	removed := lib.WGPeer{Interface: "wg0", PublicKey: "removed"}
+	kept := lib.WGPeer{Interface: "wg0", PublicKey: "kept"}
+	acc.record(&snapshot{Time: start, Wireguard: []lib.WGPeer{removed, kept}})
+
+	// Accounts of removed peers are kept for the configured months, those of current peers forever
+	for _, test := range []struct {
+		months int
+		want   int
+	}{{1, 2}, {2, 2}, {3, 1}} {
+		acc.record(&snapshot{Time: start.AddDate(0, test.months, -1), Wireguard: []lib.WGPeer{kept}})
+		if len(acc.Accounts) != test.want {
+			t.Errorf("%d months later %d accounts are kept, want %d", test.months, len(acc.Accounts), test.want)
+		}
+	}
+	if _, ok := acc.Accounts["wg0 kept"]; !ok {
+		t.Error("Account of the configured peer was dropped")
+	}
+}
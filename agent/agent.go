@@ -2,33 +2,35 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	s "strings"
 	"time"
 
 	"github.com/ilkeskin/icinga-g3000/lib"
-	"github.com/mackerelio/go-osstat/cpu"
-	"github.com/mackerelio/go-osstat/memory"
-	"github.com/mackerelio/go-osstat/network"
-	"github.com/mackerelio/go-osstat/uptime"
+	"github.com/urfave/cli/v2"
 )
 
+const version = "0.0.1"
+
 // getUptime reads uptime in secs from /proc/uptime and returns it as a time.Duration object.
 // If an error occurs while reading those values from the os, an empty object is returned.
 func getUptime() (lib.Uptime, error) {
 	var result lib.Uptime
 
-	uptime, err := uptime.Get()
+	uptime, err := readUptime()
 	if err != nil {
 		return result, fmt.Errorf("Getting system uptime failed: %w", err)
 	}
-	return lib.Uptime{uptime}, nil
+	return lib.Uptime{Uptime: uptime}, nil
 }
 
 /*// getUptime reads uptime in secs from /proc/uptime and returns it as a time.Duration object.
@@ -49,15 +51,19 @@ func getUptime() (time.Duration, error) {
 func getCPUUsage() (lib.CPUUsage, error) {
 	var result lib.CPUUsage
 
-	before, err := cpu.Get()
+	before, err := readCPUStat()
 	if err != nil {
 		return result, fmt.Errorf("Getting CPU stats failed: %w", err)
 	}
 	time.Sleep(time.Duration(1) * time.Second)
-	after, err := cpu.Get()
+	after, err := readCPUStat()
 	if err != nil {
 		return result, fmt.Errorf("Getting CPU stats failed: %w", err)
 	}
+
+	if after.Total <= before.Total {
+		return result, errors.New("CPU counters did not advance between the samples")
+	}
 	total := float64(after.Total - before.Total)
 	user := float64(after.User-before.User) / total * 100
 	sys := float64(after.System-before.System) / total * 100
@@ -74,7 +80,7 @@ func getCPUUsage() (lib.CPUUsage, error) {
 func getMemUsage() (lib.MemUsage, error) {
 	var result lib.MemUsage
 
-	mem, err := memory.Get()
+	mem, err := readMemInfo()
 	if err != nil {
 		return result, fmt.Errorf("Getting memory info failed: %w", err)
 	}
@@ -92,108 +98,281 @@ func getMemUsage() (lib.MemUsage, error) {
 }
 
 // getNetUsage determines the current RX- and TX-data rates of all availble NICs by sampling received
-// and transmitted Bytes over the timespan of 1 sec. Data rates are return as Kbit per second.
+// and transmitted Bytes over the timespan of 1 sec. Data rates are return as Kbit per second, packet,
+// error, drop and FIFO overrun rates per sec. The link details and addresses are added. Samples are
+// matched by device name, devices missing in one of the samples, e.g. PPP or USB modems coming up,
+// get no rates and are flagged as "appeared" or "vanished".
 // If an error occurs while reading those values from the os, an empty array of objects is returned.
 func getNetUsage() ([]lib.NetUsage, error) {
 	var result []lib.NetUsage
 
-	before, err := network.Get()
+	before, err := readNetDev()
 	if err != nil {
 		return result, fmt.Errorf("Getting network stats failed: %w", err)
 	}
 	time.Sleep(time.Duration(1) * time.Second)
-	after, err := network.Get()
+	after, err := readNetDev()
 	if err != nil {
 		return result, fmt.Errorf("Getting network stats failed: %w", err)
 	}
 
-	for i := 0; i < len(before); i++ {
-		// Kbit/s = Bytes * (8 / 1000)
-		rxKbps := float64(after[i].RxBytes-before[i].RxBytes) / 125
-		txKbps := float64(after[i].TxBytes-before[i].TxBytes) / 125
+	previous := make(map[string]netDevStat)
+	for _, dev := range before {
+		previous[dev.Name] = dev
+	}
+
+	addresses := readAddresses()
+	for _, dev := range after {
+		nic := lib.NetUsage{Name: dev.Name, Change: "appeared"}
+		if old, ok := previous[dev.Name]; ok {
+			nic = calcNetRates(old, dev)
+			delete(previous, dev.Name)
+		}
+
+		link := readNetLink(dev.Name)
+		nic.OperState, nic.Carrier, nic.MTU, nic.Speed, nic.Duplex = link.OperState, link.Carrier, link.MTU, link.Speed, link.Duplex
+		nic.Addresses = addresses[dev.Name]
+		nic.Roles = netRoles(dev.Name)
+		nic.Capacity = netCapacity(dev.Name, nic.Roles, link.Speed)
+		result = append(result, nic)
+	}
 
-		result = append(result, lib.NetUsage{Name: before[i].Name, Rx: rxKbps, Tx: txKbps})
+	for _, dev := range before {
+		if _, ok := previous[dev.Name]; ok {
+			result = append(result, lib.NetUsage{Name: dev.Name, Roles: netRoles(dev.Name), Change: "vanished"})
+		}
 	}
 
 	return result, nil
 }
 
+// calcNetRates calculates the rates of a network device from two samples taken 1 sec apart. The
+// device is flagged as "reset" if any of its counters was reset in between.
+func calcNetRates(before netDevStat, after netDevStat) lib.NetUsage {
+	reset := false
+	delta := func(old uint64, new uint64) float64 {
+		change, wasReset := counterDelta(old, new, 32)
+		reset = reset || wasReset
+		return float64(change)
+	}
+
+	result := lib.NetUsage{
+		Name: after.Name,
+		// Kbit/s = Bytes * (8 / 1000)
+		Rx:        delta(before.RxBytes, after.RxBytes) / 125,
+		Tx:        delta(before.TxBytes, after.TxBytes) / 125,
+		RxPackets: delta(before.RxPackets, after.RxPackets),
+		TxPackets: delta(before.TxPackets, after.TxPackets),
+		RxErrors:  delta(before.RxErrors, after.RxErrors),
+		TxErrors:  delta(before.TxErrors, after.TxErrors),
+		RxDrops:   delta(before.RxDrops, after.RxDrops),
+		TxDrops:   delta(before.TxDrops, after.TxDrops),
+		RxFifo:    delta(before.RxFifo, after.RxFifo),
+		TxFifo:    delta(before.TxFifo, after.TxFifo),
+	}
+	if reset {
+		result.Change = "reset"
+	}
+	return result
+}
+
 var result []lib.NetUsage
 
-// parseWGDump parses Wireguard peer information produced by the "wg show wg0 dump" command.
-// Interface information is skipped (first line). In case of an error while command exuction
-// an empty array of string-arrays is returned.
-func parseWGDump() ([][]string, error) {
+// calcPeersRates calculates RX- and TX-date rates for every peer of a Wireguard device, from the
+// change in received and transmitted Bytes between two samples taken 1 sec apart. Samples are
+// matched by public key. A counter lower than in the first sample was reset by a restart of the
+// interface, so the Bytes counted since the restart are taken as change. Peers missing in one of
+// the samples get no rate and are flagged as "appeared" or "vanished".
+func calcPeersRates(before wgDevice, after wgDevice) (map[string]lib.PeerRate, map[string]string) {
+	rates := make(map[string]lib.PeerRate)
+	changes := make(map[string]string)
+
+	previous := make(map[string]wgPeerState)
+	for _, peer := range before.Peers {
+		previous[peer.PublicKey] = peer
+	}
 
-	var result [][]string
+	for _, peer := range after.Peers {
+		old, ok := previous[peer.PublicKey]
+		if !ok {
+			changes[peer.PublicKey] = "appeared"
+			continue
+		}
+		delete(previous, peer.PublicKey)
 
-	out, err := exec.Command("wg", "show", "wg0", "dump").Output()
-	//out, err := exec.Command("cat", "wg-mock.txt").Output()
-	if err != nil {
-		return result, fmt.Errorf("Executing \"wg show wg0 dump\" failed: %w", err)
-	} else if len(out) == 0 {
-		return result, errors.New("Executing \"wg show wg0 dump\" returned empty response")
+		rx, rxReset := counterDelta(old.RxBytes, peer.RxBytes, 64)
+		tx, txReset := counterDelta(old.TxBytes, peer.TxBytes, 64)
+		if rxReset || txReset {
+			changes[peer.PublicKey] = "reset"
+		}
+		// Kbit/s = Bytes * (8 / 1000)
+		rates[peer.PublicKey] = lib.PeerRate{Rx: float64(rx) / 125, Tx: float64(tx) / 125}
 	}
 
-	lines := s.Split(s.TrimSpace(string(out)), "\n")[1:]
-	for i := 0; i < len(lines); i++ {
-		result = append(result, s.Split(lines[i], "\t"))
+	for key := range previous {
+		changes[key] = "vanished"
+	}
+	return rates, changes
+}
+
+// counterDelta returns the change of a counter of the given width in bits between two samples and
+// whether the counter was reset in between. Counters narrower than 64 bits, e.g. those of network
+// devices on 32-bit kernels, which count in unsigned longs, wrapped if they dropped from a value
+// within their width and the change is plausible (below half their range). Otherwise the counter
+// was reset, e.g. by recreating the device, and the value counted since is taken as change.
+func counterDelta(before uint64, after uint64, bits uint) (uint64, bool) {
+	if after >= before {
+		return after - before, false
+	}
+
+	if bits < 64 && before < 1<<bits {
+		if change := after + 1<<bits - before; change < 1<<(bits-1) {
+			return change, false
+		}
+	}
+	return after, true
+}
+
+// getWGPeers return all configured Wireguard peers as an array of Peer objects, each including
+// its interface, public key, allowed IPs, external IP address, keepalive, the epoch timestamp of its
+// last successful handshake with the gateway as well as its total traffic and data rates. Peers
+// removed while sampling are reported with their state of the first sample. Busy times observed
+// by the daemon (see loadWGBusy) are taken, unless the counters changed while sampling.
+func getWGPeers(before wgDevice, after wgDevice, busy map[string]int64) []lib.WGPeer {
+	var result []lib.WGPeer
+
+	rates, changes := calcPeersRates(before, after)
+	now := host.now().Unix()
+
+	peers := after.Peers
+	for _, peer := range before.Peers {
+		if changes[peer.PublicKey] == "vanished" {
+			peers = append(peers, peer)
+		}
+	}
+
+	for _, peer := range peers {
+		intIPAddr, extIPAddr := s.Join(peer.AllowedIPs, ","), peer.Endpoint
+		if intIPAddr == "" {
+			intIPAddr = "(none)"
+		}
+		if extIPAddr == "" {
+			extIPAddr = "(none)"
+		}
+
+		wgPeer := lib.WGPeer{
+			Interface:    after.Name,
+			PublicKey:    peer.PublicKey,
+			PresharedKey: peer.PresharedKey,
+			AllowedIPs:   peer.AllowedIPs,
+			IntIPAddr:    intIPAddr,
+			ExtIPAddr:    extIPAddr,
+			Keepalive:    peer.Keepalive,
+			LastHS:       peer.LastHandshake,
+			Transfer:     lib.PeerTransfer{Rx: peer.RxBytes, Tx: peer.TxBytes},
+			PeerRate:     rates[peer.PublicKey],
+			Busy:         busy[after.Name+" "+peer.PublicKey],
+			Change:       changes[peer.PublicKey],
+		}
+		if wgPeer.PeerRate.Rx > 0 || wgPeer.PeerRate.Tx > 0 {
+			wgPeer.Busy = now - 1
+		}
+		wgPeer.State = lib.ClassifyPeer(wgPeer, now)
+		result = append(result, wgPeer)
+	}
+
+	return result
+}
+
+// readWGDevices reads the state of the given Wireguard interfaces.
+func readWGDevices(names []string) ([]wgDevice, error) {
+	var result []wgDevice
+
+	for _, name := range names {
+		dev, err := host.wg.Device(name)
+		if err != nil {
+			return result, fmt.Errorf("Reading Wireguard device failed: %w", err)
+		}
+		result = append(result, dev)
 	}
 
 	return result, nil
 }
 
-// calcPeersRates calculates RX- and TX-date rates for every configured Wireguard peer,
-// by sampling the change in received and transmitted Bytes over the timespan of 1 sec.
-func calcPeersRates() ([]lib.PeerRate, error) {
-	var result []lib.PeerRate
+// getWGInterfaces returns the state of all monitored Wireguard interfaces.
+func getWGInterfaces() ([]lib.WGInterface, error) {
+	var result []lib.WGInterface
 
-	before, err := parseWGDump()
+	names, err := wireguardInterfaces()
 	if err != nil {
-		return result, fmt.Errorf("Parsing Wireguard dump failed: %w", err)
+		return nil, err
 	}
-	time.Sleep(time.Duration(1) * time.Second)
-	after, err := parseWGDump()
+
+	devices, err := readWGDevices(names)
 	if err != nil {
-		return result, fmt.Errorf("Parsing Wireguard dump failed: %w", err)
+		return nil, err
 	}
 
-	for i := 0; i < len(before); i++ {
-		rxBefore, err := strconv.ParseFloat(before[i][5], 64)
-		rxAfter, err := strconv.ParseFloat(after[i][5], 64)
-		txBefore, err := strconv.ParseFloat(before[i][6], 64)
-		txAfter, err := strconv.ParseFloat(after[i][6], 64)
-		if err != nil {
-			return result, fmt.Errorf("Parsing float from dump failed for peer with index %d: %w", i, err)
+	for _, dev := range devices {
+		iface := lib.WGInterface{
+			Name:       dev.Name,
+			PublicKey:  dev.PublicKey,
+			ListenPort: dev.ListenPort,
+			FwMark:     dev.FwMark,
+			Peers:      len(dev.Peers),
 		}
-		// Kbit/s = Bytes * (8 / 1000)
-		result = append(result, lib.PeerRate{Rx: (rxAfter - rxBefore) / 125, Tx: (txAfter - txBefore) / 125})
+		for _, peer := range dev.Peers {
+			iface.Transfer.Rx += peer.RxBytes
+			iface.Transfer.Tx += peer.TxBytes
+		}
+		result = append(result, iface)
 	}
+
 	return result, nil
 }
 
-// getWGPeers return all configured Wireguard peers as an array of Peer objects, each including
-// its internal and external IP address, the epoch timestamp of its last successful handshake with
-// the gateway as well as its data rates.
-func getWGPeers(peers [][]string, rates []lib.PeerRate) ([]lib.WGPeer, error) {
+// getWireguard returns the peers of all monitored Wireguard interfaces including their current data rates.
+func getWireguard() ([]lib.WGPeer, error) {
 	var result []lib.WGPeer
 
-	if len(peers) == 0 {
-		return result, errors.New("Peer dump is empty")
-	} else if len(rates) == 0 {
-		return result, errors.New("Peer dump is empty")
+	names, err := wireguardInterfaces()
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < len(peers); i++ {
-		lastHS, err := strconv.ParseInt(peers[i][4], 10, 64)
-		if err != nil {
-			return result, fmt.Errorf("Parsing \"latest handshake\"-value for peer %s failed: %w", peers[i][3], err)
-		}
+	before, err := readWGDevices(names)
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(time.Duration(1) * time.Second)
+	after, err := readWGDevices(names)
+	if err != nil {
+		return nil, err
+	}
 
-		// IntIPAddr ExtIPAddr LastHS PeerRate
-		result = append(result, lib.WGPeer{IntIPAddr: peers[i][3], ExtIPAddr: peers[i][2], LastHS: lastHS, PeerRate: rates[i]})
+	busy := loadWGBusy(host.wgEvents)
+	for i := range after {
+		result = append(result, getWGPeers(before[i], after[i], busy)...)
 	}
 
+	if len(result) == 0 {
+		return result, errors.New("Wireguard interfaces " + s.Join(names, ", ") + " have no peers")
+	}
+
+	peerNames, err := loadPeerNames(host.wgNames, host.wgConfigDir, names)
+	if err != nil {
+		return nil, err
+	}
+	namePeers(result, peerNames)
+
+	if host.probes != "" {
+		latencies := readProbeResults(host.probes, host.probeMaxAge)
+		for i := range result {
+			if latency, ok := latencies[result[i].Interface+" "+result[i].PublicKey]; ok {
+				result[i].Latency = &latency
+			}
+		}
+	}
 	return result, nil
 }
 
@@ -204,13 +383,7 @@ func sendError(err error) {
 		sendError(err)
 	}
 
-	fmt.Println("HTTP/1.1 500 Internal Server Error")
-	fmt.Println("Content-Type: application/json; charset=utf-8")
-	fmt.Println("Content-Length: " + strconv.Itoa(len(result)))
-	fmt.Println("")
-	fmt.Print(string(result))
-
-	os.Exit(1)
+	sendResponse("500 Internal Server Error", "application/json; charset=utf-8", result)
 }
 
 func sendResult(input interface{}) {
@@ -219,19 +392,25 @@ func sendResult(input interface{}) {
 		sendError(err)
 	}
 
-	fmt.Println("HTTP/1.1 200 OK")
-	fmt.Println("Content-Type: application/json; charset=utf-8")
-	fmt.Println("Content-Length: " + strconv.Itoa(len(result)))
+	sendResponse("200 OK", "application/json; charset=utf-8", result)
+}
+
+// sendResponse writes a HTTP response with the given status and body and exits. Responses
+// with a status other than 200 exit with a non-zero code.
+func sendResponse(status string, contentType string, body []byte) {
+	fmt.Println("HTTP/1.1 " + status)
+	fmt.Println("Content-Type: " + contentType)
+	fmt.Println("Content-Length: " + strconv.Itoa(len(body)))
 	fmt.Println("")
-	fmt.Print(string(result))
+	fmt.Print(string(body))
 
+	if status != "200 OK" {
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
 
 func main() {
-
-	var err error
-
 	/*var wg sync.WaitGroup
 	var uptime time.Duration
 	var cpuUsage lib.CPUUsage
@@ -308,7 +487,173 @@ func main() {
 
 	sendResult(skel)*/
 
+	app := &cli.App{
+		Name:    "icinga2-agent",
+		Usage:   "Agent serving metrics of a TDT G3000 gateway to check_g3000",
+		Version: version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Aliases:     []string{"C"},
+				Value:       defaultConfigPath,
+				DefaultText: defaultConfigPath,
+				Usage:       "Specifies the path of the agent configuration file",
+			},
+			&cli.StringFlag{
+				Name:  "root",
+				Usage: "Reads metrics from the fixture tree at `DIR` (DIR/proc, DIR/sys, recorded commands in DIR/commands and peer names in DIR/peers.json and DIR/wireguard)",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := loadAgentConfig(c)
+			if err != nil {
+				sendError(err)
+			}
+
+			serve(cfg)
+			return nil
+		},
+		Commands: []*cli.Command{
+			&cli.Command{
+				Name:        "daemon",
+				Usage:       "run background tasks",
+				Description: "periodically samples all metrics, evaluates threshold rules and serves the metrics to the SNMP master agent via AgentX, if enabled",
+				Action: func(c *cli.Context) error {
+					cfg, err := loadAgentConfig(c)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					runDaemon(cfg)
+					return nil
+				},
+			},
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+// loadAgentConfig loads the configuration file given on the command line and sets up the
+// host environment, optionally overridden by a fixture tree.
+func loadAgentConfig(c *cli.Context) (Config, error) {
+	cfg, err := loadConfig(c.String("config"))
+	if err != nil {
+		return cfg, err
+	}
+
+	if root := c.String("root"); root != "" {
+		cfg.ProcRoot = filepath.Join(root, "proc")
+		cfg.SysRoot = filepath.Join(root, "sys")
+		cfg.CommandFixtures = filepath.Join(root, "commands")
+		cfg.Wireguard.Names = filepath.Join(root, "peers.json")
+		cfg.Wireguard.ConfigDir = filepath.Join(root, "wireguard")
+	}
+
+	configureHost(cfg)
+	return cfg, nil
+}
+
+// runDaemon starts the background sampler and the tasks depending on it and runs until
+// the process is terminated.
+func runDaemon(cfg Config) {
+	smp := newSampler(cfg.Sampler)
+
+	if len(cfg.Rules) > 0 {
+		alerts := newAlerter(cfg)
+		smp.onSample(alerts.evaluate)
+		go alerts.deliver()
+	}
+
+	if cfg.History.Enabled {
+		smp.onSample(newHistoryStore(cfg).record)
+	}
+
+	smp.onSample(newWGEventLog(cfg).record)
+
+	if cfg.Accounting.Enabled {
+		acc, err := newTrafficAccounting(cfg)
+		if err != nil {
+			log.Printf("Disabling traffic accounting: %s", err)
+		} else {
+			smp.onSample(acc.record)
+		}
+	}
+
+	if cfg.Probes.Enabled {
+		go runProbes(cfg, smp)
+	}
+
+	if cfg.AgentX.Enabled {
+		go runAgentX(cfg.AgentX, smp)
+	}
+
+	smp.run()
+}
+
+// serve answers a single request read from the connection handed over by xinetd on stdin.
+// The protocol is determined by the first bytes received: Zabbix requests start with the "ZBXD"
+// header, NRPE packets with a null byte (or a TLS handshake record), everything else is treated
+// as HTTP. In Checkmk mode a connection
+// which does not send anything is answered with Checkmk agent output.
+func serve(cfg Config) {
 	rd := bufio.NewReader(os.Stdin)
+
+	if cfg.Checkmk.Enabled && !waitForRequest(rd, time.Duration(cfg.Checkmk.Timeout)*time.Second) {
+		err := serveCheckmk(os.Stdout)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	first, err := rd.Peek(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Zabbix.Enabled && first[0] == zabbixHeader[0] {
+		header, err := rd.Peek(len(zabbixHeader))
+		if err == nil && string(header) == zabbixHeader {
+			err = serveZabbix(rd, os.Stdout)
+			if err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
+	if cfg.NRPE.Enabled && (first[0] == 0x00 || first[0] == 0x16) {
+		err = serveNRPE(cfg.NRPE, rd, os.Stdout)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	serveHTTP(cfg, rd)
+}
+
+// waitForRequest reports whether the client sent any data within the given timeout.
+func waitForRequest(rd *bufio.Reader, timeout time.Duration) bool {
+	received := make(chan bool, 1)
+	go func() {
+		_, err := rd.Peek(1)
+		received <- err == nil
+	}()
+
+	select {
+	case ok := <-received:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serveHTTP answers a HTTP-GET request with a JSON response. Besides the routes of the registered
+// collectors, /all serves the results of all collectors at once, /metrics serves them in the
+// Prometheus text format and /health reports whether all collectors succeed.
+func serveHTTP(cfg Config, rd *bufio.Reader) {
 	buffer, _, err := rd.ReadLine()
 	if err != nil {
 		log.Fatal(err)
@@ -321,46 +666,60 @@ func main() {
 		sendError(errors.New(req[0] + " is not allowed"))
 	}
 
-	switch req[1] {
-	case "/uptime":
-		uptime, err := getUptime()
+	uri, err := url.ParseRequestURI(req[1])
+	if err != nil {
+		sendError(err)
+	}
+
+	if c, ok := findCollector(uri.Path); ok {
+		data, err := c.Collect(context.Background())
 		if err != nil {
 			sendError(err)
 		}
-		sendResult(uptime)
-	case "/cpu":
-		cpu, err := getCPUUsage()
+		sendResult(data)
+	}
+
+	switch uri.Path {
+	case "/all":
+		sendResult(snapshotAll(context.Background()))
+	case "/metrics":
+		var buf bytes.Buffer
+		err := writePrometheus(&buf, collectAll(context.Background()))
 		if err != nil {
 			sendError(err)
 		}
-		sendResult(cpu)
-	case "/memory":
-		mem, err := getMemUsage()
+		sendResponse("200 OK", "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+	case "/health":
+		healthy, result := health(context.Background())
+		data, err := json.Marshal(result)
 		if err != nil {
 			sendError(err)
 		}
-		sendResult(mem)
-	case "/network":
-		net, err := getNetUsage()
-		if err != nil {
-			sendError(err)
+		if !healthy {
+			sendResponse("503 Service Unavailable", "application/json; charset=utf-8", data)
 		}
-		sendResult(net)
-	case "/wireguard":
-		peerRates, err := calcPeersRates()
+		sendResult(result)
+	case "/collectors":
+		sendResult(describeCollectors())
+	case "/history":
+		history, err := queryHistory(cfg, uri.Query())
 		if err != nil {
 			sendError(err)
 		}
-		wgDump, err := parseWGDump()
+		sendResult(history)
+	case "/wireguard/events":
+		events, err := queryWGEvents(cfg, uri.Query())
 		if err != nil {
 			sendError(err)
 		}
-		peers, err := getWGPeers(wgDump, peerRates)
+		sendResult(events)
+	case "/wireguard/traffic":
+		traffic, err := queryTraffic(cfg, host.now())
 		if err != nil {
 			sendError(err)
 		}
-		sendResult(peers)
+		sendResult(traffic)
 	default:
-		sendError(errors.New(req[1] + " is not a existing route"))
+		sendError(errors.New(uri.Path + " is not a existing route"))
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after uint64
+		bits          uint
+		delta         uint64
+		reset         bool
+	}{
+		{"unchanged", 1000, 1000, 64, 0, false},
+		{"advanced", 1000, 126000, 64, 125000, false},
+		{"advanced beyond 32 bits", math.MaxUint32 - 1000, math.MaxUint32 + 124000, 64, 125000, false},
+		// Wireguard counters have 64 bits, so a drop at the 32 bit boundary is a reset, not a wrap
+		{"dropped at 32 bits", math.MaxUint32 - 1000, 124000, 64, 124000, true},
+		{"reset after restart", 20971520, 5000, 64, 5000, true},
+		{"reset to zero", 20971520, 0, 64, 0, true},
+		{"wrapped at 64 bits", math.MaxUint64 - 999, 124000, 64, 124000, true},
+		{"32 bit unchanged", 1000, 1000, 32, 0, false},
+		{"32 bit advanced", 1000, 126000, 32, 125000, false},
+		{"wrapped at 32 bits", math.MaxUint32 - 999, 124000, 32, 125000, false},
+		{"wrapped to zero", math.MaxUint32, 0, 32, 1, false},
+		{"implausible wrap", 1 << 31, 1000, 32, 1000, true},
+		{"reset of 64 bit counter", math.MaxUint32 + 1000, 124000, 32, 124000, true},
+		{"32 bit reset after restart", 9812734112, 5000, 32, 5000, true},
+		{"wrapped at 16 bits", math.MaxUint16 - 99, 100, 16, 200, false},
+	}
+
+	for _, test := range tests {
+		delta, reset := counterDelta(test.before, test.after, test.bits)
+		if delta != test.delta || reset != test.reset {
+			t.Errorf("%s: counterDelta(%d, %d, %d) = %d, %t, want %d, %t", test.name, test.before, test.after, test.bits, delta, reset, test.delta, test.reset)
+		}
+	}
+}
+
+func TestCalcPeersRates(t *testing.T) {
+	peer := func(key string, rx, tx uint64) wgPeerState {
+		return wgPeerState{PublicKey: key, RxBytes: rx, TxBytes: tx}
+	}
+
+	tests := []struct {
+		name    string
+		before  []wgPeerState
+		after   []wgPeerState
+		rates   map[string]lib.PeerRate
+		changes map[string]string
+	}{
+		{
+			name:    "steady",
+			before:  []wgPeerState{peer("a", 1000, 2000), peer("b", 0, 0)},
+			after:   []wgPeerState{peer("b", 0, 0), peer("a", 126000, 64500)},
+			rates:   map[string]lib.PeerRate{"a": {Rx: 1000, Tx: 500}, "b": {}},
+			changes: map[string]string{},
+		},
+		{
+			name:    "peer added mid-sample",
+			before:  []wgPeerState{peer("a", 1000, 2000)},
+			after:   []wgPeerState{peer("a", 1000, 2000), peer("b", 125000, 0)},
+			rates:   map[string]lib.PeerRate{"a": {}},
+			changes: map[string]string{"b": "appeared"},
+		},
+		{
+			name:    "peer removed mid-sample",
+			before:  []wgPeerState{peer("a", 1000, 2000), peer("b", 125000, 0)},
+			after:   []wgPeerState{peer("a", 1000, 2000)},
+			rates:   map[string]lib.PeerRate{"a": {}},
+			changes: map[string]string{"b": "vanished"},
+		},
+		{
+			name:    "drop at 32 bits",
+			before:  []wgPeerState{peer("a", math.MaxUint32-1000, 2000)},
+			after:   []wgPeerState{peer("a", 124000, 2000)},
+			rates:   map[string]lib.PeerRate{"a": {Rx: 992}},
+			changes: map[string]string{"a": "reset"},
+		},
+		{
+			name:    "reset after restart",
+			before:  []wgPeerState{peer("a", 20971520, 3145728)},
+			after:   []wgPeerState{peer("a", 0, 12500)},
+			rates:   map[string]lib.PeerRate{"a": {Tx: 100}},
+			changes: map[string]string{"a": "reset"},
+		},
+	}
+
+	for _, test := range tests {
+		rates, changes := calcPeersRates(wgDevice{Name: "wg0", Peers: test.before}, wgDevice{Name: "wg0", Peers: test.after})
+		if !reflect.DeepEqual(rates, test.rates) {
+			t.Errorf("%s: rates = %v, want %v", test.name, rates, test.rates)
+		}
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: changes = %v, want %v", test.name, changes, test.changes)
+		}
+	}
+}
+
+func TestCalcNetRates(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after netDevStat
+		want          lib.NetUsage
+	}{
+		{
+			name:   "steady",
+			before: netDevStat{Name: "eth0", RxBytes: 1000, TxBytes: 2000, RxPackets: 10, TxErrors: 1},
+			after:  netDevStat{Name: "eth0", RxBytes: 126000, TxBytes: 64500, RxPackets: 110, TxErrors: 3},
+			want:   lib.NetUsage{Name: "eth0", Rx: 1000, Tx: 500, RxPackets: 100, TxErrors: 2},
+		},
+		{
+			name:   "wrapped at 32 bits",
+			before: netDevStat{Name: "eth0", RxBytes: math.MaxUint32 - 999, RxPackets: math.MaxUint32},
+			after:  netDevStat{Name: "eth0", RxBytes: 124000, RxPackets: 99},
+			want:   lib.NetUsage{Name: "eth0", Rx: 1000, RxPackets: 100},
+		},
+		{
+			name:   "reset after restart",
+			before: netDevStat{Name: "ppp0", RxBytes: 9812734112, TxBytes: 2123987123, RxDrops: 12},
+			after:  netDevStat{Name: "ppp0", RxBytes: 125000, TxBytes: 12500, RxDrops: 0},
+			want:   lib.NetUsage{Name: "ppp0", Rx: 1000, Tx: 100, Change: "reset"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := calcNetRates(test.before, test.after); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestGetNetUsageChanges samples devices coming up and going away between the samples.
+func TestGetNetUsageChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "procfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := *host
+	defer func() { *host = saved }()
+	host.procRoot, host.sysRoot = filepath.Join(dir, "proc"), filepath.Join(dir, "sys")
+	host.procSamples, host.runner = newFixtureSequence(), staticRunner("")
+	host.netRoles, host.netCapacity = nil, nil
+
+	header := "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"
+	samples := []string{
+		"  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n" +
+			"  ppp0: 5000 50 0 0 0 0 0 0 6000 60 0 0 0 0 0 0\n",
+		"  eth0: 126000 110 0 0 0 0 0 0 64500 70 0 0 0 0 0 0\n" +
+			"wwan0: 125000 100 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+	}
+	os.MkdirAll(filepath.Join(dir, "proc", "net"), 0755)
+	for i, sample := range samples {
+		err := ioutil.WriteFile(filepath.Join(dir, "proc", "net", "dev."+strconv.Itoa(i+1)), []byte(header+sample), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := getNetUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []lib.NetUsage{
+		{Name: "eth0", Rx: 1000, Tx: 500, RxPackets: 100, TxPackets: 50},
+		{Name: "wwan0", Change: "appeared"},
+		{Name: "ppp0", Change: "vanished"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("getNetUsage() =\n%+v\nwant\n%+v", result, want)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+// AgentX PDU types (RFC 2741)
+const (
+	agentxOpen       = 1
+	agentxClose      = 2
+	agentxRegister   = 3
+	agentxGet        = 5
+	agentxGetNext    = 6
+	agentxGetBulk    = 7
+	agentxTestSet    = 8
+	agentxCommitSet  = 9
+	agentxUndoSet    = 10
+	agentxCleanupSet = 11
+	agentxResponse   = 18
+)
+
+// AgentX header flags
+const (
+	agentxFlagNonDefaultContext = 0x08
+	agentxFlagNetworkByteOrder  = 0x10
+)
+
+// AgentX varbind types
+const (
+	agentxInteger        = 2
+	agentxOctetString    = 4
+	agentxObjectID       = 6
+	agentxCounter32      = 65
+	agentxGauge32        = 66
+	agentxTimeTicks      = 67
+	agentxCounter64      = 70
+	agentxNoSuchObject   = 128
+	agentxNoSuchInstance = 129
+	agentxEndOfMibView   = 130
+)
+
+// AgentX response errors
+const (
+	agentxNoError     = 0
+	agentxNotWritable = 17
+)
+
+const agentxHeaderSize = 20
+
+// agentxMaxPayload limits the payload length accepted from the master agent, so a corrupt
+// header does not make the agent allocate up to 4 GiB.
+const agentxMaxPayload = 1 << 20
+
+// oid is an SNMP object identifier.
+type oid []uint32
+
+// parseOID parses an object identifier in dotted notation.
+func parseOID(str string) (oid, error) {
+	var result oid
+
+	for _, part := range s.Split(s.Trim(str, "."), ".") {
+		subid, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing OID %s failed: %w", str, err)
+		}
+		result = append(result, uint32(subid))
+	}
+
+	return result, nil
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i := range o {
+		parts[i] = strconv.FormatUint(uint64(o[i]), 10)
+	}
+	return s.Join(parts, ".")
+}
+
+// compare returns -1, 0 or 1 if o is lexicographically lower, equal or greater than other.
+func (o oid) compare(other oid) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] < other[i] {
+			return -1
+		} else if o[i] > other[i] {
+			return 1
+		}
+	}
+
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// append returns a new OID consisting of o followed by subids.
+func (o oid) append(subids ...uint32) oid {
+	result := make(oid, 0, len(o)+len(subids))
+	result = append(result, o...)
+	return append(result, subids...)
+}
+
+// varbind is a variable binding of an AgentX PDU.
+type varbind struct {
+	name  oid
+	vtype uint16
+	value interface{}
+}
+
+// agentxPDU is a decoded AgentX PDU.
+type agentxPDU struct {
+	ptype         byte
+	flags         byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	payload       []byte
+}
+
+// agentxDecoder reads the fields of an AgentX payload in the byte order of its PDU.
+type agentxDecoder struct {
+	order binary.ByteOrder
+	data  []byte
+	err   error
+}
+
+func (d *agentxDecoder) take(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.err = errors.New("AgentX PDU is truncated")
+		return make([]byte, n)
+	}
+	result := d.data[:n]
+	d.data = d.data[n:]
+	return result
+}
+
+func (d *agentxDecoder) uint16() uint16 { return d.order.Uint16(d.take(2)) }
+func (d *agentxDecoder) uint32() uint32 { return d.order.Uint32(d.take(4)) }
+
+func (d *agentxDecoder) octetString() []byte {
+	length := int(d.uint32())
+	result := d.take(length)
+	d.take((4 - length%4) % 4)
+	return result
+}
+
+// oid decodes an object identifier and reports whether its "include" field is set.
+func (d *agentxDecoder) oid() (oid, bool) {
+	header := d.take(4)
+	count, prefix, include := int(header[0]), header[1], header[2] != 0
+
+	var result oid
+	if prefix != 0 {
+		result = oid{1, 3, 6, 1, uint32(prefix)}
+	}
+	for i := 0; i < count && d.err == nil; i++ {
+		result = append(result, d.uint32())
+	}
+	return result, include
+}
+
+// agentxEncoder writes AgentX payload fields in network byte order.
+type agentxEncoder struct {
+	data []byte
+}
+
+func (e *agentxEncoder) uint16(v uint16) {
+	e.data = append(e.data, byte(v>>8), byte(v))
+}
+
+func (e *agentxEncoder) uint32(v uint32) {
+	e.data = append(e.data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *agentxEncoder) uint64(v uint64) {
+	e.uint32(uint32(v >> 32))
+	e.uint32(uint32(v))
+}
+
+func (e *agentxEncoder) octetString(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.data = append(e.data, v...)
+	e.data = append(e.data, make([]byte, (4-len(v)%4)%4)...)
+}
+
+func (e *agentxEncoder) oid(v oid, include bool) {
+	flag := byte(0)
+	if include {
+		flag = 1
+	}
+	e.data = append(e.data, byte(len(v)), 0, flag, 0)
+	for _, subid := range v {
+		e.uint32(subid)
+	}
+}
+
+func (e *agentxEncoder) varbind(vb varbind) {
+	e.uint16(vb.vtype)
+	e.uint16(0)
+	e.oid(vb.name, false)
+
+	switch vb.vtype {
+	case agentxInteger, agentxCounter32, agentxGauge32, agentxTimeTicks:
+		e.uint32(vb.value.(uint32))
+	case agentxCounter64:
+		e.uint64(vb.value.(uint64))
+	case agentxOctetString:
+		e.octetString([]byte(vb.value.(string)))
+	case agentxObjectID:
+		e.oid(vb.value.(oid), false)
+	}
+}
+
+// agentxSession is an open session with the AgentX master agent.
+type agentxSession struct {
+	conn      net.Conn
+	rd        *bufio.Reader
+	sessionID uint32
+	packetID  uint32
+	started   time.Time
+	base      oid
+	smp       *sampler
+}
+
+// runAgentX registers the agent as AgentX sub-agent and serves requests for the configured
+// subtree from the latest snapshot of the sampler. Lost connections are re-established.
+func runAgentX(cfg AgentXConfig, smp *sampler) {
+	base, err := parseOID(cfg.OID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for {
+		err = serveAgentX(cfg, base, smp)
+		log.Printf("AgentX session closed: %s", err)
+		time.Sleep(time.Duration(cfg.Reconnect) * time.Second)
+	}
+}
+
+// serveAgentX opens a single session with the master agent and handles its requests until
+// the connection is closed.
+func serveAgentX(cfg AgentXConfig, base oid, smp *sampler) error {
+	network, address := "tcp", cfg.Address
+	if s.HasPrefix(address, "/") || s.HasPrefix(address, "unix:") {
+		network, address = "unix", s.TrimPrefix(address, "unix:")
+	}
+	address = s.TrimPrefix(address, "tcp:")
+
+	conn, err := net.DialTimeout(network, address, time.Duration(cfg.Timeout)*time.Second)
+	if err != nil {
+		return fmt.Errorf("Connecting to AgentX master %s failed: %w", cfg.Address, err)
+	}
+	defer conn.Close()
+
+	session := &agentxSession{conn: conn, rd: bufio.NewReader(conn), started: time.Now(), base: base, smp: smp}
+
+	var open agentxEncoder
+	open.data = append(open.data, byte(cfg.Timeout), 0, 0, 0)
+	open.oid(nil, false)
+	open.octetString([]byte("icinga2-agent v" + version))
+	resp, err := session.request(agentxOpen, open.data)
+	if err != nil {
+		return fmt.Errorf("Opening AgentX session failed: %w", err)
+	}
+	session.sessionID = resp.sessionID
+
+	var register agentxEncoder
+	register.data = append(register.data, 0, 127, 0, 0)
+	register.oid(base, false)
+	_, err = session.request(agentxRegister, register.data)
+	if err != nil {
+		return fmt.Errorf("Registering AgentX subtree %s failed: %w", base, err)
+	}
+	log.Printf("Registered AgentX subtree %s", base)
+
+	for {
+		pdu, err := session.read()
+		if err != nil {
+			return err
+		}
+
+		err = session.handle(pdu)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// read reads the next PDU sent by the master agent.
+func (session *agentxSession) read() (agentxPDU, error) {
+	var pdu agentxPDU
+
+	header := make([]byte, agentxHeaderSize)
+	_, err := io.ReadFull(session.rd, header)
+	if err != nil {
+		return pdu, err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if header[2]&agentxFlagNetworkByteOrder != 0 {
+		order = binary.BigEndian
+	}
+
+	pdu.ptype = header[1]
+	pdu.flags = header[2]
+	pdu.sessionID = order.Uint32(header[4:8])
+	pdu.transactionID = order.Uint32(header[8:12])
+	pdu.packetID = order.Uint32(header[12:16])
+
+	length := order.Uint32(header[16:20])
+	if length > agentxMaxPayload {
+		return pdu, fmt.Errorf("AgentX PDU payload of %d bytes exceeds the limit of %d bytes", length, agentxMaxPayload)
+	}
+	pdu.payload = make([]byte, length)
+
+	_, err = io.ReadFull(session.rd, pdu.payload)
+	return pdu, err
+}
+
+// write sends a PDU with the given header fields and payload to the master agent.
+func (session *agentxSession) write(ptype byte, transactionID uint32, packetID uint32, payload []byte) error {
+	var e agentxEncoder
+	e.data = append(e.data, 1, ptype, agentxFlagNetworkByteOrder, 0)
+	e.uint32(session.sessionID)
+	e.uint32(transactionID)
+	e.uint32(packetID)
+	e.uint32(uint32(len(payload)))
+	e.data = append(e.data, payload...)
+
+	_, err := session.conn.Write(e.data)
+	return err
+}
+
+// request sends an administrative PDU and waits for the response of the master agent.
+func (session *agentxSession) request(ptype byte, payload []byte) (agentxPDU, error) {
+	session.packetID++
+	err := session.write(ptype, 0, session.packetID, payload)
+	if err != nil {
+		return agentxPDU{}, err
+	}
+
+	for {
+		pdu, err := session.read()
+		if err != nil {
+			return pdu, err
+		}
+		if pdu.ptype != agentxResponse || pdu.packetID != session.packetID {
+			continue
+		}
+
+		d := agentxDecoder{order: pduByteOrder(pdu), data: pdu.payload}
+		d.uint32()
+		code := d.uint16()
+		if d.err != nil {
+			return pdu, d.err
+		} else if code != agentxNoError {
+			return pdu, errors.New("AgentX master returned error " + strconv.Itoa(int(code)))
+		}
+		return pdu, nil
+	}
+}
+
+func pduByteOrder(pdu agentxPDU) binary.ByteOrder {
+	if pdu.flags&agentxFlagNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// handle answers a single PDU sent by the master agent. Set requests are refused,
+// as all objects of the subtree are read-only.
+func (session *agentxSession) handle(pdu agentxPDU) error {
+	d := agentxDecoder{order: pduByteOrder(pdu), data: pdu.payload}
+	if pdu.flags&agentxFlagNonDefaultContext != 0 {
+		d.octetString()
+	}
+
+	var varbinds []varbind
+	code := uint16(agentxNoError)
+
+	switch pdu.ptype {
+	case agentxGet, agentxGetNext:
+		mib := session.mib()
+		for len(d.data) > 0 && d.err == nil {
+			start, include := d.oid()
+			end, _ := d.oid()
+			if pdu.ptype == agentxGet {
+				varbinds = append(varbinds, mibGet(mib, start))
+			} else {
+				varbinds = append(varbinds, mibGetNext(mib, start, include, end))
+			}
+		}
+	case agentxGetBulk:
+		mib := session.mib()
+		nonRepeaters := int(d.uint16())
+		repetitions := int(d.uint16())
+
+		var starts, ends []oid
+		var includes []bool
+		for len(d.data) > 0 && d.err == nil {
+			start, include := d.oid()
+			end, _ := d.oid()
+			starts, includes, ends = append(starts, start), append(includes, include), append(ends, end)
+		}
+
+		for i := 0; i < nonRepeaters && i < len(starts); i++ {
+			varbinds = append(varbinds, mibGetNext(mib, starts[i], includes[i], ends[i]))
+		}
+		for r := 0; r < repetitions && nonRepeaters < len(starts); r++ {
+			done := true
+			for i := nonRepeaters; i < len(starts); i++ {
+				vb := mibGetNext(mib, starts[i], includes[i], ends[i])
+				varbinds = append(varbinds, vb)
+				starts[i], includes[i] = vb.name, false
+				if vb.vtype != agentxEndOfMibView {
+					done = false
+				}
+			}
+			if done {
+				break
+			}
+		}
+	case agentxTestSet:
+		code = agentxNotWritable
+	case agentxCommitSet, agentxUndoSet:
+	case agentxCleanupSet, agentxResponse:
+		return nil
+	case agentxClose:
+		return errors.New("AgentX master closed the session")
+	default:
+		return nil
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	var e agentxEncoder
+	e.uint32(uint32(time.Since(session.started) / (10 * time.Millisecond)))
+	e.uint16(code)
+	e.uint16(0)
+	for _, vb := range varbinds {
+		e.varbind(vb)
+	}
+
+	return session.write(agentxResponse, pdu.transactionID, pdu.packetID, e.data)
+}
+
+// mibGet returns the varbind for the exact object identifier name.
+func mibGet(mib []varbind, name oid) varbind {
+	i := sort.Search(len(mib), func(i int) bool { return mib[i].name.compare(name) >= 0 })
+	if i < len(mib) && mib[i].name.compare(name) == 0 {
+		return mib[i]
+	}
+	return varbind{name: name, vtype: agentxNoSuchObject}
+}
+
+// mibGetNext returns the varbind following start (or start itself, if include is set)
+// which is lower than end. An empty end OID does not limit the search.
+func mibGetNext(mib []varbind, start oid, include bool, end oid) varbind {
+	i := sort.Search(len(mib), func(i int) bool {
+		c := mib[i].name.compare(start)
+		return c > 0 || (c == 0 && include)
+	})
+	if i < len(mib) && (len(end) == 0 || mib[i].name.compare(end) < 0) {
+		return mib[i]
+	}
+	return varbind{name: start, vtype: agentxEndOfMibView}
+}
+
+// mib builds the sorted list of objects exposed below the registered subtree from the
+// latest snapshot. Percentages are exposed in hundredths of a percent and data rates in
+// bit per second, as SNMP does not know floating point values.
+//
+//	.1.0       uptime (TimeTicks)
+//	.2.{1-3}.0 CPU usage: user, system, idle
+//	.3.{1-3}.0 memory usage: used, cached, free
+//	.4.1.{1-4}.<n> interface table: index, name, rx rate, tx rate
+//	.5.1.{1-7}.<n> Wireguard peer table: index, internal IP, endpoint, latest handshake, rx rate, tx rate, interface
+func (session *agentxSession) mib() []varbind {
+	var result []varbind
+
+	snap := session.smp.get()
+	if snap == nil {
+		return result
+	}
+
+	add := func(vtype uint16, value interface{}, subids ...uint32) {
+		result = append(result, varbind{name: session.base.append(subids...), vtype: vtype, value: value})
+	}
+
+	add(agentxTimeTicks, uint32(snap.Uptime.Uptime/(10*time.Millisecond)), 1, 0)
+	add(agentxGauge32, hundredths(snap.CPU.User), 2, 1, 0)
+	add(agentxGauge32, hundredths(snap.CPU.System), 2, 2, 0)
+	add(agentxGauge32, hundredths(snap.CPU.Idle), 2, 3, 0)
+	add(agentxGauge32, hundredths(snap.Memory.Used), 3, 1, 0)
+	add(agentxGauge32, hundredths(snap.Memory.Cached), 3, 2, 0)
+	add(agentxGauge32, hundredths(snap.Memory.Free), 3, 3, 0)
+
+	for i, nic := range snap.Network {
+		row := uint32(i + 1)
+		add(agentxInteger, row, 4, 1, 1, row)
+		add(agentxOctetString, nic.Name, 4, 1, 2, row)
+		add(agentxGauge32, gauge(nic.Rx*1000), 4, 1, 3, row)
+		add(agentxGauge32, gauge(nic.Tx*1000), 4, 1, 4, row)
+	}
+
+	for i, peer := range snap.Wireguard {
+		row := uint32(i + 1)
+		add(agentxInteger, row, 5, 1, 1, row)
+		add(agentxOctetString, peer.IntIPAddr, 5, 1, 2, row)
+		add(agentxOctetString, peer.ExtIPAddr, 5, 1, 3, row)
+		add(agentxGauge32, uint32(peer.LastHS), 5, 1, 4, row)
+		add(agentxGauge32, gauge(peer.PeerRate.Rx*1000), 5, 1, 5, row)
+		add(agentxGauge32, gauge(peer.PeerRate.Tx*1000), 5, 1, 6, row)
+		add(agentxOctetString, peer.Interface, 5, 1, 7, row)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name.compare(result[j].name) < 0 })
+	return result
+}
+
+func hundredths(value float64) uint32 {
+	return gauge(value*100 + 0.5)
+}
+
+// gauge converts a value to a Gauge32. Negative rates after counter resets and values
+// above the range of the type are clamped instead of wrapping around.
+func gauge(value float64) uint32 {
+	if value <= 0 || math.IsNaN(value) {
+		return 0
+	} else if value >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(value)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	s "strings"
+	"testing"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// agentxMaster is a stand-in for the AgentX master agent, which accepts a single sub-agent
+// connection and talks to it with the PDU functions of the session.
+type agentxMaster struct {
+	t       *testing.T
+	session *agentxSession
+	packet  uint32
+}
+
+func startAgentX(t *testing.T, smp *sampler) (*agentxMaster, net.Listener, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	cfg := AgentXConfig{Address: listener.Addr().String(), Timeout: 5}
+	go func() { done <- serveAgentX(cfg, oid{1, 3, 6, 1, 4, 1, 8072, 9999, 3000}, smp) }()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	master := &agentxMaster{t: t, session: &agentxSession{conn: conn, rd: bufio.NewReader(conn), sessionID: 42}}
+	return master, listener, done
+}
+
+// expect reads the next PDU of the sub-agent and fails unless it is of type ptype.
+func (m *agentxMaster) expect(ptype byte) (agentxPDU, agentxDecoder) {
+	pdu, err := m.session.read()
+	if err != nil {
+		m.t.Fatalf("Reading PDU failed: %s", err)
+	}
+	if pdu.ptype != ptype {
+		m.t.Fatalf("Got PDU type %d, want %d", pdu.ptype, ptype)
+	}
+	if pdu.flags&agentxFlagNetworkByteOrder == 0 {
+		m.t.Errorf("PDU type %d is not in network byte order", ptype)
+	}
+	return pdu, agentxDecoder{order: binary.BigEndian, data: pdu.payload}
+}
+
+// respond acknowledges an administrative PDU of the sub-agent.
+func (m *agentxMaster) respond(pdu agentxPDU) {
+	var e agentxEncoder
+	e.uint32(0)
+	e.uint16(agentxNoError)
+	e.uint16(0)
+	if err := m.session.write(agentxResponse, pdu.transactionID, pdu.packetID, e.data); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// query sends a request and returns the varbinds of the response.
+func (m *agentxMaster) query(ptype byte, payload []byte) []varbind {
+	m.packet++
+	if err := m.session.write(ptype, m.packet, m.packet, payload); err != nil {
+		m.t.Fatal(err)
+	}
+
+	pdu, d := m.expect(agentxResponse)
+	if pdu.packetID != m.packet || pdu.transactionID != m.packet || pdu.sessionID != 42 {
+		m.t.Errorf("Response IDs %d/%d/%d do not match request %d of session 42",
+			pdu.sessionID, pdu.transactionID, pdu.packetID, m.packet)
+	}
+	d.uint32()
+	if code := d.uint16(); code != agentxNoError {
+		m.t.Errorf("Response error %d", code)
+	}
+	d.uint16()
+
+	var result []varbind
+	for len(d.data) > 0 && d.err == nil {
+		vb := varbind{vtype: d.uint16()}
+		d.uint16()
+		vb.name, _ = d.oid()
+		switch vb.vtype {
+		case agentxInteger, agentxCounter32, agentxGauge32, agentxTimeTicks:
+			vb.value = d.uint32()
+		case agentxOctetString:
+			vb.value = string(d.octetString())
+		}
+		result = append(result, vb)
+	}
+	if d.err != nil {
+		m.t.Fatal(d.err)
+	}
+	return result
+}
+
+// searchRange encodes a search range from start to end for Get, GetNext and GetBulk requests.
+func searchRange(e *agentxEncoder, start oid, include bool, end oid) {
+	e.oid(start, include)
+	e.oid(end, false)
+}
+
+func TestAgentXSession(t *testing.T) {
+	smp := &sampler{latest: &snapshot{
+		Uptime:  lib.Uptime{Uptime: 90 * time.Second},
+		CPU:     lib.CPUUsage{User: 12.345, System: 1, Idle: 86.655},
+		Network: []lib.NetUsage{{Name: "eth0", Rx: 1.5, Tx: -2}},
+		Wireguard: []lib.WGPeer{{Interface: "wg0", IntIPAddr: "10.0.0.2", ExtIPAddr: "192.0.2.1:51820",
+			PeerRate: lib.PeerRate{Rx: -0.5, Tx: 8}}},
+	}}
+	master, listener, done := startAgentX(t, smp)
+	defer listener.Close()
+	base := oid{1, 3, 6, 1, 4, 1, 8072, 9999, 3000}
+
+	// Open: timeout, reserved, null subagent OID, description
+	pdu, d := master.expect(agentxOpen)
+	if timeout := d.take(4)[0]; timeout != 5 {
+		t.Errorf("Open timeout %d, want 5", timeout)
+	}
+	if id, _ := d.oid(); len(id) != 0 {
+		t.Errorf("Open subagent OID %s, want null", id)
+	}
+	if descr := string(d.octetString()); !s.HasPrefix(descr, "icinga2-agent v") {
+		t.Errorf("Open description %q", descr)
+	}
+	master.respond(pdu)
+
+	// Register: timeout, priority, range subid, reserved, subtree
+	pdu, d = master.expect(agentxRegister)
+	if pdu.sessionID != 42 {
+		t.Errorf("Register session %d, want 42", pdu.sessionID)
+	}
+	if header := d.take(4); header[1] != 127 {
+		t.Errorf("Register priority %d, want 127", header[1])
+	}
+	if subtree, _ := d.oid(); subtree.compare(base) != 0 {
+		t.Errorf("Register subtree %s, want %s", subtree, base)
+	}
+	master.respond(pdu)
+
+	var get agentxEncoder
+	searchRange(&get, base.append(1, 0), false, nil)
+	searchRange(&get, base.append(2, 1, 0), false, nil)
+	searchRange(&get, base.append(9, 0), false, nil)
+	vbs := master.query(agentxGet, get.data)
+	if len(vbs) != 3 {
+		t.Fatalf("Get returned %d varbinds, want 3", len(vbs))
+	}
+	if vbs[0].vtype != agentxTimeTicks || vbs[0].value != uint32(9000) {
+		t.Errorf("Get uptime = %d %v, want TimeTicks 9000", vbs[0].vtype, vbs[0].value)
+	}
+	if vbs[1].vtype != agentxGauge32 || vbs[1].value != uint32(1235) {
+		t.Errorf("Get CPU user = %d %v, want Gauge32 1235", vbs[1].vtype, vbs[1].value)
+	}
+	if vbs[2].vtype != agentxNoSuchObject || vbs[2].name.compare(base.append(9, 0)) != 0 {
+		t.Errorf("Get unknown object = %d %s, want noSuchObject", vbs[2].vtype, vbs[2].name)
+	}
+
+	var next agentxEncoder
+	searchRange(&next, base.append(4), false, nil)
+	searchRange(&next, base.append(5, 1, 7, 1), false, nil)
+	vbs = master.query(agentxGetNext, next.data)
+	if len(vbs) != 2 {
+		t.Fatalf("GetNext returned %d varbinds, want 2", len(vbs))
+	}
+	if vbs[0].name.compare(base.append(4, 1, 1, 1)) != 0 || vbs[0].value != uint32(1) {
+		t.Errorf("GetNext interface table = %s %v, want index 1", vbs[0].name, vbs[0].value)
+	}
+	if vbs[1].vtype != agentxEndOfMibView {
+		t.Errorf("GetNext after last object = %d, want endOfMibView", vbs[1].vtype)
+	}
+
+	// Negative rates after counter resets are reported as 0 instead of wrapping around
+	var bulk agentxEncoder
+	bulk.uint16(1)
+	bulk.uint16(3)
+	searchRange(&bulk, base.append(1), false, nil)
+	searchRange(&bulk, base.append(4, 1, 2, 1), false, nil)
+	searchRange(&bulk, base.append(5, 1, 4, 1), false, nil)
+	vbs = master.query(agentxGetBulk, bulk.data)
+	want := []struct {
+		name  oid
+		value interface{}
+	}{
+		{base.append(1, 0), uint32(9000)},
+		{base.append(4, 1, 3, 1), uint32(1500)},
+		{base.append(5, 1, 5, 1), uint32(0)},
+		{base.append(4, 1, 4, 1), uint32(0)},
+		{base.append(5, 1, 6, 1), uint32(8000)},
+		{base.append(5, 1, 1, 1), uint32(1)},
+		{base.append(5, 1, 7, 1), "wg0"},
+	}
+	if len(vbs) != len(want) {
+		t.Fatalf("GetBulk returned %d varbinds, want %d", len(vbs), len(want))
+	}
+	for i, vb := range vbs {
+		if vb.name.compare(want[i].name) != 0 || vb.value != want[i].value {
+			t.Errorf("GetBulk varbind %d = %s %v, want %s %v", i, vb.name, vb.value, want[i].name, want[i].value)
+		}
+	}
+
+	// Close: reason shutdown
+	master.packet++
+	if err := master.session.write(agentxClose, master.packet, master.packet, []byte{5, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil || !s.Contains(err.Error(), "closed the session") {
+			t.Errorf("Session ended with %v, want close by master", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session did not end after Close")
+	}
+}
+
+func TestAgentXPayloadLimit(t *testing.T) {
+	master, listener, done := startAgentX(t, &sampler{})
+	defer listener.Close()
+
+	header := []byte{1, agentxResponse, agentxFlagNetworkByteOrder, 0, 0, 0, 0, 42, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xf0}
+	master.expect(agentxOpen)
+	if _, err := master.session.conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !s.Contains(err.Error(), "exceeds the limit") {
+			t.Errorf("Session ended with %v, want payload limit error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session did not reject the oversized payload")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// ruleMetric describes a metric that can be used in threshold rules. Boolean metrics
+// are 1 if the condition described by verb is met and 0 otherwise.
+type ruleMetric struct {
+	subject string
+	verb    string
+	unit    string
+	boolean bool
+	value   func(snap *snapshot, target string) (float64, error)
+}
+
+var ruleMetrics = map[string]ruleMetric{
+	"uptime": {"uptime", "above", "s", false, func(snap *snapshot, target string) (float64, error) {
+		return snap.Uptime.Uptime.Seconds(), nil
+	}},
+	"cpu": {"CPU usage", "above", "%", false, func(snap *snapshot, target string) (float64, error) {
+		return snap.CPU.User + snap.CPU.System, nil
+	}},
+	"memory": {"memory usage", "above", "%", false, func(snap *snapshot, target string) (float64, error) {
+		return snap.Memory.Used + snap.Memory.Cached, nil
+	}},
+	"network.upstream": {"device %s upstream", "above", "kbps", false, func(snap *snapshot, target string) (float64, error) {
+		nic, err := findDevice(snap.Network, target)
+		return nic.Tx, err
+	}},
+	"network.downstream": {"device %s downstream", "above", "kbps", false, func(snap *snapshot, target string) (float64, error) {
+		nic, err := findDevice(snap.Network, target)
+		return nic.Rx, err
+	}},
+	"network.down": {"device %s", "is down", "", true, func(snap *snapshot, target string) (float64, error) {
+		nic, err := findDevice(snap.Network, target)
+		if err != nil {
+			return 0, err
+		}
+		if lib.NetLinkState(nic) != lib.StateOk {
+			return 1, nil
+		}
+		return 0, nil
+	}},
+	"wireguard.handshake": {"peer %s handshake", "older than", "s", false, func(snap *snapshot, target string) (float64, error) {
+		peer, err := findPeer(snap.Wireguard, target)
+		if err != nil {
+			return 0, err
+		}
+		// Tunnels that never came up exceed any threshold, as with check_g3000
+		age, ok := lib.HandshakeAge(peer, snap.Time.Unix())
+		if !ok {
+			return math.Inf(1), nil
+		}
+		return float64(age), nil
+	}},
+	"wireguard.upstream": {"peer %s upstream", "above", "kbps", false, func(snap *snapshot, target string) (float64, error) {
+		peer, err := findPeer(snap.Wireguard, target)
+		return peer.PeerRate.Tx, err
+	}},
+	"wireguard.downstream": {"peer %s downstream", "above", "kbps", false, func(snap *snapshot, target string) (float64, error) {
+		peer, err := findPeer(snap.Wireguard, target)
+		return peer.PeerRate.Rx, err
+	}},
+}
+
+// findDevice returns the usage of the network device with the given name.
+func findDevice(netArr []lib.NetUsage, name string) (lib.NetUsage, error) {
+	for i := range netArr {
+		if netArr[i].Name == name {
+			return netArr[i], nil
+		}
+	}
+	return lib.NetUsage{}, errors.New("Could not find device with name " + name)
+}
+
+// alertEvent describes the state change of a threshold rule. The ID is unique per change
+// and allows receivers to drop duplicates caused by retried deliveries. Value is nil for
+// infinite values, e.g. the handshake age of peers that never connected.
+type alertEvent struct {
+	ID       string   `json:"id"`
+	Hostname string   `json:"hostname"`
+	Time     int64    `json:"time"`
+	Rule     string   `json:"rule"`
+	Metric   string   `json:"metric"`
+	Target   string   `json:"target,omitempty"`
+	State    string   `json:"state"`
+	Previous string   `json:"previous"`
+	Value    *float64 `json:"value"`
+	Message  string   `json:"message"`
+
+	stateCode    int
+	previousCode int
+}
+
+// alerter evaluates the threshold rules on every snapshot and delivers state changes to the
+// configured webhooks and trap receivers. The last state of every rule is persisted in the state
+// directory, so restarts of the daemon do not repeat notifications for unchanged states.
+type alerter struct {
+	rules    []RuleConfig
+	webhooks []WebhookConfig
+	traps    []TrapConfig
+	engine   *snmpEngine
+	trapBase oid
+	path     string
+	states   map[string]int
+	queue    chan alertEvent
+}
+
+func newAlerter(cfg Config) *alerter {
+	result := &alerter{
+		rules:    cfg.Rules,
+		webhooks: cfg.Webhooks,
+		path:     filepath.Join(cfg.StateDir, "alerts.json"),
+		states:   make(map[string]int),
+		queue:    make(chan alertEvent, 100),
+	}
+
+	if len(cfg.Traps) > 0 {
+		engine, err := newSNMPEngine(cfg)
+		if err == nil {
+			result.trapBase, err = parseOID(cfg.AgentX.OID)
+		}
+		if err != nil {
+			log.Printf("Disabling traps: %s", err)
+		} else {
+			result.traps, result.engine = cfg.Traps, engine
+		}
+	}
+
+	data, err := ioutil.ReadFile(result.path)
+	if err == nil {
+		err = json.Unmarshal(data, &result.states)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Reading alert states failed: %s", err)
+	}
+
+	return result
+}
+
+// evaluate compares the metrics of a snapshot against all rules and queues an event for every
+// rule whose state changed. Rules without a previous state are assumed to have been OK. The new
+// state of a rule is only committed once its event is queued, so changes dropped because of a
+// full queue are reported again with the next snapshot.
+func (a *alerter) evaluate(snap *snapshot) {
+	changed := false
+
+	for _, rule := range a.rules {
+		metric := ruleMetrics[rule.Metric]
+		subject := metric.subject
+		if rule.Target != "" {
+			subject = fmt.Sprintf(subject, rule.Target)
+		}
+
+		state := lib.StateUnknown
+		value, err := metric.value(snap, rule.Target)
+		if err == nil {
+			state = lib.Evaluate(value, rule.Warning, rule.Critical)
+		} else {
+			value = 0
+		}
+
+		previous := a.states[rule.Name]
+		if state == previous {
+			continue
+		}
+
+		var message string
+		switch {
+		case metric.boolean && state == lib.StateOk:
+			message = fmt.Sprintf("%s back to normal", subject)
+		case metric.boolean && state != lib.StateUnknown:
+			message = fmt.Sprintf("%s %s", subject, metric.verb)
+		case state == lib.StateOk:
+			message = fmt.Sprintf("%s back to normal (%s)", subject, formatRuleValue(value, metric.unit))
+		case state == lib.StateWarning:
+			message = fmt.Sprintf("%s %s %g%s (%s)", subject, metric.verb, *rule.Warning, metric.unit, formatRuleValue(value, metric.unit))
+		case state == lib.StateCritical:
+			message = fmt.Sprintf("%s %s %g%s (%s)", subject, metric.verb, *rule.Critical, metric.unit, formatRuleValue(value, metric.unit))
+		default:
+			message = fmt.Sprintf("%s unknown: %s", subject, err)
+		}
+
+		hostname, _ := os.Hostname()
+		event := alertEvent{
+			ID:       fmt.Sprintf("%s-%s-%d", hostname, rule.Name, snap.Time.UnixNano()),
+			Hostname: hostname,
+			Time:     snap.Time.Unix(),
+			Rule:     rule.Name,
+			Metric:   rule.Metric,
+			Target:   rule.Target,
+			State:    lib.StateName(state),
+			Previous: lib.StateName(previous),
+			Message:  message,
+
+			stateCode:    state,
+			previousCode: previous,
+		}
+
+		if !math.IsInf(value, 0) {
+			event.Value = &value
+		}
+
+		select {
+		case a.queue <- event:
+			a.states[rule.Name] = state
+			changed = true
+		default:
+			log.Printf("Delivery queue is full, retrying event for rule %s with the next snapshot", rule.Name)
+		}
+	}
+
+	if changed {
+		a.save()
+	}
+}
+
+// formatRuleValue formats the value of a metric with its unit. Only handshake ages of peers that
+// never connected are infinite.
+func formatRuleValue(value float64, unit string) string {
+	if math.IsInf(value, 1) {
+		return "never connected"
+	}
+	return fmt.Sprintf("%.2f%s", value, unit)
+}
+
+// save persists the current rule states.
+func (a *alerter) save() {
+	data, err := json.Marshal(a.states)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.path), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(a.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Saving alert states failed: %s", err)
+	}
+}
+
+// deliver sends queued events to all webhooks and trap receivers until the process exits.
+func (a *alerter) deliver() {
+	for event := range a.queue {
+		log.Printf("Rule %s changed to %s: %s", event.Rule, event.State, event.Message)
+
+		if len(a.traps) > 0 {
+			deliverTraps(a.traps, a.engine, a.trapBase, event)
+		}
+
+		for _, hook := range a.webhooks {
+			err := postWebhook(hook, event)
+			if err != nil {
+				log.Printf("Delivering event %s to %s failed: %s", event.ID, hook.URL, err)
+			}
+		}
+	}
+}
+
+// postWebhook POSTs an event as JSON to a webhook. Failed attempts are retried with an
+// exponentially growing delay, any 2xx status code is treated as success.
+func postWebhook(hook WebhookConfig, event alertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(hook.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := http.Client{Timeout: timeout}
+	delay := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err = postOnce(client, hook, body)
+		if err == nil || attempt >= hook.Retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postOnce(client http.Client, hook WebhookConfig, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Webhook returned status " + resp.Status)
+	}
+	return nil
+}
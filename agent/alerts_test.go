@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestAlerterFullQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	warning := 50.0
+	a := &alerter{
+		rules:  []RuleConfig{{Name: "cpu-high", Metric: "cpu", Warning: &warning}},
+		path:   filepath.Join(dir, "alerts.json"),
+		states: make(map[string]int),
+		queue:  make(chan alertEvent, 1),
+	}
+	a.queue <- alertEvent{}
+	snap := &snapshot{Time: time.Now(), CPU: lib.CPUUsage{User: 60}}
+
+	// The event is dropped, so neither the state nor the state file may change
+	a.evaluate(snap)
+	if state := a.states["cpu-high"]; state != lib.StateOk {
+		t.Errorf("State after dropped event = %d, want %d", state, lib.StateOk)
+	}
+	if _, err := os.Stat(a.path); !os.IsNotExist(err) {
+		t.Errorf("State file was written for a dropped event: %v", err)
+	}
+
+	// The change is reported again, once there is room in the queue
+	<-a.queue
+	a.evaluate(snap)
+	if state := a.states["cpu-high"]; state != lib.StateWarning {
+		t.Errorf("State after queued event = %d, want %d", state, lib.StateWarning)
+	}
+	event := <-a.queue
+	if event.State != "WARNING" || event.Previous != "OK" {
+		t.Errorf("Event changed from %s to %s, want OK to WARNING", event.Previous, event.State)
+	}
+	if _, err := os.Stat(a.path); err != nil {
+		t.Errorf("State file was not written: %s", err)
+	}
+}
+
+func TestRuleMetricNetworkDown(t *testing.T) {
+	snap := &snapshot{Network: []lib.NetUsage{
+		{Name: "eth0", OperState: "up", Carrier: true},
+		{Name: "eth1", OperState: "up"},
+		{Name: "wg0", OperState: "unknown", Carrier: true},
+		{Name: "wwan0", OperState: "down"},
+		{Name: "eth2", OperState: "dormant"},
+	}}
+
+	tests := []struct {
+		target string
+		want   float64
+		err    bool
+	}{
+		{"eth0", 0, false},
+		{"eth1", 1, false},
+		{"wg0", 0, false},
+		{"wwan0", 1, false},
+		{"eth2", 1, false},
+		{"eth9", 0, true},
+	}
+	for _, test := range tests {
+		value, err := ruleMetrics["network.down"].value(snap, test.target)
+		if value != test.want || (err != nil) != test.err {
+			t.Errorf("%s: network.down = %g, %v, want %g", test.target, value, err, test.want)
+		}
+	}
+}
+
+func TestRuleNeverConnectedPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	critical := 300.0
+	a := &alerter{
+		rules:  []RuleConfig{{Name: "tunnel", Metric: "wireguard.handshake", Target: "name:office", Critical: &critical}},
+		path:   filepath.Join(dir, "alerts.json"),
+		states: make(map[string]int),
+		queue:  make(chan alertEvent, 1),
+	}
+	snap := &snapshot{Time: time.Now(), Wireguard: []lib.WGPeer{{Interface: "wg0", Name: "office", PublicKey: "key"}}}
+
+	a.evaluate(snap)
+	if state := a.states["tunnel"]; state != lib.StateCritical {
+		t.Fatalf("State of never connected peer = %d, want %d", state, lib.StateCritical)
+	}
+	event := <-a.queue
+	if event.Value != nil || !strings.Contains(event.Message, "never connected") {
+		t.Errorf("Event = %v, %q, want no value and never connected", event.Value, event.Message)
+	}
+	data, err := json.Marshal(event)
+	if err != nil || !strings.Contains(string(data), `"value":null`) {
+		t.Errorf("Marshalled event = %s, %v, want null value", data, err)
+	}
+}
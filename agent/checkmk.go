@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	s "strings"
+)
+
+// serveCheckmk writes the metrics of the gateway as Checkmk agent sections to w. Sections which
+// cannot be collected are left out, as the Checkmk server treats missing sections as unknown.
+func serveCheckmk(w io.Writer) error {
+	var out bytes.Buffer
+
+	hostname, _ := os.Hostname()
+	fmt.Fprintln(&out, "<<<check_mk>>>")
+	fmt.Fprintln(&out, "Version: "+version)
+	fmt.Fprintln(&out, "AgentOS: linux")
+	fmt.Fprintln(&out, "Hostname: "+hostname)
+
+	uptime, err := getUptime()
+	if err == nil {
+		fmt.Fprintln(&out, "<<<uptime>>>")
+		fmt.Fprintf(&out, "%.2f\n", uptime.Uptime.Seconds())
+	}
+
+	loadavg, err := host.readProc("loadavg")
+	if err == nil {
+		fmt.Fprintln(&out, "<<<cpu>>>")
+		fmt.Fprintf(&out, "%s %d\n", s.TrimSpace(string(loadavg)), runtime.NumCPU())
+	}
+
+	meminfo, err := host.readProc("meminfo")
+	if err == nil {
+		fmt.Fprintln(&out, "<<<mem>>>")
+		out.Write(meminfo)
+	}
+
+	netdev, err := host.readProc("net", "dev")
+	if err == nil {
+		writeCheckmkInterfaces(&out, string(netdev))
+	}
+
+	peers, err := getWireguard()
+	if err == nil {
+		fmt.Fprintln(&out, "<<<wireguard>>>")
+		for i := range peers {
+			fmt.Fprintf(&out, "%s %s %s %d %.2f %.2f\n",
+				peers[i].Interface,
+				peers[i].IntIPAddr,
+				peers[i].ExtIPAddr,
+				peers[i].LastHS,
+				peers[i].PeerRate.Rx,
+				peers[i].PeerRate.Tx)
+		}
+	}
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// writeCheckmkInterfaces writes the "lnx_if" section built from the counters in /proc/net/dev
+// followed by the link details Checkmk usually obtains from ethtool.
+func writeCheckmkInterfaces(out io.Writer, netdev string) {
+	var names []string
+
+	fmt.Fprintln(out, "<<<lnx_if:sep(58)>>>")
+	lines := s.Split(s.TrimSpace(netdev), "\n")
+	for i := 2; i < len(lines); i++ {
+		fields := s.SplitN(lines[i], ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		names = append(names, s.TrimSpace(fields[0]))
+		fmt.Fprintln(out, lines[i])
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(out, "[%s]\n", name)
+
+		speed, err := host.readSys("class", "net", name, "speed")
+		if err == nil && speed != "-1" {
+			fmt.Fprintf(out, "\tSpeed: %sMb/s\n", speed)
+		} else {
+			fmt.Fprintln(out, "\tSpeed: Unknown")
+		}
+
+		carrier, err := host.readSys("class", "net", name, "carrier")
+		if err == nil && carrier == "1" {
+			fmt.Fprintln(out, "\tLink detected: yes")
+		} else {
+			fmt.Fprintln(out, "\tLink detected: no")
+		}
+
+		address, err := host.readSys("class", "net", name, "address")
+		if err == nil {
+			fmt.Fprintf(out, "\tAddress: %s\n", address)
+		}
+	}
+}
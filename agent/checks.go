@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// builtinCheck describes a check that is evaluated by the agent itself. Checks with a
+// target expect the name of a network device or a Wireguard peer selector (see lib.SelectPeer).
+type builtinCheck struct {
+	hasTarget bool
+	run       func(target string) (float64, string, error)
+}
+
+var builtinChecks = map[string]builtinCheck{
+	"uptime":        {false, checkUptime},
+	"cpu":           {false, checkCPU},
+	"memory":        {false, checkMemory},
+	"upstream":      {true, checkUpstream},
+	"downstream":    {true, checkDownstream},
+	"wg_handshake":  {true, checkPeerHandshake},
+	"wg_upstream":   {true, checkPeerUpstream},
+	"wg_downstream": {true, checkPeerDownstream},
+}
+
+// runCheck evaluates the built-in check with the given name against the optional thresholds.
+// It returns the resulting service state together with the plugin output.
+func runCheck(name string, target string, warning *float64, critical *float64) (int, string) {
+	check, ok := builtinChecks[name]
+	if !ok {
+		return lib.StateUnknown, "UNKNOWN - " + name + " is not a built-in check"
+	}
+
+	value, output, err := check.run(target)
+	if err != nil {
+		return lib.StateUnknown, fmt.Sprintf("UNKNOWN - %s", err)
+	}
+
+	state := lib.Evaluate(value, warning, critical)
+	return state, lib.StateName(state) + " - " + output
+}
+
+func checkUptime(target string) (float64, string, error) {
+	uptime, err := getUptime()
+	if err != nil {
+		return 0, "", err
+	}
+
+	return uptime.Uptime.Seconds(), fmt.Sprintf("'uptime'=%ds", int(uptime.Uptime.Seconds())), nil
+}
+
+func checkCPU(target string) (float64, string, error) {
+	cpu, err := getCPUUsage()
+	if err != nil {
+		return 0, "", err
+	}
+
+	output, err := lib.ParseCPUUsage(cpu)
+	return cpu.System + cpu.User, output, err
+}
+
+func checkMemory(target string) (float64, string, error) {
+	mem, err := getMemUsage()
+	if err != nil {
+		return 0, "", err
+	}
+
+	output, err := lib.ParseMemUsage(mem)
+	return mem.Cached + mem.Used, output, err
+}
+
+func checkUpstream(target string) (float64, string, error) {
+	netArr, err := getNetUsage()
+	if err != nil {
+		return 0, "", err
+	}
+
+	output, err := lib.ParseNetUsage(netArr, target)
+	if err != nil {
+		return 0, "", err
+	}
+
+	for i := range netArr {
+		if netArr[i].Name == target {
+			return netArr[i].Tx, output[0], nil
+		}
+	}
+	return 0, "", errors.New("Could not find device with name " + target)
+}
+
+func checkDownstream(target string) (float64, string, error) {
+	netArr, err := getNetUsage()
+	if err != nil {
+		return 0, "", err
+	}
+
+	output, err := lib.ParseNetUsage(netArr, target)
+	if err != nil {
+		return 0, "", err
+	}
+
+	for i := range netArr {
+		if netArr[i].Name == target {
+			return netArr[i].Rx, output[1], nil
+		}
+	}
+	return 0, "", errors.New("Could not find device with name " + target)
+}
+
+// findPeer returns the Wireguard peer addressed by target, see lib.SelectPeer.
+func findPeer(peers []lib.WGPeer, target string) (lib.WGPeer, error) {
+	return lib.SelectPeer(peers, target)
+}
+
+// getCheckedPeer returns the Wireguard peer addressed by target together with its parsed metrics.
+func getCheckedPeer(target string) (lib.WGPeer, [3]string, error) {
+	var output [3]string
+
+	peers, err := getWireguard()
+	if err != nil {
+		return lib.WGPeer{}, output, err
+	}
+
+	peer, err := findPeer(peers, target)
+	if err != nil {
+		return peer, output, err
+	}
+
+	return peer, lib.FormatPeer(peer), nil
+}
+
+func checkPeerHandshake(target string) (float64, string, error) {
+	peer, output, err := getCheckedPeer(target)
+	if err != nil {
+		return 0, "", err
+	}
+
+	age, ok := lib.HandshakeAge(peer, host.now().Unix())
+	if !ok {
+		return math.Inf(1), output[0], nil
+	}
+	return float64(age), output[0], nil
+}
+
+func checkPeerUpstream(target string) (float64, string, error) {
+	peer, output, err := getCheckedPeer(target)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return peer.PeerRate.Tx, output[1], nil
+}
+
+func checkPeerDownstream(target string) (float64, string, error) {
+	peer, output, err := getCheckedPeer(target)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return peer.PeerRate.Rx, output[2], nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// collectTimeout limits the time spent collecting metrics for the /all, /metrics and /health routes.
+const collectTimeout = 10 * time.Second
+
+// MetricDesc describes a value reported by a collector. Field is the JSON field holding the
+// value, nested fields are joined by dots.
+type MetricDesc struct {
+	Field string `json:"field"`
+	Help  string `json:"help"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+// Collector is a source of metrics served by the agent. The result of Collect is served as JSON
+// on its route and as part of the /all snapshot, numeric fields are exported to Prometheus.
+type Collector interface {
+	Name() string
+	Route() string
+	Collect(ctx context.Context) (interface{}, error)
+	Describe() []MetricDesc
+}
+
+// funcCollector adapts a function collecting metrics to the Collector interface.
+type funcCollector struct {
+	name    string
+	collect func() (interface{}, error)
+	schema  []MetricDesc
+}
+
+func (c funcCollector) Name() string {
+	return c.name
+}
+
+func (c funcCollector) Route() string {
+	return "/" + c.name
+}
+
+func (c funcCollector) Describe() []MetricDesc {
+	return c.schema
+}
+
+// Collect runs the collect function, but stops waiting for it once ctx is done.
+func (c funcCollector) Collect(ctx context.Context) (interface{}, error) {
+	type result struct {
+		data interface{}
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		data, err := c.collect()
+		done <- result{data, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// routedCollector serves a collector on a route other than its name, e.g. below the route of
+// a related collector.
+type routedCollector struct {
+	Collector
+	route string
+}
+
+func (c routedCollector) Route() string {
+	return c.route
+}
+
+var collectors []Collector
+
+// registerCollector adds a collector to the registry. Collectors must be registered
+// before any request is served.
+func registerCollector(c Collector) {
+	collectors = append(collectors, c)
+}
+
+// findCollector returns the registered collector serving the given route.
+func findCollector(route string) (Collector, bool) {
+	for _, c := range collectors {
+		if c.Route() == route {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	registerCollector(funcCollector{"uptime", func() (interface{}, error) { return getUptime() }, []MetricDesc{
+		{"uptime", "Time since the gateway was booted", "nanoseconds"},
+	}})
+	registerCollector(funcCollector{"cpu", func() (interface{}, error) { return getCPUUsage() }, []MetricDesc{
+		{"user", "CPU time spent in user mode", "percent"},
+		{"system", "CPU time spent in kernel mode", "percent"},
+		{"idle", "CPU time spent idle", "percent"},
+	}})
+	registerCollector(funcCollector{"memory", func() (interface{}, error) { return getMemUsage() }, []MetricDesc{
+		{"used", "Memory used by processes", "percent"},
+		{"cached", "Memory used as page cache", "percent"},
+		{"free", "Unused memory", "percent"},
+	}})
+	registerCollector(funcCollector{"network", func() (interface{}, error) { return getNetUsage() }, []MetricDesc{
+		{"rx", "Receive rate of the device", "kbps"},
+		{"tx", "Transmit rate of the device", "kbps"},
+		{"rx-packets", "Received packets of the device", "packets/s"},
+		{"tx-packets", "Transmitted packets of the device", "packets/s"},
+		{"rx-errors", "Receive errors of the device", "errors/s"},
+		{"tx-errors", "Transmit errors of the device", "errors/s"},
+		{"rx-drops", "Received packets dropped by the device", "packets/s"},
+		{"tx-drops", "Packets dropped by the device before transmission", "packets/s"},
+		{"rx-fifo", "Receive FIFO overruns of the device", "errors/s"},
+		{"tx-fifo", "Transmit FIFO overruns of the device", "errors/s"},
+		{"carrier", "Whether the device detects a link", ""},
+		{"mtu", "Maximum transmission unit of the device", "bytes"},
+		{"speed", "Link speed of the device (0 if unknown)", "Mbit/s"},
+		{"capacity", "Nominal capacity of the device (0 if unknown)", "kbps"},
+	}})
+	registerCollector(funcCollector{"wireguard", func() (interface{}, error) { return getWireguard() }, []MetricDesc{
+		{"latest-handshake", "Time of the latest handshake with the peer", "unix time"},
+		{"data-rates.rx", "Receive rate from the peer", "kbps"},
+		{"data-rates.tx", "Transmit rate to the peer", "kbps"},
+		{"transfer.rx", "Bytes received from the peer", "bytes"},
+		{"transfer.tx", "Bytes transmitted to the peer", "bytes"},
+		{"persistent-keepalive", "Persistent keepalive interval (0 if disabled)", "seconds"},
+		{"preshared-key", "Whether a preshared key is configured", ""},
+		{"latency.rtt-min", "Minimum round trip time of the latest probes through the tunnel", "ms"},
+		{"latency.rtt-avg", "Average round trip time of the latest probes through the tunnel", "ms"},
+		{"latency.rtt-max", "Maximum round trip time of the latest probes through the tunnel", "ms"},
+		{"latency.loss", "Unanswered probes of the latest probes through the tunnel", "percent"},
+	}})
+	registerCollector(routedCollector{funcCollector{"wireguard_interfaces", func() (interface{}, error) { return getWGInterfaces() }, []MetricDesc{
+		{"listen-port", "UDP port the interface listens on", ""},
+		{"fwmark", "Firewall mark of outgoing packets (0 if not set)", ""},
+		{"peers", "Number of configured peers", ""},
+		{"transfer.rx", "Bytes received from all peers", "bytes"},
+		{"transfer.tx", "Bytes transmitted to all peers", "bytes"},
+	}}, "/wireguard/interfaces"})
+	registerCollector(routedCollector{funcCollector{"wireguard_lint", func() (interface{}, error) { return getWGLint() }, []MetricDesc{
+		{"severity", "Severity of the finding (warning or critical)", ""},
+		{"check", "Rule that found the problem", ""},
+	}}, "/wireguard/lint"})
+}
+
+// collectorResult holds the outcome of a single collector run.
+type collectorResult struct {
+	collector Collector
+	data      interface{}
+	err       error
+	duration  time.Duration
+}
+
+// collectAll runs all registered collectors concurrently and returns their results
+// in the order of registration.
+func collectAll(ctx context.Context) []collectorResult {
+	ctx, cancel := context.WithTimeout(ctx, collectTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	result := make([]collectorResult, len(collectors))
+
+	for i, c := range collectors {
+		wg.Add(1)
+		go func(i int, c Collector) {
+			defer wg.Done()
+			start := time.Now()
+			data, err := c.Collect(ctx)
+			result[i] = collectorResult{c, data, err, time.Since(start)}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// snapshotAll returns the results of all collectors keyed by their names. Errors of
+// collectors are reported in the "errors" field instead of failing the whole snapshot.
+func snapshotAll(ctx context.Context) map[string]interface{} {
+	result := make(map[string]interface{})
+	errs := make(map[string]string)
+
+	result["hostname"], _ = os.Hostname()
+	for _, r := range collectAll(ctx) {
+		if r.err != nil {
+			errs[r.collector.Name()] = r.err.Error()
+			continue
+		}
+		result[r.collector.Name()] = r.data
+	}
+
+	if len(errs) > 0 {
+		result["errors"] = errs
+	}
+	return result
+}
+
+// collectorHealth describes the outcome of running a collector for the /health route.
+type collectorHealth struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration-ms"`
+}
+
+// health runs all collectors and reports whether each of them succeeded. The overall
+// status is "ok" if all collectors succeeded and "degraded" otherwise.
+func health(ctx context.Context) (bool, map[string]interface{}) {
+	healthy := true
+	checks := make(map[string]collectorHealth)
+
+	for _, r := range collectAll(ctx) {
+		check := collectorHealth{OK: r.err == nil, Duration: r.duration.Milliseconds()}
+		if r.err != nil {
+			check.Error = r.err.Error()
+			healthy = false
+		}
+		checks[r.collector.Name()] = check
+	}
+
+	status := "ok"
+	if !healthy {
+		status = "degraded"
+	}
+	return healthy, map[string]interface{}{"status": status, "collectors": checks}
+}
+
+// collectorInfo describes a registered collector for the /collectors route.
+type collectorInfo struct {
+	Name    string       `json:"name"`
+	Route   string       `json:"route"`
+	Metrics []MetricDesc `json:"metrics"`
+}
+
+// describeCollectors returns the names, routes and schemas of all registered collectors.
+func describeCollectors() []collectorInfo {
+	result := make([]collectorInfo, 0, len(collectors))
+	for _, c := range collectors {
+		result = append(result, collectorInfo{c.Name(), c.Route(), c.Describe()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	s "strings"
+)
+
+const defaultConfigPath = "/etc/upload/icinga2-agent.json"
+
+// TLSConfig holds the certificate settings used to wrap a connection in TLS.
+type TLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	CA       string `json:"ca"`
+	Required bool   `json:"required"`
+}
+
+// NRPECommand maps an NRPE command name to one of the built-in checks.
+type NRPECommand struct {
+	Check    string   `json:"check"`
+	Target   string   `json:"target"`
+	Warning  *float64 `json:"warning"`
+	Critical *float64 `json:"critical"`
+}
+
+// NRPEConfig holds the settings of the NRPE protocol handler.
+type NRPEConfig struct {
+	Enabled        bool                   `json:"enabled"`
+	AllowArguments bool                   `json:"allow_arguments"`
+	TLS            TLSConfig              `json:"tls"`
+	Commands       map[string]NRPECommand `json:"commands"`
+}
+
+// CheckmkConfig holds the settings of the Checkmk agent mode. If enabled, a connection which
+// does not send a request within the timeout (in secs) is answered with Checkmk sections.
+type CheckmkConfig struct {
+	Enabled bool `json:"enabled"`
+	Timeout int  `json:"timeout"`
+}
+
+// ZabbixConfig holds the settings of the Zabbix passive agent protocol handler.
+type ZabbixConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// WireguardConfig holds the settings used to read the state of Wireguard interfaces. The
+// backend is either "netlink", "wg" (parses the output of "wg show <interface> dump") or
+// "auto", which uses netlink and falls back to wg. Without a list of interfaces, all Wireguard
+// interfaces of the gateway are monitored. Peers are named by the JSON mapping file names and
+// by "# Name = ..." comments in the configuration files (<interface>.conf) below config_dir.
+// The daemon keeps the latest max_events handshake and endpoint changes of all peers.
+type WireguardConfig struct {
+	Backend    string   `json:"backend"`
+	Interfaces []string `json:"interfaces"`
+	Names      string   `json:"names"`
+	ConfigDir  string   `json:"config_dir"`
+	MaxEvents  int      `json:"max_events"`
+}
+
+// NetworkConfig holds the settings of the network collector. Roles map aliases like "wan", "lan"
+// or "lte" to the devices serving them, given as names or glob patterns (e.g. "wwan*"), so checks
+// can select devices independent of the interface names of the firmware. Capacity sets the nominal
+// capacity in Mbit/s of devices without link speed, like LTE modems or PPP links, keyed by device
+// name, glob pattern or role.
+type NetworkConfig struct {
+	Roles    map[string][]string `json:"roles"`
+	Capacity map[string]float64  `json:"capacity"`
+}
+
+// SamplerConfig holds the settings of the background sampler run by the daemon.
+// The interval between two snapshots is given in secs.
+type SamplerConfig struct {
+	Interval int `json:"interval"`
+}
+
+// HistoryConfig holds the settings of the metric history recorded by the daemon. A snapshot is
+// recorded every interval secs. Each series keeps the given number of samples (8 bytes each),
+// series of new metrics are no longer recorded once the maximum number of series is reached.
+type HistoryConfig struct {
+	Enabled   bool `json:"enabled"`
+	Interval  int  `json:"interval"`
+	Capacity  int  `json:"capacity"`
+	MaxSeries int  `json:"max_series"`
+}
+
+// ProbeConfig holds the settings of the latency probes the daemon sends to every Wireguard peer
+// through the tunnel every interval secs. Method is "icmp" (echo requests), "udp" (datagrams to a
+// closed port, answered by port unreachable), "tcp" (connects to port) or "auto", which falls back
+// from ICMP to UDP if raw sockets are not permitted. Peers are probed at their first allowed IP
+// with a single address, unless targets maps their public key or name to another address.
+type ProbeConfig struct {
+	Enabled  bool              `json:"enabled"`
+	Method   string            `json:"method"`
+	Interval int               `json:"interval"`
+	Count    int               `json:"count"`
+	Timeout  int               `json:"timeout"`
+	Port     int               `json:"port"`
+	Targets  map[string]string `json:"targets"`
+}
+
+// AgentXConfig holds the settings of the AgentX sub-agent run by the daemon. The address is
+// either a unix socket path or "tcp:host:port", timeouts and reconnect delay are given in secs.
+type AgentXConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Address   string `json:"address"`
+	OID       string `json:"oid"`
+	Timeout   int    `json:"timeout"`
+	Reconnect int    `json:"reconnect"`
+}
+
+// RuleConfig defines a threshold rule evaluated by the daemon on every snapshot. The target
+// selects the network device or Wireguard peer (see lib.SelectPeer) for metrics that need one.
+type RuleConfig struct {
+	Name     string   `json:"name"`
+	Metric   string   `json:"metric"`
+	Target   string   `json:"target"`
+	Warning  *float64 `json:"warning"`
+	Critical *float64 `json:"critical"`
+}
+
+// WebhookConfig defines an URL state changes of rules are POSTed to. Failed deliveries are
+// retried the given number of times, the timeout of each attempt is given in secs.
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Retries int               `json:"retries"`
+	Timeout int               `json:"timeout"`
+}
+
+// TrapConfig defines a receiver state changes of rules are sent to as SNMP trap or inform.
+// Version is either "2c" (default) or "3". SNMPv3 supports MD5 and SHA authentication as well as DES and
+// AES privacy. Retries and timeout (in secs) apply to informs only.
+type TrapConfig struct {
+	Address      string `json:"address"`
+	Version      string `json:"version"`
+	Community    string `json:"community"`
+	Inform       bool   `json:"inform"`
+	Retries      int    `json:"retries"`
+	Timeout      int    `json:"timeout"`
+	User         string `json:"user"`
+	AuthProtocol string `json:"auth_protocol"`
+	AuthPassword string `json:"auth_password"`
+	PrivProtocol string `json:"priv_protocol"`
+	PrivPassword string `json:"priv_password"`
+}
+
+// Config holds the agent configuration read from a JSON file. The procfs and sysfs roots as well
+// as a directory of recorded command output (see fixtureRunner) allow to run the agent against
+// a fixture tree instead of the live system, whose clock is pinned to the fixture time if set.
+type Config struct {
+	ProcRoot        string           `json:"proc_root"`
+	SysRoot         string           `json:"sys_root"`
+	CommandFixtures string           `json:"command_fixtures"`
+	FixtureTime     int64            `json:"fixture_time"`
+	StateDir        string           `json:"state_dir"`
+	SNMPEngineID    string           `json:"snmp_engine_id"`
+	NRPE            NRPEConfig       `json:"nrpe"`
+	Checkmk         CheckmkConfig    `json:"checkmk"`
+	Zabbix          ZabbixConfig     `json:"zabbix"`
+	Network         NetworkConfig    `json:"network"`
+	Wireguard       WireguardConfig  `json:"wireguard"`
+	Sampler         SamplerConfig    `json:"sampler"`
+	History         HistoryConfig    `json:"history"`
+	Accounting      AccountingConfig `json:"accounting"`
+	Probes          ProbeConfig      `json:"probes"`
+	AgentX          AgentXConfig     `json:"agentx"`
+	Rules           []RuleConfig     `json:"rules"`
+	Webhooks        []WebhookConfig  `json:"webhooks"`
+	Traps           []TrapConfig     `json:"traps"`
+}
+
+// AccountingConfig holds the settings of the per-peer traffic accounting done by the daemon. The
+// counters are saved every interval secs, daily and monthly totals are kept for the given number
+// of days and months.
+type AccountingConfig struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"`
+	Days     int  `json:"days"`
+	Months   int  `json:"months"`
+}
+
+// defaultConfig returns the configuration used if no configuration file exists.
+func defaultConfig() Config {
+	return Config{
+		ProcRoot: "/proc",
+		SysRoot:  "/sys",
+		StateDir: "/etc/upload/icinga2-agent-state",
+		NRPE: NRPEConfig{
+			Enabled: false,
+		},
+		Checkmk: CheckmkConfig{
+			Enabled: false,
+			Timeout: 2,
+		},
+		Zabbix: ZabbixConfig{
+			Enabled: false,
+		},
+		Wireguard: WireguardConfig{
+			Backend:   "auto",
+			Names:     "/etc/upload/icinga2-agent-peers.json",
+			ConfigDir: "/etc/wireguard",
+			MaxEvents: 1000,
+		},
+		Sampler: SamplerConfig{
+			Interval: 30,
+		},
+		History: HistoryConfig{
+			Enabled:   true,
+			Interval:  60,
+			Capacity:  10080,
+			MaxSeries: 64,
+		},
+		Accounting: AccountingConfig{
+			Enabled:  true,
+			Interval: 300,
+			Days:     62,
+			Months:   24,
+		},
+		Probes: ProbeConfig{
+			Enabled:  false,
+			Method:   "auto",
+			Interval: 60,
+			Count:    5,
+			Timeout:  1,
+			Port:     33434,
+		},
+		AgentX: AgentXConfig{
+			Enabled:   false,
+			Address:   "/var/agentx/master",
+			OID:       "1.3.6.1.4.1.8072.9999.3000",
+			Timeout:   5,
+			Reconnect: 30,
+		},
+	}
+}
+
+// loadConfig reads the agent configuration from the JSON file at path. Settings missing in
+// the file keep their default values. If the file does not exist, the defaults are returned.
+func loadConfig(path string) (Config, error) {
+	result := defaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return result, fmt.Errorf("Reading config file %s failed: %w", path, err)
+	}
+
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return result, fmt.Errorf("Parsing config file %s failed: %w", path, err)
+	}
+
+	for role, patterns := range result.Network.Roles {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return result, errors.New("Role " + role + " has invalid pattern " + pattern)
+			}
+		}
+	}
+
+	for key, capacity := range result.Network.Capacity {
+		if _, err := filepath.Match(key, ""); err != nil || capacity <= 0 {
+			return result, errors.New("Capacity of " + key + " must be a valid pattern and above 0")
+		}
+	}
+
+	switch result.Wireguard.Backend {
+	case "auto", "netlink", "wg":
+	default:
+		return result, errors.New("Unsupported Wireguard backend " + result.Wireguard.Backend)
+	}
+
+	if result.Wireguard.MaxEvents < 1 {
+		return result, errors.New("Wireguard max_events must be at least 1")
+	}
+
+	if result.Sampler.Interval < 1 {
+		return result, errors.New("Sampler interval must be at least 1 sec")
+	}
+
+	if result.History.Interval < 1 || result.History.Capacity < 1 {
+		return result, errors.New("History interval and capacity must be at least 1")
+	}
+
+	if result.Accounting.Interval < 1 || result.Accounting.Days < 1 || result.Accounting.Months < 1 {
+		return result, errors.New("Accounting interval, days and months must be at least 1")
+	}
+
+	switch result.Probes.Method {
+	case "auto", "icmp", "udp", "tcp":
+	default:
+		return result, errors.New("Unsupported probe method " + result.Probes.Method)
+	}
+	if result.Probes.Interval < 1 || result.Probes.Count < 1 || result.Probes.Timeout < 1 {
+		return result, errors.New("Probe interval, count and timeout must be at least 1")
+	}
+
+	// The timeout is sent to the master agent as a single byte
+	if result.AgentX.Timeout < 1 || result.AgentX.Timeout > 255 || result.AgentX.Reconnect < 1 {
+		return result, errors.New("AgentX timeout must be between 1 and 255 secs, reconnect at least 1 sec")
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range result.Rules {
+		if rule.Name == "" || names[rule.Name] {
+			return result, errors.New("Rule names must be unique and not empty")
+		}
+		names[rule.Name] = true
+
+		metric, ok := ruleMetrics[rule.Metric]
+		if !ok {
+			return result, errors.New("Rule " + rule.Name + " has unknown metric " + rule.Metric)
+		} else if s.Contains(metric.subject, "%s") && rule.Target == "" {
+			return result, errors.New("Rule " + rule.Name + " needs a target")
+		}
+	}
+
+	for _, trap := range result.Traps {
+		if trap.Version != "" && trap.Version != "2c" && trap.Version != "3" {
+			return result, errors.New("Trap receiver " + trap.Address + " has unsupported version " + trap.Version)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigAgentX(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "icinga2-agent.json")
+
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{`{"agentx": {"timeout": 1, "reconnect": 1}}`, true},
+		{`{"agentx": {"timeout": 255}}`, true},
+		{`{"agentx": {"timeout": 0}}`, false},
+		{`{"agentx": {"timeout": 256}}`, false},
+		{`{"agentx": {"reconnect": 0}}`, false},
+		{`{"agentx": {"reconnect": -5}}`, false},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); (err == nil) != test.valid {
+			t.Errorf("%s: loading returned %v", test.config, err)
+		}
+	}
+}
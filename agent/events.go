@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// wgEventLog records handshake and endpoint changes of Wireguard peers into a file in the state
+// directory, which the /wireguard/events route reads. Only the latest events are kept. The
+// transfer counters of the previous snapshot are only kept in memory.
+type wgEventLog struct {
+	path     string
+	max      int
+	sampled  int64
+	transfer map[string]lib.PeerTransfer
+	Peers    map[string]wgPeerMark `json:"peers"`
+	Events   []lib.WGEvent         `json:"events"`
+}
+
+// wgPeerMark holds the state of a peer seen in the previous snapshot. Busy is the start of the
+// first sampling interval after the session of the peer expired in which its transfer counters
+// changed, it is only updated once per expired session to spare the flash.
+type wgPeerMark struct {
+	Interface string `json:"interface"`
+	PublicKey string `json:"public-key"`
+	Name      string `json:"name,omitempty"`
+	Fresh     bool   `json:"fresh"`
+	Endpoint  string `json:"endpoint"`
+	Busy      int64  `json:"busy,omitempty"`
+}
+
+// wgEventFile returns the path of the file holding the event log.
+func wgEventFile(stateDir string) string {
+	return filepath.Join(stateDir, "wireguard-events.json")
+}
+
+// loadWGEventLog reads the event log keeping up to max events. A missing file yields an empty log.
+func loadWGEventLog(path string, max int) (*wgEventLog, error) {
+	result := &wgEventLog{
+		path:     path,
+		max:      max,
+		transfer: make(map[string]lib.PeerTransfer),
+		Peers:    make(map[string]wgPeerMark),
+	}
+
+	data, err := ioutil.ReadFile(result.path)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return result, fmt.Errorf("Parsing Wireguard events failed: %w", err)
+	}
+	if result.Peers == nil {
+		result.Peers = make(map[string]wgPeerMark)
+	}
+	return result, nil
+}
+
+// loadWGBusy returns the busy times of the peers recorded by the daemon, see wgPeerMark.
+func loadWGBusy(path string) map[string]int64 {
+	result := make(map[string]int64)
+	events, err := loadWGEventLog(path, 0)
+	if err != nil {
+		return result
+	}
+	for key, mark := range events.Peers {
+		result[key] = mark.Busy
+	}
+	return result
+}
+
+func newWGEventLog(cfg Config) *wgEventLog {
+	result, err := loadWGEventLog(wgEventFile(cfg.StateDir), cfg.Wireguard.MaxEvents)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Reading Wireguard events failed: %s", err)
+	}
+	return result
+}
+
+// record compares the peers of a snapshot with the previous one and logs a "fresh" event if the
+// latest handshake got younger than REJECT_AFTER_TIME and an "endpoint" event if the endpoint
+// changed. A handshake getting older is logged as "stale" if keepalives or traffic should have
+// renewed the session and as "expired" if the peer was just idle. Counters of an expired session
+// changing later show handshake initiations of the gateway, which are logged as "stale" as well.
+// Fresh, stale and expired events are dated to the time of the change. Peers removed from the
+// interfaces are forgotten.
+func (l *wgEventLog) record(snap *snapshot) {
+	changed := false
+	seen := make(map[string]bool)
+
+	for _, peer := range snap.Wireguard {
+		seen[peer.Interface+" "+peer.PublicKey] = true
+		if peer.Change == "vanished" {
+			continue
+		}
+
+		key := peer.Interface + " " + peer.PublicKey
+		last, known := l.Peers[key]
+
+		// Only the first interval after the session expired in which the counters changed is kept
+		expiry, busy := peer.LastHS+lib.RejectAfterTime, last.Busy
+		if before, ok := l.transfer[key]; ok && before != peer.Transfer && peer.Busy < l.sampled {
+			peer.Busy = l.sampled
+		}
+		l.transfer[key] = peer.Transfer
+		if busy < expiry && peer.Busy >= expiry {
+			busy = peer.Busy
+		} else if busy > peer.Busy {
+			peer.Busy = busy
+		}
+
+		age, ok := lib.HandshakeAge(peer, snap.Time.Unix())
+		mark := wgPeerMark{
+			Interface: peer.Interface,
+			PublicKey: peer.PublicKey,
+			Name:      peer.Name,
+			Fresh:     ok && age <= lib.RejectAfterTime,
+			Busy:      busy,
+		}
+		if peer.ExtIPAddr != "(none)" {
+			mark.Endpoint = peer.ExtIPAddr
+		}
+		l.Peers[key] = mark
+		if known && last == mark {
+			continue
+		}
+		changed = true
+		if !known {
+			continue
+		}
+
+		event := lib.WGEvent{Interface: peer.Interface, PublicKey: peer.PublicKey, Name: peer.Name}
+		if mark.Fresh != last.Fresh {
+			event.Type, event.Time = "expired", snap.Time.Unix()
+			if state := lib.ClassifyPeer(peer, snap.Time.Unix()); state == lib.PeerStale || state == lib.PeerDown {
+				event.Type = "stale"
+			}
+			if mark.Fresh {
+				event.Type, event.Time = "fresh", peer.LastHS
+			} else if ok {
+				event.Time = peer.LastHS + lib.RejectAfterTime
+			}
+			l.add(event)
+		} else if !mark.Fresh && ok && peer.Keepalive == 0 && last.Busy < expiry && busy >= expiry {
+			event.Type, event.Time = "stale", busy
+			l.add(event)
+		}
+		if mark.Endpoint != last.Endpoint {
+			event.Type, event.Time, event.From, event.To = "endpoint", snap.Time.Unix(), last.Endpoint, mark.Endpoint
+			l.add(event)
+		}
+	}
+
+	// An empty snapshot is more likely a failed collection than all peers being removed
+	for key := range l.Peers {
+		if len(snap.Wireguard) > 0 && !seen[key] {
+			delete(l.Peers, key)
+			delete(l.transfer, key)
+			changed = true
+		}
+	}
+	l.sampled = snap.Time.Unix()
+
+	if changed {
+		l.save()
+	}
+}
+
+// add appends an event and drops the oldest events beyond the maximum.
+func (l *wgEventLog) add(event lib.WGEvent) {
+	l.Events = append(l.Events, event)
+	if len(l.Events) > l.max {
+		l.Events = l.Events[len(l.Events)-l.max:]
+	}
+}
+
+// save persists the event log.
+func (l *wgEventLog) save() {
+	data, err := json.Marshal(l)
+	if err == nil {
+		err = replaceFile(l.path, data)
+	}
+	if err != nil {
+		log.Printf("Saving Wireguard events failed: %s", err)
+	}
+}
+
+// queryWGEvents answers a query of the /wireguard/events route with the flaps and endpoint
+// changes of every peer within the given window (default: last 24h).
+func queryWGEvents(cfg Config, query url.Values) ([]lib.WGFlaps, error) {
+	window := 24 * time.Hour
+	if query.Get("window") != "" {
+		d, err := time.ParseDuration(query.Get("window"))
+		if err != nil {
+			secs, err := strconv.ParseInt(query.Get("window"), 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid window " + query.Get("window"))
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		window = d
+	}
+
+	events, err := loadWGEventLog(wgEventFile(cfg.StateDir), cfg.Wireguard.MaxEvents)
+	if os.IsNotExist(err) {
+		return nil, errors.New("No Wireguard events recorded, is the daemon running?")
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := []lib.WGFlaps{}
+	index := make(map[string]int)
+	for key, mark := range events.Peers {
+		index[key] = len(result)
+		result = append(result, lib.WGFlaps{
+			Interface: mark.Interface,
+			PublicKey: mark.PublicKey,
+			Name:      mark.Name,
+			Events:    []lib.WGEvent{},
+		})
+	}
+
+	since := host.now().Add(-window).Unix()
+	for i, event := range events.Events {
+		n, ok := index[event.Interface+" "+event.PublicKey]
+		if !ok || event.Time < since {
+			continue
+		}
+
+		flaps := &result[n]
+		flaps.Events = append(flaps.Events, event)
+		switch event.Type {
+		case "stale":
+			flaps.Flaps++
+		case "endpoint":
+			flaps.EndpointChanges++
+			flaps.LastEndpointChange = &events.Events[i]
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Interface != result[j].Interface {
+			return result[i].Interface < result[j].Interface
+		}
+		return result[i].PublicKey < result[j].PublicKey
+	})
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestWGEventLogRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, _ := loadWGEventLog(wgEventFile(dir), 100)
+	peer := func(key string, lastHS int64, keepalive int, tx uint64) lib.WGPeer {
+		return lib.WGPeer{Interface: "wg0", PublicKey: key, ExtIPAddr: "(none)", LastHS: lastHS, Keepalive: keepalive, Transfer: lib.PeerTransfer{Tx: tx}}
+	}
+	busy := func(peer lib.WGPeer, busy int64) lib.WGPeer {
+		peer.Busy = busy
+		return peer
+	}
+	snap := func(now int64, peers ...lib.WGPeer) *snapshot {
+		return &snapshot{Time: time.Unix(now, 0), Wireguard: peers}
+	}
+
+	// keepalive: session should have been renewed, sampled: counters changed while sampling,
+	// initiating: counters change after the session expired, idle: nothing to send
+	l.record(snap(1000, peer("keepalive", 990, 25, 100), peer("sampled", 990, 0, 100), peer("initiating", 990, 0, 100), peer("idle", 990, 0, 100), peer("removed", 990, 0, 100)))
+	l.record(snap(1200, peer("keepalive", 990, 25, 100), busy(peer("sampled", 990, 0, 100), 1199), peer("initiating", 990, 0, 100), peer("idle", 990, 0, 100)))
+	l.record(snap(1230, peer("keepalive", 990, 25, 100), peer("sampled", 990, 0, 100), peer("initiating", 990, 0, 400), peer("idle", 990, 0, 100)))
+	l.record(snap(1260, peer("keepalive", 990, 25, 100), peer("sampled", 990, 0, 100), peer("initiating", 990, 0, 700), peer("idle", 990, 0, 100)))
+
+	want := []struct {
+		peer, event string
+		time        int64
+	}{
+		{"keepalive", "stale", 1170},
+		{"sampled", "stale", 1170},
+		{"initiating", "expired", 1170},
+		{"idle", "expired", 1170},
+		{"initiating", "stale", 1200},
+	}
+	if len(l.Events) != len(want) {
+		t.Fatalf("Recorded %d events, want %d: %+v", len(l.Events), len(want), l.Events)
+	}
+	for i, event := range l.Events {
+		if event.PublicKey != want[i].peer || event.Type != want[i].event || event.Time != want[i].time {
+			t.Errorf("Event %d: %s %s at %d, want %s %s at %d", i, event.PublicKey, event.Type, event.Time, want[i].peer, want[i].event, want[i].time)
+		}
+	}
+
+	if _, ok := l.Peers["wg0 removed"]; ok {
+		t.Error("Removed peer was not forgotten")
+	}
+	if busy := loadWGBusy(l.path); busy["wg0 initiating"] != 1200 || busy["wg0 idle"] != 0 {
+		t.Errorf("Saved busy times %v", busy)
+	}
+
+	// A failed collection does not drop the peers
+	l.record(snap(1290))
+	if len(l.Peers) != 4 {
+		t.Errorf("Empty snapshot left %d peers, want 4", len(l.Peers))
+	}
+
+	// The events are dated to 1970, so the window has to reach back that far
+	flaps, err := queryWGEvents(Config{StateDir: dir}, url.Values{"window": {"1000000h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range flaps {
+		if expected := map[string]int{"keepalive": 1, "sampled": 1, "initiating": 1}[f.PublicKey]; f.Flaps != expected {
+			t.Errorf("Peer %s flapped %d times, want %d", f.PublicKey, f.Flaps, expected)
+		}
+	}
+}
+
+func TestWGEventLogSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &wgEventLog{path: wgEventFile(dir), max: 100, Peers: make(map[string]wgPeerMark)}
+	l.add(lib.WGEvent{Time: 1000, Interface: "wg0", PublicKey: "key", Type: "stale"})
+	l.save()
+
+	// The log is replaced by renaming, no temporary file remains
+	if _, err := os.Stat(l.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary file remains: %v", err)
+	}
+	saved, err := loadWGEventLog(l.path, 100)
+	if err != nil || len(saved.Events) != 1 {
+		t.Errorf("Saved log = %+v, %v", saved, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// goldenRoutes are requested from the agent running against the fixture tree.
+var goldenRoutes = []string{"uptime", "cpu", "memory", "network", "wireguard", "wireguard/interfaces", "wireguard/lint", "metrics"}
+
+// TestMain runs the agent instead of the tests, if the test binary was started by TestGolden.
+func TestMain(m *testing.M) {
+	if os.Getenv("ICINGA2_AGENT_GOLDEN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TestGolden serves every route in its own agent process, as under xinetd, and compares the
+// responses with the golden files. Run "go test -run TestGolden -update" to update them.
+func TestGolden(t *testing.T) {
+	fixture := filepath.Join("testdata", "g3000")
+
+	for _, route := range goldenRoutes {
+		route := route
+		t.Run(route, func(t *testing.T) {
+			t.Parallel()
+
+			cmd := exec.Command(os.Args[0], "--root", fixture, "-C", filepath.Join(fixture, "icinga2-agent.json"))
+			cmd.Env = append(os.Environ(), "ICINGA2_AGENT_GOLDEN=1")
+			cmd.Stdin = s.NewReader(fmt.Sprintf("GET /%s HTTP/1.1\r\n\r\n", route))
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("Agent failed: %s", err)
+			}
+
+			golden := filepath.Join("testdata", "golden", s.Replace(route, "/", "-", -1)+".txt")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Response differs from %s:\n--- want\n%s\n--- got\n%s", golden, want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+// A series is stored as ring buffer in a file of fixed size: a header holding magic, capacity,
+// index of the next record and number of records, followed by the records. Each record holds the
+// unix time (uint32) and value (float32) of a sample. To spare the flash, the header is only
+// written every historyHeaderEvery records, records appended since are recovered on open.
+const (
+	historyMagic       = "G3H1"
+	historyHeaderSize  = 16
+	historyRecordSize  = 8
+	historyHeaderEvery = 16
+	historyExt         = ".ts"
+	historyMaxPoints   = 500
+)
+
+var errHistoryEmpty = errors.New("File is empty")
+
+// historySeries is a time series stored in a ring buffer file.
+type historySeries struct {
+	file     *os.File
+	capacity uint32
+	head     uint32
+	count    uint32
+	unsaved  int
+}
+
+// openHistorySeries opens the ring buffer file at path. If create is set, a missing or invalid
+// file is (re)created with the given capacity, otherwise the capacity is read from the file.
+func openHistorySeries(path string, capacity uint32, create bool) (*historySeries, error) {
+	flags := os.O_RDONLY
+	if create {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	series := &historySeries{file: f, capacity: capacity}
+
+	err = series.readHeader()
+	if err == nil {
+		return series, nil
+	} else if !create {
+		f.Close()
+		return nil, fmt.Errorf("History file %s is invalid: %w", path, err)
+	} else if err != errHistoryEmpty {
+		log.Printf("Recreating history file %s: %s", path, err)
+	}
+
+	// New or invalid files are (re)initialized with the full size, so the file never grows
+	series.capacity, series.head, series.count = capacity, 0, 0
+	err = f.Truncate(0)
+	if err == nil {
+		err = f.Truncate(int64(historyHeaderSize + capacity*historyRecordSize))
+	}
+	if err == nil {
+		err = series.writeHeader()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return series, nil
+}
+
+// readHeader reads the header and validates it against the size of the file. Records appended
+// after the header was written last are recovered by their ascending time.
+func (series *historySeries) readHeader() error {
+	info, err := series.file.Stat()
+	if err != nil {
+		return err
+	} else if info.Size() == 0 {
+		return errHistoryEmpty
+	}
+
+	header := make([]byte, historyHeaderSize)
+	_, err = series.file.ReadAt(header, 0)
+	if err != nil || string(header[:4]) != historyMagic {
+		return errors.New("Missing header")
+	}
+	series.capacity = binary.LittleEndian.Uint32(header[4:8])
+	series.head = binary.LittleEndian.Uint32(header[8:12])
+	series.count = binary.LittleEndian.Uint32(header[12:16])
+
+	switch {
+	case series.capacity == 0:
+		return errors.New("Capacity is 0")
+	case info.Size() != historyHeaderSize+int64(series.capacity)*historyRecordSize:
+		return fmt.Errorf("File size %d does not match capacity %d", info.Size(), series.capacity)
+	case series.head >= series.capacity || series.count > series.capacity:
+		return fmt.Errorf("Position %d/%d exceeds capacity %d", series.head, series.count, series.capacity)
+	}
+
+	var last uint32
+	record := make([]byte, historyRecordSize)
+	if series.count > 0 {
+		_, err = series.file.ReadAt(record, int64(historyHeaderSize+((series.head+series.capacity-1)%series.capacity)*historyRecordSize))
+		last = binary.LittleEndian.Uint32(record[0:4])
+	}
+	for i := 0; i < historyHeaderEvery && err == nil; i++ {
+		_, err = series.file.ReadAt(record, int64(historyHeaderSize+series.head*historyRecordSize))
+		if err != nil || binary.LittleEndian.Uint32(record[0:4]) <= last {
+			break
+		}
+		last = binary.LittleEndian.Uint32(record[0:4])
+		series.head = (series.head + 1) % series.capacity
+		if series.count < series.capacity {
+			series.count++
+		}
+	}
+	return err
+}
+
+func (series *historySeries) writeHeader() error {
+	header := make([]byte, historyHeaderSize)
+	copy(header, historyMagic)
+	binary.LittleEndian.PutUint32(header[4:8], series.capacity)
+	binary.LittleEndian.PutUint32(header[8:12], series.head)
+	binary.LittleEndian.PutUint32(header[12:16], series.count)
+
+	_, err := series.file.WriteAt(header, 0)
+	return err
+}
+
+// append writes a sample, overwriting the oldest one if the series is full.
+// The header is written after every historyHeaderEvery samples.
+func (series *historySeries) append(t time.Time, value float64) error {
+	record := make([]byte, historyRecordSize)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], math.Float32bits(float32(value)))
+
+	_, err := series.file.WriteAt(record, int64(historyHeaderSize+series.head*historyRecordSize))
+	if err != nil {
+		return err
+	}
+
+	series.head = (series.head + 1) % series.capacity
+	if series.count < series.capacity {
+		series.count++
+	}
+
+	series.unsaved++
+	if series.unsaved < historyHeaderEvery {
+		return nil
+	}
+	series.unsaved = 0
+	return series.writeHeader()
+}
+
+// historyPoint is a single sample of a series.
+type historyPoint struct {
+	Time  int64
+	Value float64
+}
+
+// read returns all samples of the series in chronological order.
+func (series *historySeries) read() ([]historyPoint, error) {
+	data := make([]byte, series.capacity*historyRecordSize)
+	_, err := series.file.ReadAt(data, historyHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]historyPoint, 0, series.count)
+	start := (series.head + series.capacity - series.count) % series.capacity
+	for i := uint32(0); i < series.count; i++ {
+		record := data[((start+i)%series.capacity)*historyRecordSize:]
+		result = append(result, historyPoint{
+			Time:  int64(binary.LittleEndian.Uint32(record[0:4])),
+			Value: float64(math.Float32frombits(binary.LittleEndian.Uint32(record[4:8]))),
+		})
+	}
+	return result, nil
+}
+
+// historyFileName maps a metric name to the name of its file in the history directory.
+func historyFileName(metric string) string {
+	return s.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || s.ContainsRune(".:-_", r) {
+			return r
+		}
+		return '_'
+	}, metric) + historyExt
+}
+
+// historyPeerKey identifies a peer in metric names by its public key, which unlike its allowed IPs
+// is unique and stable. The key is URL-safe base64 encoded, so it maps to a file name unchanged.
+func historyPeerKey(publicKey string) string {
+	return s.NewReplacer("+", "-", "/", "_", "=", "").Replace(publicKey)
+}
+
+// historyValues returns the values of a snapshot that are recorded in the history.
+func historyValues(snap *snapshot) map[string]float64 {
+	result := map[string]float64{
+		"cpu.user":      snap.CPU.User,
+		"cpu.system":    snap.CPU.System,
+		"cpu.idle":      snap.CPU.Idle,
+		"memory.used":   snap.Memory.Used,
+		"memory.cached": snap.Memory.Cached,
+		"memory.free":   snap.Memory.Free,
+	}
+
+	for _, nic := range snap.Network {
+		result["network."+nic.Name+".rx"] = nic.Rx
+		result["network."+nic.Name+".tx"] = nic.Tx
+	}
+
+	for _, peer := range snap.Wireguard {
+		key := historyPeerKey(peer.PublicKey)
+		result["wireguard."+peer.Interface+"."+key+".rx"] = peer.PeerRate.Rx
+		result["wireguard."+peer.Interface+"."+key+".tx"] = peer.PeerRate.Tx
+	}
+
+	return result
+}
+
+// historyStore records snapshots into one series per metric in the history directory. The size
+// on flash is capped by the capacity of each series and the maximum number of series.
+type historyStore struct {
+	dir      string
+	cfg      HistoryConfig
+	last     time.Time
+	series   map[string]*historySeries
+	rejected map[string]bool
+}
+
+func newHistoryStore(cfg Config) *historyStore {
+	return &historyStore{
+		dir:      filepath.Join(cfg.StateDir, "history"),
+		cfg:      cfg.History,
+		series:   make(map[string]*historySeries),
+		rejected: make(map[string]bool),
+	}
+}
+
+// record appends the values of a snapshot, if the configured interval since the last
+// recorded snapshot has passed.
+func (store *historyStore) record(snap *snapshot) {
+	if snap.Time.Sub(store.last) < time.Duration(store.cfg.Interval)*time.Second {
+		return
+	}
+	store.last = snap.Time
+
+	err := os.MkdirAll(store.dir, 0755)
+	if err != nil {
+		log.Printf("Creating history directory failed: %s", err)
+		return
+	}
+
+	for metric, value := range historyValues(snap) {
+		series, ok := store.series[metric]
+		if !ok {
+			if store.rejected[metric] {
+				continue
+			}
+
+			path := filepath.Join(store.dir, historyFileName(metric))
+			_, err := os.Stat(path)
+			if os.IsNotExist(err) && len(store.series) >= store.cfg.MaxSeries {
+				log.Printf("Not recording history of %s, maximum number of series reached", metric)
+				store.rejected[metric] = true
+				continue
+			}
+
+			series, err = openHistorySeries(path, uint32(store.cfg.Capacity), true)
+			if err != nil {
+				log.Printf("Opening history of %s failed: %s", metric, err)
+				store.rejected[metric] = true
+				continue
+			}
+			store.series[metric] = series
+		}
+
+		err := series.append(snap.Time, value)
+		if err != nil {
+			log.Printf("Recording history of %s failed: %s", metric, err)
+		}
+	}
+}
+
+// historyResult is the response of the /history route for a single metric.
+type historyResult struct {
+	Metric string       `json:"metric"`
+	From   int64        `json:"from"`
+	To     int64        `json:"to"`
+	Step   int64        `json:"step"`
+	Points [][2]float64 `json:"points"`
+}
+
+// parseHistoryTime parses a point in time given as unix time or in RFC 3339 format.
+func parseHistoryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return result, errors.New("Invalid time " + value)
+	}
+	return result, nil
+}
+
+// queryHistory answers a query of the /history route. Without a metric, the names of all
+// recorded metrics are returned. Otherwise the samples between from and to (default: last 24h)
+// are averaged over buckets of step secs (default: at most 500 points).
+func queryHistory(cfg Config, query url.Values) (interface{}, error) {
+	dir := filepath.Join(cfg.StateDir, "history")
+
+	metric := query.Get("metric")
+	if metric == "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		metrics := []string{}
+		for _, f := range files {
+			if s.HasSuffix(f.Name(), historyExt) {
+				metrics = append(metrics, s.TrimSuffix(f.Name(), historyExt))
+			}
+		}
+		return map[string][]string{"metrics": metrics}, nil
+	}
+
+	now := host.now()
+	to, err := parseHistoryTime(query.Get("to"), now)
+	if err != nil {
+		return nil, err
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, errors.New("History query needs from to be before to")
+	}
+
+	step := int64(math.Ceil(to.Sub(from).Seconds() / historyMaxPoints))
+	if query.Get("step") != "" {
+		d, err := time.ParseDuration(query.Get("step"))
+		if err != nil {
+			secs, err := strconv.ParseInt(query.Get("step"), 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid step " + query.Get("step"))
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		step = int64(d.Seconds())
+	}
+	if step < int64(cfg.History.Interval) {
+		step = int64(cfg.History.Interval)
+	}
+	if step < 1 {
+		step = 1
+	}
+
+	series, err := openHistorySeries(filepath.Join(dir, historyFileName(metric)), 0, false)
+	if os.IsNotExist(err) {
+		return nil, errors.New("No history recorded for metric " + metric)
+	} else if err != nil {
+		return nil, err
+	}
+	defer series.file.Close()
+
+	points, err := series.read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading history of %s failed: %w", metric, err)
+	}
+
+	return downsample(metric, points, from.Unix(), to.Unix(), step), nil
+}
+
+// downsample averages all points between from and to over buckets of step secs.
+// Buckets without any point are left out.
+func downsample(metric string, points []historyPoint, from int64, to int64, step int64) historyResult {
+	result := historyResult{Metric: metric, From: from, To: to, Step: step, Points: [][2]float64{}}
+
+	sums := make(map[int64]float64)
+	counts := make(map[int64]int)
+	for _, p := range points {
+		if p.Time < from || p.Time > to {
+			continue
+		}
+		bucket := from + (p.Time-from)/step*step
+		sums[bucket] += p.Value
+		counts[bucket]++
+	}
+
+	buckets := make([]int64, 0, len(sums))
+	for bucket := range sums {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	for _, bucket := range buckets {
+		avg := sums[bucket] / float64(counts[bucket])
+		result.Points = append(result.Points, [2]float64{float64(bucket), math.Round(avg*100) / 100})
+	}
+
+	return result
+}
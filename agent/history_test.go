@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func tempHistoryDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeHistoryHeader(t *testing.T, path string, capacity, head, count uint32, size int) {
+	data := make([]byte, size)
+	copy(data, historyMagic)
+	binary.LittleEndian.PutUint32(data[4:8], capacity)
+	binary.LittleEndian.PutUint32(data[8:12], head)
+	binary.LittleEndian.PutUint32(data[12:16], count)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistoryInvalidHeader(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cpu.user.ts")
+
+	tests := []struct {
+		name                  string
+		capacity, head, count uint32
+		size                  int
+	}{
+		{"zero capacity", 0, 0, 0, historyHeaderSize},
+		{"count above capacity", 4, 0, 5, historyHeaderSize + 4*historyRecordSize},
+		{"head at capacity", 4, 4, 4, historyHeaderSize + 4*historyRecordSize},
+		{"truncated records", 4, 1, 1, historyHeaderSize + 2*historyRecordSize},
+		{"missing header", 0, 0, 0, 8},
+	}
+
+	for _, test := range tests {
+		if test.size < historyHeaderSize {
+			ioutil.WriteFile(path, []byte("garbage!"), 0644)
+		} else {
+			writeHistoryHeader(t, path, test.capacity, test.head, test.count, test.size)
+		}
+
+		if _, err := openHistorySeries(path, 0, false); err == nil {
+			t.Errorf("%s: file was opened for reading", test.name)
+		}
+
+		series, err := openHistorySeries(path, 8, true)
+		if err != nil {
+			t.Errorf("%s: file was not recreated: %s", test.name, err)
+			continue
+		}
+		if err := series.append(time.Unix(1000, 0), 1); err != nil {
+			t.Errorf("%s: appending failed: %s", test.name, err)
+		}
+		points, err := series.read()
+		series.file.Close()
+
+		info, _ := os.Stat(path)
+		if err != nil || len(points) != 1 || info.Size() != historyHeaderSize+8*historyRecordSize {
+			t.Errorf("%s: recreated file holds %v (%v) in %d bytes", test.name, points, err, info.Size())
+		}
+	}
+}
+
+func TestHistoryRecoverUnsavedRecords(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cpu.user.ts")
+
+	// The header is not written for all appends, the rest is recovered by time
+	for _, appends := range []int{3, historyHeaderEvery + 5, 3*historyHeaderEvery - 1} {
+		os.Remove(path)
+		series, err := openHistorySeries(path, 20, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= appends; i++ {
+			if err := series.append(time.Unix(int64(1000+60*i), 0), float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		series.file.Close()
+
+		series, err = openHistorySeries(path, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points, err := series.read()
+		series.file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := appends
+		if want > 20 {
+			want = 20
+		}
+		if len(points) != want {
+			t.Fatalf("%d appends: read %d points, want %d", appends, len(points), want)
+		}
+		for i, p := range points {
+			if value := float64(appends - want + i + 1); p.Value != value || p.Time != int64(1000+60*value) {
+				t.Errorf("%d appends: point %d = %v, want value %g", appends, i, p, value)
+			}
+		}
+	}
+}
+
+func TestHistoryValuesPeers(t *testing.T) {
+	snap := &snapshot{Wireguard: []lib.WGPeer{
+		{Interface: "wg0", PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", IntIPAddr: "(none)", PeerRate: lib.PeerRate{Rx: 1}},
+		{Interface: "wg0", PublicKey: "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=", IntIPAddr: "(none)", PeerRate: lib.PeerRate{Rx: 2}},
+		{Interface: "wg0", PublicKey: "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAq/dyYBz6EA=", IntIPAddr: "10.0.0.2/32", PeerRate: lib.PeerRate{Rx: 3}},
+	}}
+
+	// Peers without allowed IPs get series of their own
+	values := historyValues(snap)
+	want := map[string]float64{
+		"wireguard.wg0.xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg.rx": 1,
+		"wireguard.wg0.TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi-y71lOWWXX0.rx": 2,
+		"wireguard.wg0.gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAq_dyYBz6EA.rx": 3,
+	}
+	for metric, value := range want {
+		if values[metric] != value {
+			t.Errorf("%s = %g, want %g", metric, values[metric], value)
+		}
+		if historyFileName(metric) != metric+historyExt {
+			t.Errorf("%s is stored as %s", metric, historyFileName(metric))
+		}
+	}
+}
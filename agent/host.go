@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	s "strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// commandRunner runs external commands like "wg" and returns their standard output.
+type commandRunner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// execRunner runs commands on the host.
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// fixtureSequence reads recorded files of a fixture tree. If numbered files ("stat.1", ".2", ...)
+// exist, successive reads of a file return them in order and the last one is repeated, so rates
+// can be calculated from recorded samples.
+type fixtureSequence struct {
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func newFixtureSequence() *fixtureSequence {
+	return &fixtureSequence{reads: make(map[string]int)}
+}
+
+func (seq *fixtureSequence) read(file string) ([]byte, error) {
+	seq.mu.Lock()
+	seq.reads[file]++
+	read := seq.reads[file]
+	seq.mu.Unlock()
+
+	for ; read > 0; read-- {
+		out, err := ioutil.ReadFile(file + "." + strconv.Itoa(read))
+		if !os.IsNotExist(err) {
+			return out, err
+		}
+	}
+	return ioutil.ReadFile(file)
+}
+
+// fixtureRunner replays command output recorded in a directory instead of running commands. The
+// output of "wg show wg0 dump" is read from the file "wg_show_wg0_dump" or its numbered samples.
+type fixtureRunner struct {
+	dir string
+	seq *fixtureSequence
+}
+
+func newFixtureRunner(dir string, seq *fixtureSequence) *fixtureRunner {
+	return &fixtureRunner{dir: dir, seq: seq}
+}
+
+func (r *fixtureRunner) Run(name string, args ...string) ([]byte, error) {
+	return r.seq.read(filepath.Join(r.dir, s.Join(append([]string{name}, args...), "_")))
+}
+
+// nativeEndian is the byte order of the host, in which the kernel prints the addresses of IPv4
+// routes and encodes netlink headers and attributes.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	var probe uint16 = 1
+	if (*[2]byte)(unsafe.Pointer(&probe))[0] == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// hostEnv gives the collectors access to the procfs and sysfs of the gateway, to external
+// commands and to the state of Wireguard interfaces. Roots and runner can be replaced to run the
+// agent against a recorded fixture tree, whose procfs files are read as sequence of samples. The
+// raw sockets of ICMP probes are opened by listenPacket. The clock can be pinned to the time a
+// fixture tree was recorded, so peers are classified as on the gateway.
+type hostEnv struct {
+	procRoot     string
+	sysRoot      string
+	procSamples  *fixtureSequence
+	runner       commandRunner
+	wg           wgClient
+	netRoles     map[string][]string
+	netCapacity  map[string]float64
+	wgInterfaces []string
+	wgNames      string
+	wgConfigDir  string
+	probes       string
+	probeMaxAge  time.Duration
+	wgEvents     string
+	listenPacket func(network, address string) (net.PacketConn, error)
+	clock        func() time.Time
+}
+
+var host = &hostEnv{procRoot: "/proc", sysRoot: "/sys", runner: execRunner{}, wg: autoWGClient{}, listenPacket: net.ListenPacket, clock: time.Now}
+
+// configureHost sets up the host environment from the configuration.
+func configureHost(cfg Config) {
+	host.procRoot = cfg.ProcRoot
+	host.sysRoot = cfg.SysRoot
+	if cfg.CommandFixtures != "" {
+		host.procSamples = newFixtureSequence()
+		host.runner = newFixtureRunner(cfg.CommandFixtures, host.procSamples)
+	} else {
+		host.procSamples = nil
+		host.runner = execRunner{}
+	}
+	host.wg = newWGClient(cfg)
+	host.clock = time.Now
+	if cfg.FixtureTime != 0 {
+		pinned := time.Unix(cfg.FixtureTime, 0)
+		host.clock = func() time.Time { return pinned }
+	}
+	host.netRoles = cfg.Network.Roles
+	host.netCapacity = cfg.Network.Capacity
+	host.wgInterfaces = cfg.Wireguard.Interfaces
+	host.wgNames = cfg.Wireguard.Names
+	host.wgConfigDir = cfg.Wireguard.ConfigDir
+	host.wgEvents = wgEventFile(cfg.StateDir)
+	host.probes = ""
+	if cfg.Probes.Enabled {
+		// A round takes up to count timeouts longer than the interval, results are kept for three
+		host.probes = probeFile(cfg.StateDir)
+		host.probeMaxAge = 3 * time.Duration(cfg.Probes.Interval+cfg.Probes.Count*cfg.Probes.Timeout) * time.Second
+	}
+}
+
+// proc returns the path of a file below the procfs root.
+func (h *hostEnv) proc(parts ...string) string {
+	return filepath.Join(append([]string{h.procRoot}, parts...)...)
+}
+
+// sys returns the path of a file below the sysfs root.
+func (h *hostEnv) sys(parts ...string) string {
+	return filepath.Join(append([]string{h.sysRoot}, parts...)...)
+}
+
+// readProc reads a file below the procfs root.
+func (h *hostEnv) readProc(parts ...string) ([]byte, error) {
+	if h.procSamples != nil {
+		return h.procSamples.read(h.proc(parts...))
+	}
+	return ioutil.ReadFile(h.proc(parts...))
+}
+
+// readSys reads a file below the sysfs root and returns its content without surrounding whitespace.
+func (h *hostEnv) readSys(parts ...string) (string, error) {
+	data, err := ioutil.ReadFile(h.sys(parts...))
+	return s.TrimSpace(string(data)), err
+}
+
+// replaceFile replaces a file of the state directory atomically by writing a temporary file and
+// renaming it. Requests are served by separate processes, which read the state at any time.
+func replaceFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// now returns the current time of the configured clock.
+func (h *hostEnv) now() time.Time {
+	return h.clock()
+}
+
+// run runs an external command using the configured runner.
+func (h *hostEnv) run(name string, args ...string) ([]byte, error) {
+	return h.runner.Run(name, args...)
+}
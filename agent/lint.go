@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	s "strings"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// wgLinter collects findings about the configuration of Wireguard interfaces.
+type wgLinter struct {
+	findings []lib.WGLintFinding
+}
+
+func (l *wgLinter) report(severity string, check string, peer lib.WGPeer, format string, args ...interface{}) {
+	l.findings = append(l.findings, lib.WGLintFinding{
+		Severity:  severity,
+		Check:     check,
+		Interface: peer.Interface,
+		PublicKey: peer.PublicKey,
+		Message:   lib.PeerLabel(peer) + " " + fmt.Sprintf(format, args...),
+	})
+}
+
+// getWGLint checks the live state of all monitored Wireguard interfaces together with the routing
+// table for duplicated public keys, overlapping allowed IPs, peers behind NAT without persistent
+// keepalive and allowed IPs without route through the interface.
+func getWGLint() ([]lib.WGLintFinding, error) {
+	names, err := wireguardInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := readWGDevices(names)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := readRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("Reading routing table failed: %w", err)
+	}
+
+	var peers []lib.WGPeer
+	for _, dev := range devices {
+		peers = append(peers, getWGPeers(dev, dev, nil)...)
+	}
+	peerNames, err := loadPeerNames(host.wgNames, host.wgConfigDir, names)
+	if err != nil {
+		return nil, err
+	}
+	namePeers(peers, peerNames)
+
+	endpoints, err := loadWGConfigEndpoints(host.wgConfigDir, names)
+	if err != nil {
+		return nil, err
+	}
+	var events []lib.WGEvent
+	if eventLog, err := loadWGEventLog(host.wgEvents, 0); err == nil {
+		events = eventLog.Events
+	}
+
+	linter := &wgLinter{findings: []lib.WGLintFinding{}}
+	linter.lintPublicKeys(devices, peers)
+	linter.lintAllowedIPs(peers)
+	linter.lintKeepalive(peers, endpoints, events, host.now().Unix())
+	linter.lintRoutes(devices, peers, routes)
+
+	severity := map[string]int{"critical": 0, "warning": 1}
+	sort.SliceStable(linter.findings, func(i, j int) bool {
+		a, b := linter.findings[i], linter.findings[j]
+		if a.Severity != b.Severity {
+			return severity[a.Severity] < severity[b.Severity]
+		}
+		return a.Interface < b.Interface
+	})
+	return linter.findings, nil
+}
+
+// lintPublicKeys reports peers using the key of an interface of the gateway and peers configured
+// on several interfaces.
+func (l *wgLinter) lintPublicKeys(devices []wgDevice, peers []lib.WGPeer) {
+	own := make(map[string]string)
+	for _, dev := range devices {
+		own[dev.PublicKey] = dev.Name
+	}
+
+	seen := make(map[string]lib.WGPeer)
+	for _, peer := range peers {
+		if iface, ok := own[peer.PublicKey]; ok {
+			l.report("critical", "duplicate-public-key", peer, "uses the public key of interface %s", iface)
+		}
+		if first, ok := seen[peer.PublicKey]; ok {
+			l.report("warning", "duplicate-public-key", peer, "uses the same public key as %s", lib.PeerLabel(first))
+		} else {
+			seen[peer.PublicKey] = peer
+		}
+	}
+}
+
+// lintAllowedIPs reports allowed IPs of different peers that are equal (critical, as only one of
+// the peers can be reached) or contained in each other (warning, as the more specific prefix
+// shadows part of the other).
+func (l *wgLinter) lintAllowedIPs(peers []lib.WGPeer) {
+	for i := range peers {
+		for j := i + 1; j < len(peers); j++ {
+			for _, a := range peers[i].AllowedIPs {
+				_, x, err := net.ParseCIDR(a)
+				if err != nil {
+					continue
+				}
+				for _, b := range peers[j].AllowedIPs {
+					_, y, err := net.ParseCIDR(b)
+					if err != nil || (!x.Contains(y.IP) && !y.Contains(x.IP)) {
+						continue
+					}
+					if x.String() == y.String() {
+						l.report("critical", "overlapping-allowed-ips", peers[j], "has the same allowed IP %s as %s", y, lib.PeerLabel(peers[i]))
+					} else {
+						l.report("warning", "overlapping-allowed-ips", peers[j], "has allowed IP %s overlapping %s of %s", y, x, lib.PeerLabel(peers[i]))
+					}
+				}
+			}
+		}
+	}
+}
+
+// lintKeepalive reports peers behind NAT without persistent keepalive, as the NAT mapping expires
+// once the peer is idle and the gateway can no longer reach it. A peer is taken to be behind NAT
+// if it sends from another port than its configured endpoint or if the port of its endpoint
+// changed without the address changing within the last 24h, as NAT devices do when they rebind.
+func (l *wgLinter) lintKeepalive(peers []lib.WGPeer, endpoints map[string]string, events []lib.WGEvent, now int64) {
+	for _, peer := range peers {
+		if peer.Keepalive > 0 || peer.ExtIPAddr == "(none)" {
+			continue
+		}
+		addr, port, err := net.SplitHostPort(peer.ExtIPAddr)
+		if err != nil {
+			continue
+		}
+
+		var evidence string
+		if configured, ok := endpoints[peer.Interface+" "+peer.PublicKey]; ok {
+			if _, configuredPort, err := net.SplitHostPort(configured); err == nil && configuredPort != port {
+				evidence = fmt.Sprintf("sends from port %s instead of the port of its configured endpoint %s", port, configured)
+			}
+		}
+		for _, event := range events {
+			if event.Type != "endpoint" || event.Interface != peer.Interface || event.PublicKey != peer.PublicKey || event.Time < now-24*60*60 {
+				continue
+			}
+			fromAddr, _, err := net.SplitHostPort(event.From)
+			if evidence == "" && err == nil && fromAddr == addr && event.From != event.To {
+				evidence = fmt.Sprintf("changed its source port from %s to %s", event.From, event.To)
+			}
+		}
+
+		if evidence != "" {
+			l.report("warning", "keepalive-behind-nat", peer, "has no persistent keepalive, but %s, so it is behind NAT", evidence)
+		}
+	}
+}
+
+// loadWGConfigEndpoints reads the endpoints configured for peers in the Wireguard configuration
+// files of the given interfaces, keyed by interface and public key.
+func loadWGConfigEndpoints(configDir string, interfaces []string) (map[string]string, error) {
+	result := make(map[string]string)
+	if configDir == "" {
+		return result, nil
+	}
+
+	for _, iface := range interfaces {
+		f, err := os.Open(filepath.Join(configDir, iface+".conf"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return result, fmt.Errorf("Reading endpoints from Wireguard config of %s failed: %w", iface, err)
+		}
+
+		var publicKey, endpoint string
+		flush := func() {
+			if publicKey != "" && endpoint != "" {
+				result[iface+" "+publicKey] = endpoint
+			}
+			publicKey, endpoint = "", ""
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := s.TrimSpace(scanner.Text())
+			if s.HasPrefix(line, "[") {
+				flush()
+				continue
+			}
+
+			parts := s.SplitN(line, "=", 2)
+			if len(parts) != 2 || s.HasPrefix(line, "#") {
+				continue
+			}
+			switch key, value := s.TrimSpace(parts[0]), s.TrimSpace(parts[1]); {
+			case s.EqualFold(key, "PublicKey"):
+				publicKey = value
+			case s.EqualFold(key, "Endpoint"):
+				endpoint = value
+			}
+		}
+		flush()
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return result, fmt.Errorf("Reading endpoints from Wireguard config of %s failed: %w", iface, err)
+		}
+	}
+
+	return result, nil
+}
+
+// lintRoutes reports allowed IPs without a route through the interface of the peer. Default
+// routes of interfaces with fwmark are skipped, as wg-quick routes them in a separate table.
+func (l *wgLinter) lintRoutes(devices []wgDevice, peers []lib.WGPeer, routes []route) {
+	fwmark := make(map[string]bool)
+	for _, dev := range devices {
+		fwmark[dev.Name] = dev.FwMark != 0
+	}
+
+	for _, peer := range peers {
+		for _, allowed := range peer.AllowedIPs {
+			_, network, err := net.ParseCIDR(allowed)
+			if err != nil {
+				continue
+			}
+			ones, bits := network.Mask.Size()
+			if ones == 0 && fwmark[peer.Interface] {
+				continue
+			}
+
+			routed := false
+			for _, r := range routes {
+				routeOnes, routeBits := r.Network.Mask.Size()
+				if r.Interface == peer.Interface && routeBits == bits && routeOnes <= ones && r.Network.Contains(network.IP) {
+					routed = true
+					break
+				}
+			}
+			if !routed {
+				l.report("warning", "missing-route", peer, "has allowed IP %s, but it is not routed through %s", network, peer.Interface)
+			}
+		}
+	}
+}
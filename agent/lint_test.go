@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestLintKeepalive(t *testing.T) {
+	const now = 1700000000
+	peer := func(endpoint string, keepalive int) lib.WGPeer {
+		return lib.WGPeer{Interface: "wg0", PublicKey: "key", AllowedIPs: []string{"10.0.0.2/32"}, ExtIPAddr: endpoint, Keepalive: keepalive}
+	}
+	moved := func(from, to string, time int64) []lib.WGEvent {
+		return []lib.WGEvent{{Time: time, Interface: "wg0", PublicKey: "key", Type: "endpoint", From: from, To: to}}
+	}
+	configured := map[string]string{"wg0 key": "plant.example.com:51820"}
+
+	tests := []struct {
+		name      string
+		peer      lib.WGPeer
+		endpoints map[string]string
+		events    []lib.WGEvent
+		finding   bool
+	}{
+		{"private address without evidence", peer("192.168.1.10:51820", 0), nil, nil, false},
+		{"configured port", peer("198.51.100.22:51820", 0), configured, nil, false},
+		{"port differs from configured endpoint", peer("198.51.100.22:41237", 0), configured, nil, true},
+		{"port differs with keepalive", peer("198.51.100.22:41237", 25), configured, nil, false},
+		{"source port changed", peer("198.51.100.22:41237", 0), nil, moved("198.51.100.22:40112", "198.51.100.22:41237", now-3600), true},
+		{"IPv6 source port changed", peer("[2001:db8::10]:41237", 0), nil, moved("[2001:db8::10]:40112", "[2001:db8::10]:41237", now-3600), true},
+		{"roamed to another address", peer("198.51.100.22:51820", 0), nil, moved("203.0.113.10:51820", "198.51.100.22:51820", now-3600), false},
+		{"source port changed days ago", peer("198.51.100.22:41237", 0), nil, moved("198.51.100.22:40112", "198.51.100.22:41237", now-3*86400), false},
+		{"no endpoint", peer("(none)", 0), configured, nil, false},
+	}
+
+	for _, test := range tests {
+		l := &wgLinter{}
+		l.lintKeepalive([]lib.WGPeer{test.peer}, test.endpoints, test.events, now)
+		if found := len(l.findings) > 0; found != test.finding {
+			t.Errorf("%s: findings %v, want finding %t", test.name, l.findings, test.finding)
+		}
+	}
+}
+
+func TestReadRoutes(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("Routing table was recorded on a little-endian host")
+	}
+
+	saved := *host
+	defer func() { *host = saved }()
+	host.procRoot, host.procSamples = "testdata/g3000/proc", nil
+
+	routes, err := readRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"eth0 0.0.0.0/0", "eth0 192.0.2.0/24", "wg0 10.0.0.0/24", "wg0 192.168.10.0/24", "wg1 10.1.0.0/24"}
+	if len(routes) < len(want) {
+		t.Fatalf("Read %d routes, want at least %d", len(routes), len(want))
+	}
+	for i, w := range want {
+		if got := routes[i].Interface + " " + routes[i].Network.String(); got != w {
+			t.Errorf("Route %d = %s, want %s", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	s "strings"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+const (
+	nrpeQueryPacket    = 1
+	nrpeResponsePacket = 2
+
+	nrpeV2PacketSize  = 1036
+	nrpeV2BufferSize  = 1024
+	nrpeV3HeaderSize  = 16
+	nrpeV3MaxBuffer   = 65536
+	nrpeV3MaxTrailing = 8
+)
+
+// defaultNRPECommands holds the commands which are available without being configured.
+// Their target and thresholds can be passed as arguments, if arguments are allowed.
+var defaultNRPECommands = map[string]NRPECommand{
+	"check_uptime":         {Check: "uptime"},
+	"check_cpu":            {Check: "cpu"},
+	"check_memory":         {Check: "memory"},
+	"check_net_upstream":   {Check: "upstream", Target: "eth0"},
+	"check_net_downstream": {Check: "downstream", Target: "eth0"},
+	"check_wg_handshake":   {Check: "wg_handshake", Target: "1"},
+	"check_wg_upstream":    {Check: "wg_upstream", Target: "1"},
+	"check_wg_downstream":  {Check: "wg_downstream", Target: "1"},
+}
+
+// stdioAddr is the placeholder address of a connection handed over by xinetd.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn wraps the connection handed over by xinetd on stdin and stdout into a net.Conn,
+// so it can be used as the transport of a TLS session.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error                       { return nil }
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// loadTLSConfig creates the server side TLS configuration from the configured certificate files.
+// If a CA is configured, clients have to present a certificate signed by it.
+func loadTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.Cert == "" || cfg.Key == "" {
+		return nil, errors.New("TLS requested but no certificate is configured")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Loading TLS certificate failed: %w", err)
+	}
+	result := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Reading TLS CA failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("TLS CA holds no certificates")
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return result, nil
+}
+
+// serveNRPE answers a single NRPE query. If the first byte read is the start of a TLS handshake,
+// the connection is wrapped into a TLS session first.
+func serveNRPE(cfg NRPEConfig, rd *bufio.Reader, w io.Writer) error {
+	first, err := rd.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if first[0] == 0x16 {
+		tlsCfg, err := loadTLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		conn := tls.Server(stdioConn{rd, w}, tlsCfg)
+		defer conn.Close()
+
+		return handleNRPEPacket(cfg, bufio.NewReader(conn), conn)
+	} else if cfg.TLS.Required {
+		return errors.New("NRPE query without TLS rejected")
+	}
+
+	return handleNRPEPacket(cfg, rd, w)
+}
+
+// handleNRPEPacket reads a query packet from rd, runs the requested command and writes
+// the response packet in the same protocol version to w.
+func handleNRPEPacket(cfg NRPEConfig, rd *bufio.Reader, w io.Writer) error {
+	version, query, trailing, err := readNRPEPacket(rd)
+	if err != nil {
+		return err
+	}
+
+	state, output := runNRPECommand(cfg, query)
+
+	_, err = w.Write(buildNRPEPacket(version, state, output, trailing))
+	return err
+}
+
+// readNRPEPacket reads a version 2 or 3 query packet and validates its CRC32 checksum.
+// Besides the protocol version and the query it returns the number of padding bytes that
+// followed the buffer of a version 3 packet, as this differs between NRPE releases.
+func readNRPEPacket(rd *bufio.Reader) (int, string, int, error) {
+	header := make([]byte, nrpeV3HeaderSize)
+	_, err := io.ReadFull(rd, header)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("Reading NRPE packet failed: %w", err)
+	}
+
+	version := int(binary.BigEndian.Uint16(header[0:2]))
+	if binary.BigEndian.Uint16(header[2:4]) != nrpeQueryPacket {
+		return version, "", 0, errors.New("NRPE packet is not a query")
+	}
+
+	var packet, buffer []byte
+	trailing := 0
+
+	switch version {
+	case 2:
+		packet = make([]byte, nrpeV2PacketSize)
+		copy(packet, header)
+		_, err = io.ReadFull(rd, packet[nrpeV3HeaderSize:])
+		if err != nil {
+			return version, "", 0, fmt.Errorf("Reading NRPE packet failed: %w", err)
+		}
+		if !validNRPEChecksum(packet) {
+			return version, "", 0, errors.New("NRPE packet has an invalid CRC32 checksum")
+		}
+		buffer = packet[10 : 10+nrpeV2BufferSize]
+	case 3:
+		length := int(binary.BigEndian.Uint32(header[12:16]))
+		if length > nrpeV3MaxBuffer {
+			return version, "", 0, errors.New("NRPE packet exceeds maximum size")
+		}
+		packet = make([]byte, nrpeV3HeaderSize+length)
+		copy(packet, header)
+		_, err = io.ReadFull(rd, packet[nrpeV3HeaderSize:])
+		if err != nil {
+			return version, "", 0, fmt.Errorf("Reading NRPE packet failed: %w", err)
+		}
+
+		// Padding is only consumed if it already arrived together with the packet
+		extra := rd.Buffered()
+		if extra > nrpeV3MaxTrailing {
+			extra = nrpeV3MaxTrailing
+		}
+		padding := make([]byte, extra)
+		io.ReadFull(rd, padding)
+
+		for trailing = 0; trailing <= extra; trailing++ {
+			if validNRPEChecksum(append(packet[:len(packet):len(packet)], padding[:trailing]...)) {
+				break
+			}
+		}
+		if trailing > extra {
+			return version, "", 0, errors.New("NRPE packet has an invalid CRC32 checksum")
+		}
+		buffer = packet[nrpeV3HeaderSize:]
+	default:
+		return version, "", 0, errors.New("NRPE packet version " + strconv.Itoa(version) + " is not supported")
+	}
+
+	if i := bytes.IndexByte(buffer, 0); i >= 0 {
+		buffer = buffer[:i]
+	}
+
+	return version, string(buffer), trailing, nil
+}
+
+// validNRPEChecksum compares the checksum stored in packet with the CRC32 of the packet
+// calculated with a zeroed checksum field.
+func validNRPEChecksum(packet []byte) bool {
+	expected := binary.BigEndian.Uint32(packet[4:8])
+
+	data := make([]byte, len(packet))
+	copy(data, packet)
+	binary.BigEndian.PutUint32(data[4:8], 0)
+
+	return crc32.ChecksumIEEE(data) == expected
+}
+
+// buildNRPEPacket creates a response packet carrying the service state and plugin output.
+func buildNRPEPacket(version int, state int, output string, trailing int) []byte {
+	var packet []byte
+
+	if version == 2 {
+		packet = make([]byte, nrpeV2PacketSize)
+		if len(output) > nrpeV2BufferSize-1 {
+			output = output[:nrpeV2BufferSize-1]
+		}
+		copy(packet[10:], output)
+	} else {
+		packet = make([]byte, nrpeV3HeaderSize+len(output)+1+trailing)
+		binary.BigEndian.PutUint32(packet[12:16], uint32(len(output)+1))
+		copy(packet[nrpeV3HeaderSize:], output)
+	}
+
+	binary.BigEndian.PutUint16(packet[0:2], uint16(version))
+	binary.BigEndian.PutUint16(packet[2:4], nrpeResponsePacket)
+	binary.BigEndian.PutUint16(packet[8:10], uint16(state))
+	binary.BigEndian.PutUint32(packet[4:8], crc32.ChecksumIEEE(packet))
+
+	return packet
+}
+
+// runNRPECommand resolves an NRPE query of the form "command!arg1!arg2" to a built-in check.
+// Arguments are the target of the check (if it has one) followed by the warning and critical
+// threshold. They are only accepted if allowed by the configuration.
+func runNRPECommand(cfg NRPEConfig, query string) (int, string) {
+	args := s.Split(query, "!")
+	name := args[0]
+	args = args[1:]
+
+	if name == "_NRPE_CHECK" {
+		return lib.StateOk, "icinga2-agent v" + version
+	}
+
+	if len(args) > 0 && !cfg.AllowArguments {
+		return lib.StateUnknown, "UNKNOWN - Command arguments are not allowed"
+	}
+
+	command, ok := cfg.Commands[name]
+	if !ok {
+		command, ok = defaultNRPECommands[name]
+	}
+	if !ok {
+		return lib.StateUnknown, "UNKNOWN - Command " + name + " is not defined"
+	}
+
+	if builtinChecks[command.Check].hasTarget && len(args) > 0 {
+		if args[0] != "" {
+			command.Target = args[0]
+		}
+		args = args[1:]
+	}
+
+	thresholds := []**float64{&command.Warning, &command.Critical}
+	for i := 0; i < len(args) && i < len(thresholds); i++ {
+		if args[i] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return lib.StateUnknown, "UNKNOWN - Invalid threshold " + args[i]
+		}
+		*thresholds[i] = &value
+	}
+
+	return runCheck(command.Check, command.Target, command.Warning, command.Critical)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	s "strings"
+	"testing"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// checkNRPEv2 builds a query packet as check_nrpe 2.x does: the packed struct is padded to 1036
+// bytes and the buffer behind the query is filled with random bytes.
+func checkNRPEv2(query string) []byte {
+	packet := make([]byte, nrpeV2PacketSize)
+	rand.New(rand.NewSource(1)).Read(packet)
+	binary.BigEndian.PutUint16(packet[0:2], 2)
+	binary.BigEndian.PutUint16(packet[2:4], nrpeQueryPacket)
+	binary.BigEndian.PutUint32(packet[4:8], 0)
+	binary.BigEndian.PutUint16(packet[8:10], 0)
+	copy(packet[10:], query+"\x00")
+	binary.BigEndian.PutUint32(packet[4:8], crc32.ChecksumIEEE(packet))
+	return packet
+}
+
+// checkNRPEv3 builds a query packet as check_nrpe 3.x does: the packet is at least as large as
+// a version 2 packet, the buffer length does not cover the padding of the struct, so trailing
+// bytes follow the buffer.
+func checkNRPEv3(query string, trailing int) []byte {
+	size := nrpeV3HeaderSize + len(query) + 1 + trailing
+	if size < nrpeV2PacketSize {
+		size = nrpeV2PacketSize
+	}
+	packet := make([]byte, size)
+	binary.BigEndian.PutUint16(packet[0:2], 3)
+	binary.BigEndian.PutUint16(packet[2:4], nrpeQueryPacket)
+	binary.BigEndian.PutUint32(packet[12:16], uint32(size-nrpeV3HeaderSize-trailing))
+	copy(packet[nrpeV3HeaderSize:], query)
+	binary.BigEndian.PutUint32(packet[4:8], crc32.ChecksumIEEE(packet))
+	return packet
+}
+
+func TestReadNRPEPacket(t *testing.T) {
+	corrupt := checkNRPEv2("check_cpu")
+	corrupt[20] ^= 0xff
+	oversized := checkNRPEv3("check_cpu", 0)
+	binary.BigEndian.PutUint32(oversized[12:16], nrpeV3MaxBuffer+1)
+	response := checkNRPEv2("check_cpu")
+	binary.BigEndian.PutUint16(response[2:4], nrpeResponsePacket)
+	version4 := checkNRPEv3("check_cpu", 0)
+	binary.BigEndian.PutUint16(version4[0:2], 4)
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		version  int
+		query    string
+		trailing int
+		err      string
+	}{
+		{"v2", checkNRPEv2("check_wg_handshake!7!300!600"), 2, "check_wg_handshake!7!300!600", 0, ""},
+		{"v2 corrupt", corrupt, 2, "", 0, "invalid CRC32"},
+		{"v2 truncated", checkNRPEv2("check_cpu")[:500], 2, "", 0, "Reading NRPE packet failed"},
+		{"v3 without padding", checkNRPEv3("check_cpu", 0), 3, "check_cpu", 0, ""},
+		{"v3 padded", checkNRPEv3("check_cpu", 3), 3, "check_cpu", 3, ""},
+		{"v3 long query padded", checkNRPEv3(s.Repeat("x", 2000), 3), 3, s.Repeat("x", 2000), 3, ""},
+		{"v3 padding beyond limit", checkNRPEv3(s.Repeat("x", 2000), nrpeV3MaxTrailing+1), 3, "", 0, "invalid CRC32"},
+		{"v3 oversized", oversized, 3, "", 0, "exceeds maximum size"},
+		{"v3 truncated", checkNRPEv3("check_cpu", 0)[:100], 3, "", 0, "Reading NRPE packet failed"},
+		{"response", response, 2, "", 0, "not a query"},
+		{"v4", version4, 4, "", 0, "not supported"},
+		{"short header", []byte{0, 2, 0, 1}, 0, "", 0, "Reading NRPE packet failed"},
+	}
+
+	for _, test := range tests {
+		version, query, trailing, err := readNRPEPacket(bufio.NewReader(bytes.NewReader(test.packet)))
+		if test.err != "" {
+			if err == nil || !s.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || version != test.version || query != test.query || trailing != test.trailing {
+			t.Errorf("%s: got version %d, query %.20q, %d trailing bytes, %v", test.name, version, query, trailing, err)
+		}
+	}
+}
+
+func TestHandleNRPEPacket(t *testing.T) {
+	// Responses carry as many trailing bytes as the query, check_nrpe 3.x expects them
+	for _, packet := range [][]byte{checkNRPEv2("_NRPE_CHECK"), checkNRPEv3("_NRPE_CHECK", 3)} {
+		var out bytes.Buffer
+		if err := handleNRPEPacket(NRPEConfig{}, bufio.NewReader(bytes.NewReader(packet)), &out); err != nil {
+			t.Fatal(err)
+		}
+		resp := out.Bytes()
+
+		v := binary.BigEndian.Uint16(resp[0:2])
+		if !validNRPEChecksum(resp) || binary.BigEndian.Uint16(resp[2:4]) != nrpeResponsePacket {
+			t.Errorf("v%d: invalid response packet %x", v, resp[:16])
+		}
+		want := nrpeV2PacketSize
+		if v == 3 {
+			want = nrpeV3HeaderSize + len("icinga2-agent v"+version) + 1 + 3
+		}
+		if len(resp) != want {
+			t.Errorf("v%d: response of %d bytes, want %d", v, len(resp), want)
+		}
+		if !bytes.Contains(resp, []byte("icinga2-agent v"+version)) {
+			t.Errorf("v%d: response lacks the agent version", v)
+		}
+	}
+}
+
+func TestRunNRPECommand(t *testing.T) {
+	cfg := NRPEConfig{AllowArguments: true}
+	tests := []struct {
+		cfg    NRPEConfig
+		query  string
+		output string
+	}{
+		{NRPEConfig{}, "check_cpu!50!80", "UNKNOWN - Command arguments are not allowed"},
+		{cfg, "check_foo", "UNKNOWN - Command check_foo is not defined"},
+		{cfg, "check_cpu!high", "UNKNOWN - Invalid threshold high"},
+		{cfg, "check_net_upstream!eth0!x", "UNKNOWN - Invalid threshold x"},
+	}
+	for _, test := range tests {
+		state, output := runNRPECommand(test.cfg, test.query)
+		if state != lib.StateUnknown || output != test.output {
+			t.Errorf("%s: %d %q, want UNKNOWN %q", test.query, state, output, test.output)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	s "strings"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// peerName assigns a name and metadata (e.g. site, customer, contact) to the Wireguard peer
+// with the given public key or allowed IP in CIDR notation.
+type peerName struct {
+	PublicKey string            `json:"public_key"`
+	AllowedIP string            `json:"allowed_ip"`
+	Name      string            `json:"name"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// loadPeerNames reads the peer names of the mapping file followed by the names found in
+// comments of the Wireguard configuration files. Earlier entries take precedence.
+func loadPeerNames(names string, configDir string, interfaces []string) ([]peerName, error) {
+	var result []peerName
+
+	if names != "" {
+		data, err := ioutil.ReadFile(names)
+		if err != nil && !os.IsNotExist(err) {
+			return result, fmt.Errorf("Reading peer names failed: %w", err)
+		} else if err == nil {
+			err = json.Unmarshal(data, &result)
+			if err != nil {
+				return result, fmt.Errorf("Parsing peer names %s failed: %w", names, err)
+			}
+		}
+	}
+
+	if configDir != "" {
+		for _, iface := range interfaces {
+			fromConfig, err := parseWGConfigNames(filepath.Join(configDir, iface+".conf"))
+			if err != nil && !os.IsNotExist(err) {
+				return result, fmt.Errorf("Reading names from Wireguard config of %s failed: %w", iface, err)
+			}
+			result = append(result, fromConfig...)
+		}
+	}
+
+	return result, nil
+}
+
+// parseWGConfigNames reads the names of peers from comments in a Wireguard configuration file.
+// Comments in a [Peer] section of the form "# Name = plant-berlin" set the name, all other
+// comments of the form "# Key = value" are added to the metadata with a lowercase key:
+//
+//	[Peer]
+//	# Name = plant-berlin
+//	# Site = Berlin
+//	PublicKey = ...
+func parseWGConfigNames(path string) ([]peerName, error) {
+	var result []peerName
+
+	f, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	var current *peerName
+	flush := func() {
+		if current != nil && current.PublicKey != "" && (current.Name != "" || len(current.Metadata) > 0) {
+			result = append(result, *current)
+		}
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := s.TrimSpace(scanner.Text())
+
+		if s.HasPrefix(line, "[") {
+			flush()
+			if s.EqualFold(line, "[Peer]") {
+				current = &peerName{Metadata: make(map[string]string)}
+			}
+			continue
+		} else if current == nil {
+			continue
+		}
+
+		comment := s.HasPrefix(line, "#")
+		parts := s.SplitN(s.TrimLeft(line, "# \t"), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := s.TrimSpace(parts[0]), s.TrimSpace(parts[1])
+
+		switch {
+		case comment && s.EqualFold(key, "Name"):
+			current.Name = value
+		case comment && key != "" && !s.ContainsAny(key, " \t"):
+			current.Metadata[s.ToLower(key)] = value
+		case !comment && s.EqualFold(key, "PublicKey"):
+			current.PublicKey = value
+		}
+	}
+	flush()
+
+	return result, scanner.Err()
+}
+
+// matches reports whether the mapping entry applies to the given peer.
+func (name peerName) matches(peer lib.WGPeer) bool {
+	if name.PublicKey != "" {
+		return name.PublicKey == peer.PublicKey
+	}
+
+	_, prefix, err := net.ParseCIDR(name.AllowedIP)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range peer.AllowedIPs {
+		_, network, err := net.ParseCIDR(allowed)
+		if err == nil && network.String() == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// namePeers sets name and metadata of all peers matching an entry of the mapping.
+func namePeers(peers []lib.WGPeer, names []peerName) {
+	for i := range peers {
+		for _, name := range names {
+			if name.matches(peers[i]) {
+				peers[i].Name = name.Name
+				peers[i].Metadata = name.Metadata
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// probeSpacing is the delay between two probes sent to the same peer.
+const probeSpacing = 200 * time.Millisecond
+
+// probeFile returns the path of the file holding the latest probe results.
+func probeFile(stateDir string) string {
+	return filepath.Join(stateDir, "wireguard-probes.json")
+}
+
+// runProbes probes the peers of the latest snapshot every interval secs until the process exits.
+// The results are saved to the state directory, so the request handlers can add them to the peers.
+func runProbes(cfg Config, smp *sampler) {
+	interval := time.Duration(cfg.Probes.Interval) * time.Second
+
+	for {
+		started := time.Now()
+
+		if snap := smp.get(); snap != nil {
+			results := probePeers(cfg.Probes, snap.Wireguard)
+
+			data, err := json.Marshal(results)
+			if err == nil {
+				err = replaceFile(probeFile(cfg.StateDir), data)
+			}
+			if err != nil {
+				log.Printf("Saving probe results failed: %s", err)
+			}
+		}
+
+		time.Sleep(interval - time.Since(started))
+	}
+}
+
+// probePeers probes all peers concurrently and returns the results keyed by interface and
+// public key. Peers without target address are skipped.
+func probePeers(cfg ProbeConfig, peers []lib.WGPeer) map[string]lib.PeerLatency {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[string]lib.PeerLatency)
+
+	for i, peer := range peers {
+		target := probeTarget(cfg, peer)
+		if target == nil || peer.Change == "vanished" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(peer lib.WGPeer, id int) {
+			defer wg.Done()
+
+			latency := probe(cfg, target, id)
+			mu.Lock()
+			result[peer.Interface+" "+peer.PublicKey] = latency
+			mu.Unlock()
+		}(peer, (os.Getpid()+i)&0xffff)
+	}
+	wg.Wait()
+
+	now := host.now().Unix()
+	for key, latency := range result {
+		latency.Time = now
+		result[key] = latency
+	}
+	return result
+}
+
+// probeTarget returns the address a peer is probed at: the configured target for its public key
+// or name or its first allowed IP with a single address.
+func probeTarget(cfg ProbeConfig, peer lib.WGPeer) net.IP {
+	for _, key := range []string{peer.PublicKey, peer.Name} {
+		if target, ok := cfg.Targets[key]; ok && key != "" {
+			return net.ParseIP(target)
+		}
+	}
+
+	for _, allowed := range peer.AllowedIPs {
+		ip, network, err := net.ParseCIDR(allowed)
+		if err != nil {
+			continue
+		}
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return ip
+		}
+	}
+	return nil
+}
+
+// probe sends count probes to target using the configured method and summarizes the round trip
+// times of the answered ones.
+func probe(cfg ProbeConfig, target net.IP, id int) lib.PeerLatency {
+	result := lib.PeerLatency{Method: cfg.Method, Target: target.String(), Sent: cfg.Count}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+
+	var rtts []time.Duration
+	var err error
+	switch cfg.Method {
+	case "icmp", "auto":
+		result.Method = "icmp"
+		rtts, err = probeICMP(target, cfg.Count, timeout, id)
+		if err != nil && cfg.Method == "auto" {
+			result.Method = "udp"
+			rtts = probeDial("udp", target, cfg.Port, cfg.Count, timeout)
+		} else if err != nil {
+			// Unsent probes are no loss, the check reports the error instead
+			log.Printf("Probing %s failed: %s", target, err)
+			result.Sent, result.Error = 0, err.Error()
+			return result
+		}
+	default:
+		rtts = probeDial(cfg.Method, target, cfg.Port, cfg.Count, timeout)
+	}
+
+	result.Received = len(rtts)
+	result.Loss = float64(result.Sent-result.Received) / float64(result.Sent) * 100
+	for i, rtt := range rtts {
+		ms := float64(rtt) / float64(time.Millisecond)
+		if i == 0 || ms < result.Min {
+			result.Min = ms
+		}
+		if ms > result.Max {
+			result.Max = ms
+		}
+		result.Avg += ms / float64(len(rtts))
+	}
+	return result
+}
+
+// probeICMP sends ICMP echo requests and returns the round trip times of the replies. It fails
+// if no raw socket can be opened, e.g. without CAP_NET_RAW.
+func probeICMP(target net.IP, count int, timeout time.Duration, id int) ([]time.Duration, error) {
+	var result []time.Duration
+
+	network, request, reply := "ip4:icmp", byte(8), byte(0)
+	if target.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", 128, 129
+	}
+
+	conn, err := host.listenPacket(network, "")
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			time.Sleep(probeSpacing)
+		}
+
+		// type code checksum id seq payload
+		msg := make([]byte, 16)
+		msg[0] = request
+		binary.BigEndian.PutUint16(msg[4:6], uint16(id))
+		binary.BigEndian.PutUint16(msg[6:8], uint16(seq))
+		copy(msg[8:], "g3000agt")
+		// The kernel calculates the checksum of ICMPv6 messages
+		if request == 8 {
+			binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+		}
+
+		sent := time.Now()
+		_, err := conn.WriteTo(msg, &net.IPAddr{IP: target})
+		if err != nil {
+			return result, err
+		}
+
+		conn.SetReadDeadline(sent.Add(timeout))
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			ip, ok := addr.(*net.IPAddr)
+			if n < 8 || !ok || !ip.IP.Equal(target) || buf[0] != reply ||
+				binary.BigEndian.Uint16(buf[4:6]) != uint16(id) || binary.BigEndian.Uint16(buf[6:8]) != uint16(seq) {
+				continue
+			}
+			result = append(result, time.Since(sent))
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// icmpChecksum calculates the internet checksum of an ICMP message.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// probeDial probes a peer with UDP datagrams or TCP connects to the given port. A refused
+// connection, i.e. an ICMP port unreachable or a TCP reset from the peer, is an answer as well.
+func probeDial(network string, target net.IP, port int, count int, timeout time.Duration) []time.Duration {
+	var result []time.Duration
+	address := net.JoinHostPort(target.String(), strconv.Itoa(port))
+
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			time.Sleep(probeSpacing)
+		}
+
+		sent := time.Now()
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err == nil && network == "udp" {
+			conn.SetDeadline(sent.Add(timeout))
+			_, err = conn.Write([]byte("g3000agt"))
+			if err == nil {
+				_, err = conn.Read(make([]byte, 64))
+			}
+		}
+		if conn != nil {
+			conn.Close()
+		}
+
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			result = append(result, time.Since(sent))
+		}
+	}
+
+	return result
+}
+
+// readProbeResults reads the latest probe results saved by the daemon. Results older than
+// maxAge are dropped, so peers are not reported with latencies of probes that stopped.
+func readProbeResults(path string, maxAge time.Duration) map[string]lib.PeerLatency {
+	var result map[string]lib.PeerLatency
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &result) != nil {
+		return nil
+	}
+
+	for key, latency := range result {
+		if host.now().Sub(time.Unix(latency.Time, 0)) > maxAge {
+			delete(result, key)
+		}
+	}
+	return result
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestProbeICMPFailure(t *testing.T) {
+	saved := *host
+	defer func() { *host = saved }()
+	host.listenPacket = func(network, address string) (net.PacketConn, error) {
+		return nil, errors.New("listen " + network + ": socket: operation not permitted")
+	}
+
+	target := net.IPv4(127, 0, 0, 1)
+	result := probe(ProbeConfig{Method: "icmp", Count: 3, Timeout: 1}, target, 1)
+	if result.Error == "" || result.Sent != 0 || result.Loss != 0 {
+		t.Errorf("Failed probe = %+v, want error without loss", result)
+	}
+
+	result = probe(ProbeConfig{Method: "auto", Count: 1, Timeout: 1, Port: 33434}, target, 1)
+	if result.Error != "" || result.Method != "udp" {
+		t.Errorf("Probe with fallback = %+v, want udp without error", result)
+	}
+}
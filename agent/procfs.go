@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+// cpuStat holds the aggregated CPU time counters of /proc/stat in USER_HZ.
+type cpuStat struct {
+	User   uint64
+	System uint64
+	Idle   uint64
+	Total  uint64
+}
+
+// memInfo holds the memory sizes of /proc/meminfo in kB.
+type memInfo struct {
+	Total   uint64
+	Used    uint64
+	Cached  uint64
+	Free    uint64
+	Buffers uint64
+}
+
+// netDevStat holds the counters of a network device from /proc/net/dev.
+type netDevStat struct {
+	Name      string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDrops   uint64
+	RxFifo    uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDrops   uint64
+	TxFifo    uint64
+}
+
+// route is an entry of the main routing table.
+type route struct {
+	Interface string
+	Network   *net.IPNet
+}
+
+// readUptime reads the uptime from /proc/uptime.
+func readUptime() (time.Duration, error) {
+	data, err := host.readProc("uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := s.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("Uptime file is empty")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Parsing uptime failed: %w", err)
+	}
+
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// readCPUStat reads the counters of the aggregated "cpu" line of /proc/stat. The total
+// includes user, nice, system, idle, iowait, irq, softirq and steal time.
+func readCPUStat() (cpuStat, error) {
+	var result cpuStat
+
+	data, err := host.readProc("stat")
+	if err != nil {
+		return result, err
+	}
+
+	for _, line := range s.Split(string(data), "\n") {
+		fields := s.Fields(line)
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var counters [8]uint64
+		for i := 0; i < len(counters) && i+1 < len(fields); i++ {
+			counters[i], err = strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("Parsing CPU stats failed: %w", err)
+			}
+			result.Total += counters[i]
+		}
+		result.User, result.System, result.Idle = counters[0], counters[2], counters[3]
+		return result, nil
+	}
+
+	return result, errors.New("CPU stats contain no cpu line")
+}
+
+// readMemInfo reads /proc/meminfo. Used memory excludes free memory, buffers and page cache.
+func readMemInfo() (memInfo, error) {
+	var result memInfo
+
+	data, err := host.readProc("meminfo")
+	if err != nil {
+		return result, err
+	}
+
+	values := make(map[string]uint64)
+	for _, line := range s.Split(string(data), "\n") {
+		fields := s.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return result, fmt.Errorf("Parsing memory info failed: %w", err)
+		}
+		values[s.TrimSuffix(fields[0], ":")] = value
+	}
+
+	result.Total = values["MemTotal"]
+	if result.Total == 0 {
+		return result, errors.New("Memory info contains no total")
+	}
+	result.Free = values["MemFree"]
+	result.Buffers = values["Buffers"]
+	result.Cached = values["Cached"]
+	if used := result.Free + result.Buffers + result.Cached; used < result.Total {
+		result.Used = result.Total - used
+	}
+
+	return result, nil
+}
+
+// readNetDev reads the counters of all network devices except loopback from /proc/net/dev.
+func readNetDev() ([]netDevStat, error) {
+	var result []netDevStat
+
+	data, err := host.readProc("net", "dev")
+	if err != nil {
+		return result, err
+	}
+
+	lines := s.Split(string(data), "\n")
+	if len(lines) < 2 {
+		return result, errors.New("Network stats are truncated")
+	}
+
+	for _, line := range lines[2:] {
+		parts := s.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := s.TrimSpace(parts[0])
+		fields := s.Fields(parts[1])
+		if name == "lo" || len(fields) < 9 {
+			continue
+		}
+
+		// Receive: bytes packets errs drop fifo frame compressed multicast
+		// Transmit: bytes packets errs drop fifo colls carrier compressed
+		var counters [13]uint64
+		for i := range counters {
+			if i >= len(fields) {
+				break
+			}
+			counters[i], err = strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("Parsing network stats of %s failed: %w", name, err)
+			}
+		}
+		result = append(result, netDevStat{
+			Name:      name,
+			RxBytes:   counters[0],
+			RxPackets: counters[1],
+			RxErrors:  counters[2],
+			RxDrops:   counters[3],
+			RxFifo:    counters[4],
+			TxBytes:   counters[8],
+			TxPackets: counters[9],
+			TxErrors:  counters[10],
+			TxDrops:   counters[11],
+			TxFifo:    counters[12],
+		})
+	}
+
+	return result, nil
+}
+
+// readRoutes reads the IPv4 and IPv6 routes of the main routing table from /proc/net/route and
+// /proc/net/ipv6_route. A missing IPv6 routing table is ignored.
+func readRoutes() ([]route, error) {
+	var result []route
+
+	data, err := host.readProc("net", "route")
+	if err != nil {
+		return result, err
+	}
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	// Addresses are printed in host byte order.
+	for _, line := range s.Split(string(data), "\n")[1:] {
+		fields := s.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		dest, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return result, fmt.Errorf("Parsing route to %s failed: %w", fields[1], err)
+		}
+		mask, err := strconv.ParseUint(fields[7], 16, 32)
+		if err != nil {
+			return result, fmt.Errorf("Parsing route mask %s failed: %w", fields[7], err)
+		}
+
+		network := &net.IPNet{IP: make(net.IP, 4), Mask: make(net.IPMask, 4)}
+		nativeEndian.PutUint32(network.IP, uint32(dest))
+		nativeEndian.PutUint32(network.Mask, uint32(mask))
+		result = append(result, route{fields[0], network})
+	}
+
+	data, err = host.readProc("net", "ipv6_route")
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return result, err
+	}
+
+	// dest dest-len src src-len next-hop metric refcnt use flags iface
+	for _, line := range s.Split(string(data), "\n") {
+		fields := s.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		dest, err := hex.DecodeString(fields[0])
+		if err != nil || len(dest) != net.IPv6len {
+			return result, errors.New("Invalid IPv6 route to " + fields[0])
+		}
+		ones, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil || ones > 128 {
+			return result, errors.New("Invalid IPv6 route length " + fields[1])
+		}
+		result = append(result, route{fields[9], &net.IPNet{IP: dest, Mask: net.CIDRMask(int(ones), 128)}})
+	}
+
+	return result, nil
+}
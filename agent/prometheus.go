@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	s "strings"
+)
+
+const prometheusPrefix = "g3000_"
+
+// promSample is a single sample of a Prometheus metric.
+type promSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// promFamily holds all samples of a Prometheus metric.
+type promFamily struct {
+	name    string
+	help    string
+	samples []promSample
+}
+
+// promBuilder flattens collector results into Prometheus metric families.
+type promBuilder struct {
+	families map[string]*promFamily
+	order    []string
+}
+
+func (b *promBuilder) add(name string, help string, labels map[string]string, value float64) {
+	family, ok := b.families[name]
+	if !ok {
+		family = &promFamily{name: name, help: help}
+		b.families[name] = family
+		b.order = append(b.order, name)
+	}
+	family.samples = append(family.samples, promSample{labels, value})
+}
+
+// flatten walks the JSON representation of a collector result. Numbers and booleans become
+// samples named by their field path, strings become labels of all values of the same object.
+// Array elements without any string field are labeled by their index.
+func (b *promBuilder) flatten(c Collector, path []string, labels map[string]string, value interface{}) {
+	switch v := value.(type) {
+	case float64:
+		b.emit(c, path, labels, v)
+	case bool:
+		if v {
+			b.emit(c, path, labels, 1)
+		} else {
+			b.emit(c, path, labels, 0)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		nested := copyLabels(labels)
+		for _, k := range keys {
+			if str, ok := v[k].(string); ok {
+				nested[promName(k)] = str
+			}
+		}
+		for _, k := range keys {
+			if _, ok := v[k].(string); !ok {
+				b.flatten(c, append(path, k), nested, v[k])
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			nested := copyLabels(labels)
+			if !hasStringField(elem) {
+				nested["index"] = strconv.Itoa(i)
+			}
+			b.flatten(c, path, nested, elem)
+		}
+	}
+}
+
+func (b *promBuilder) emit(c Collector, path []string, labels map[string]string, value float64) {
+	field := s.Join(path, ".")
+	help := c.Name() + " " + field
+	for _, desc := range c.Describe() {
+		if desc.Field == field {
+			help = desc.Help
+			if desc.Unit != "" {
+				help += " (" + desc.Unit + ")"
+			}
+		}
+	}
+
+	b.add(prometheusPrefix+promName(c.Name()+"_"+s.Join(path, "_")), help, labels, value)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
+func hasStringField(value interface{}) bool {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, v := range obj {
+		if _, ok := v.(string); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// promName replaces all characters not allowed in Prometheus metric and label names.
+func promName(name string) string {
+	return s.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := s.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+`="`+escaper.Replace(labels[k])+`"`)
+	}
+	return "{" + s.Join(parts, ",") + "}"
+}
+
+// writePrometheus writes the results of all collectors in the Prometheus text exposition format.
+// Every collector is additionally reported by the g3000_collector_up metric.
+func writePrometheus(w io.Writer, results []collectorResult) error {
+	b := &promBuilder{families: make(map[string]*promFamily)}
+
+	for _, r := range results {
+		up := 1.0
+		if r.err != nil {
+			up = 0
+		}
+		b.add(prometheusPrefix+"collector_up", "Whether the collector succeeded", map[string]string{"collector": r.collector.Name()}, up)
+		if r.err != nil {
+			continue
+		}
+
+		data, err := json.Marshal(r.data)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		err = json.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+		b.flatten(r.collector, nil, map[string]string{}, value)
+	}
+
+	for _, name := range b.order {
+		family := b.families[name]
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, family.help, name)
+		if err != nil {
+			return err
+		}
+		for _, sample := range family.samples {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", name, promLabels(sample.labels), strconv.FormatFloat(sample.value, 'g', -1, 64))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+// snapshot holds all metrics of the gateway collected at the same time.
+type snapshot struct {
+	Time      time.Time
+	Uptime    lib.Uptime
+	CPU       lib.CPUUsage
+	Memory    lib.MemUsage
+	Network   []lib.NetUsage
+	Wireguard []lib.WGPeer
+}
+
+// collectSnapshot collects all metrics concurrently, so the sampling periods of the rate
+// calculations overlap. Metrics which could not be collected are logged and left empty.
+func collectSnapshot() snapshot {
+	var wg sync.WaitGroup
+	result := snapshot{Time: host.now()}
+
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		var err error
+		result.Uptime, err = getUptime()
+		logSampleError(err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		var err error
+		result.CPU, err = getCPUUsage()
+		logSampleError(err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		var err error
+		result.Memory, err = getMemUsage()
+		logSampleError(err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		var err error
+		result.Network, err = getNetUsage()
+		logSampleError(err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		var err error
+		result.Wireguard, err = getWireguard()
+		logSampleError(err)
+	}()
+	wg.Wait()
+
+	return result
+}
+
+func logSampleError(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sampler periodically collects a snapshot of all metrics in the background and keeps the
+// latest one, so it can be served without waiting for the sampling periods.
+type sampler struct {
+	interval time.Duration
+	mu       sync.RWMutex
+	latest   *snapshot
+	handlers []func(*snapshot)
+}
+
+func newSampler(cfg SamplerConfig) *sampler {
+	return &sampler{interval: time.Duration(cfg.Interval) * time.Second}
+}
+
+// run collects snapshots until the process exits.
+func (smp *sampler) run() {
+	for {
+		snap := collectSnapshot()
+
+		smp.mu.Lock()
+		smp.latest = &snap
+		smp.mu.Unlock()
+
+		for _, handler := range smp.handlers {
+			handler(&snap)
+		}
+
+		time.Sleep(smp.interval - time.Since(snap.Time))
+	}
+}
+
+// onSample registers a handler which is called with every new snapshot.
+// Handlers are called sequentially and must not be registered after run was called.
+func (smp *sampler) onSample(handler func(*snapshot)) {
+	smp.handlers = append(smp.handlers, handler)
+}
+
+// get returns the latest snapshot or nil, if no snapshot has been collected yet.
+func (smp *sampler) get() *snapshot {
+	smp.mu.RLock()
+	defer smp.mu.RUnlock()
+
+	return smp.latest
+}
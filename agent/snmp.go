@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	s "strings"
+)
+
+// BER tags used by SNMP messages
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berObjectID    = 0x06
+	berSequence    = 0x30
+	berTimeTicks   = 0x43
+
+	snmpGetRequest   = 0xa0
+	snmpResponse     = 0xa2
+	snmpInform       = 0xa6
+	snmpTrapV2       = 0xa7
+	snmpReport       = 0xa8
+	snmpMaxMsgSize   = 65507
+	snmpUSMModel     = 3
+	snmpFlagAuth     = 0x01
+	snmpFlagPriv     = 0x02
+	snmpFlagReport   = 0x04
+	snmpAuthParamLen = 12
+)
+
+// berTLV encodes a value with the given tag and content.
+func berTLV(tag byte, content []byte) []byte {
+	length := len(content)
+	if length < 0x80 {
+		return append([]byte{tag, byte(length)}, content...)
+	}
+
+	var lenBytes []byte
+	for l := length; l > 0; l >>= 8 {
+		lenBytes = append([]byte{byte(l)}, lenBytes...)
+	}
+	result := append([]byte{tag, 0x80 | byte(len(lenBytes))}, lenBytes...)
+	return append(result, content...)
+}
+
+// berInt encodes a signed integer in its shortest two's complement form.
+func berInt(tag byte, v int64) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(v)}, content...)
+		if (v < 0x80 && v >= -0x80) || len(content) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, content)
+}
+
+// berUint encodes an unsigned integer as used by Counter32, Gauge32 and TimeTicks.
+func berUint(tag byte, v uint64) []byte {
+	content := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(tag, content)
+}
+
+func berOctets(v []byte) []byte {
+	return berTLV(berOctetString, v)
+}
+
+func berOID(o oid) []byte {
+	var content []byte
+	if len(o) >= 2 {
+		o = append(oid{o[0]*40 + o[1]}, o[2:]...)
+	}
+	for _, subid := range o {
+		part := []byte{byte(subid & 0x7f)}
+		for subid >>= 7; subid > 0; subid >>= 7 {
+			part = append([]byte{byte(subid&0x7f) | 0x80}, part...)
+		}
+		content = append(content, part...)
+	}
+	return berTLV(berObjectID, content)
+}
+
+func berSeq(parts ...[]byte) []byte {
+	return berTLV(berSequence, bytes.Join(parts, nil))
+}
+
+// berRead splits the first TLV of data into tag and content and returns the remaining bytes.
+func berRead(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("BER data is truncated")
+	}
+
+	tag, length, offset := data[0], int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n > 4 || len(data) < 2+n {
+			return 0, nil, nil, errors.New("BER length is invalid")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			length = length<<8 | int(data[2+i])
+		}
+		offset += n
+	}
+
+	if len(data) < offset+length {
+		return 0, nil, nil, errors.New("BER data is truncated")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// berReadInt decodes the content of a BER integer.
+func berReadInt(content []byte) int64 {
+	var result int64
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			result = -1
+		}
+		result = result<<8 | int64(b)
+	}
+	return result
+}
+
+// snmpUser holds the USM credentials of an SNMPv3 user localized for one engine.
+type snmpUser struct {
+	name     string
+	authHash func() hash.Hash
+	authKey  []byte
+	privAES  bool
+	privKey  []byte
+}
+
+// passwordToKey derives the key of an SNMPv3 user from its password and localizes it
+// for the given engine ID (RFC 3414, A.2).
+func passwordToKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	if password != "" {
+		buf := make([]byte, 64)
+		for i := 0; i < 1048576; i += len(buf) {
+			for j := range buf {
+				buf[j] = password[(i+j)%len(password)]
+			}
+			h.Write(buf)
+		}
+	}
+	key := h.Sum(nil)
+
+	h = newHash()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// newSNMPUser localizes the credentials of a trap receiver for the given engine ID, see
+// snmpEngine.user for the cached credentials.
+func newSNMPUser(cfg TrapConfig, engineID []byte) (*snmpUser, error) {
+	user := &snmpUser{name: cfg.User}
+
+	switch s.ToUpper(cfg.AuthProtocol) {
+	case "":
+		if cfg.PrivProtocol != "" {
+			return nil, errors.New("SNMPv3 privacy requires authentication")
+		}
+		return user, nil
+	case "MD5":
+		user.authHash = md5.New
+	case "SHA":
+		user.authHash = sha1.New
+	default:
+		return nil, errors.New("Unsupported SNMPv3 authentication protocol " + cfg.AuthProtocol)
+	}
+	user.authKey = passwordToKey(user.authHash, cfg.AuthPassword, engineID)
+
+	switch s.ToUpper(cfg.PrivProtocol) {
+	case "":
+		return user, nil
+	case "DES":
+	case "AES":
+		user.privAES = true
+	default:
+		return nil, errors.New("Unsupported SNMPv3 privacy protocol " + cfg.PrivProtocol)
+	}
+	user.privKey = passwordToKey(user.authHash, cfg.PrivPassword, engineID)
+
+	return user, nil
+}
+
+// flags returns the message flags matching the security level of the user.
+func (user *snmpUser) flags() byte {
+	switch {
+	case user.privKey != nil:
+		return snmpFlagAuth | snmpFlagPriv
+	case user.authKey != nil:
+		return snmpFlagAuth
+	}
+	return 0
+}
+
+// encrypt encrypts a scoped PDU with DES-CBC or AES-128-CFB (RFC 3414, RFC 3826)
+// and returns the cipher text together with the privacy parameters.
+func (user *snmpUser) encrypt(scopedPDU []byte, boots uint32, engineTime uint32) ([]byte, []byte, error) {
+	salt := make([]byte, 8)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.privAES {
+		binary.BigEndian.PutUint32(salt[0:4], boots)
+	}
+
+	block, iv, err := user.cipher(salt, boots, engineTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.privAES {
+		result := make([]byte, len(scopedPDU))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(result, scopedPDU)
+		return result, salt, nil
+	}
+
+	padded := append([]byte{}, scopedPDU...)
+	padded = append(padded, make([]byte, (8-len(padded)%8)%8)...)
+	result := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(result, padded)
+	return result, salt, nil
+}
+
+// decrypt decrypts the scoped PDU of a message with the privacy parameters and the boots and time
+// of the authoritative engine sent along with it. DES padding is left in place, as it follows the
+// BER encoded scoped PDU.
+func (user *snmpUser) decrypt(encrypted []byte, salt []byte, boots uint32, engineTime uint32) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, errors.New("SNMPv3 message has invalid privacy parameters")
+	}
+
+	block, iv, err := user.cipher(salt, boots, engineTime)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, len(encrypted))
+	if user.privAES {
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(result, encrypted)
+		return result, nil
+	}
+
+	if len(encrypted)%8 != 0 {
+		return nil, errors.New("SNMPv3 message has invalid DES cipher text")
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(result, encrypted)
+	return result, nil
+}
+
+// cipher returns the block cipher and initialization vector for the given privacy parameters.
+func (user *snmpUser) cipher(salt []byte, boots uint32, engineTime uint32) (cipher.Block, []byte, error) {
+	if user.privAES {
+		block, err := aes.NewCipher(user.privKey[:16])
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint32(iv[0:4], boots)
+		binary.BigEndian.PutUint32(iv[4:8], engineTime)
+		copy(iv[8:], salt)
+		return block, iv, err
+	}
+
+	block, err := des.NewCipher(user.privKey[:8])
+	iv := make([]byte, 8)
+	for i := range iv {
+		iv[i] = user.privKey[8+i] ^ salt[i]
+	}
+	return block, iv, err
+}
+
+// snmpV3Message builds an SNMPv3 message carrying pdu for the given authoritative engine.
+// The message is encrypted and authenticated according to the security level of the user.
+func snmpV3Message(user *snmpUser, msgID int64, flags byte, engineID []byte, boots uint32, engineTime uint32, pdu []byte) ([]byte, error) {
+	scopedPDU := berSeq(berOctets(engineID), berOctets(nil), pdu)
+
+	var authParams, privParams []byte
+	if user.authKey != nil {
+		authParams = make([]byte, snmpAuthParamLen)
+	}
+	msgData := scopedPDU
+	if user.privKey != nil {
+		encrypted, salt, err := user.encrypt(scopedPDU, boots, engineTime)
+		if err != nil {
+			return nil, err
+		}
+		msgData, privParams = berOctets(encrypted), salt
+	}
+
+	// The offset of the authentication parameters is tracked while encoding, as their zeroed
+	// placeholder may also occur in the fields before them
+	secHead := bytes.Join([][]byte{
+		berOctets(engineID),
+		berInt(berInteger, int64(boots)),
+		berInt(berInteger, int64(engineTime)),
+		berOctets([]byte(user.name))}, nil)
+	authField := berOctets(authParams)
+	secContent := bytes.Join([][]byte{secHead, authField, berOctets(privParams)}, nil)
+	secParams := berOctets(berTLV(berSequence, secContent))
+
+	msgHead := bytes.Join([][]byte{
+		berInt(berInteger, 3),
+		berSeq(
+			berInt(berInteger, msgID),
+			berInt(berInteger, snmpMaxMsgSize),
+			berOctets([]byte{flags | user.flags()}),
+			berInt(berInteger, snmpUSMModel))}, nil)
+	msgContent := bytes.Join([][]byte{msgHead, secParams, msgData}, nil)
+	msg := berTLV(berSequence, msgContent)
+
+	if user.authKey != nil {
+		i := len(msg) - len(msgContent) + len(msgHead) + len(secParams) - len(secContent) +
+			len(secHead) + len(authField) - len(authParams)
+		mac := hmac.New(user.authHash, user.authKey)
+		mac.Write(msg)
+		copy(msg[i:i+snmpAuthParamLen], mac.Sum(nil))
+	}
+
+	return msg, nil
+}
+
+// snmpV3Reply holds the fields of an SNMPv3 reply needed to answer engine discovery
+// and to match responses to requests.
+type snmpV3Reply struct {
+	engineID   []byte
+	boots      uint32
+	engineTime uint32
+	pduType    byte
+	requestID  int64
+}
+
+// parseSNMPv3Reply decodes the security parameters and the PDU header of an SNMPv3 message.
+// Responses use the security level of the request (RFC 3412, 7.1), so encrypted messages are
+// decrypted with the privacy key of user. Without user, e.g. during engine discovery, only the
+// security parameters of encrypted messages are decoded.
+func parseSNMPv3Reply(data []byte, user *snmpUser) (snmpV3Reply, error) {
+	var reply snmpV3Reply
+
+	_, msg, _, err := berRead(data)
+	if err != nil {
+		return reply, err
+	}
+	_, _, msg, err = berRead(msg) // version
+	if err != nil {
+		return reply, err
+	}
+	_, global, msg, err := berRead(msg)
+	if err != nil {
+		return reply, err
+	}
+	_, secParams, msg, err := berRead(msg)
+	if err != nil {
+		return reply, err
+	}
+
+	// Message flags are the third field of the global data
+	var flags []byte
+	for i := 0; i < 3 && err == nil; i++ {
+		_, flags, global, err = berRead(global)
+	}
+	if err != nil || len(flags) != 1 {
+		return reply, errors.New("SNMPv3 message has invalid flags")
+	}
+
+	_, usm, _, err := berRead(secParams)
+	if err != nil {
+		return reply, err
+	}
+	_, reply.engineID, usm, err = berRead(usm)
+	if err != nil {
+		return reply, err
+	}
+	_, boots, usm, err := berRead(usm)
+	if err != nil {
+		return reply, err
+	}
+	_, engineTime, usm, err := berRead(usm)
+	if err != nil {
+		return reply, err
+	}
+	reply.boots, reply.engineTime = uint32(berReadInt(boots)), uint32(berReadInt(engineTime))
+
+	// User name and authentication parameters precede the privacy parameters
+	var privParams []byte
+	for i := 0; i < 3 && err == nil; i++ {
+		_, privParams, usm, err = berRead(usm)
+	}
+	if err != nil {
+		return reply, err
+	}
+
+	_, scoped, _, err := berRead(msg)
+	if err != nil {
+		return reply, err
+	}
+	if flags[0]&snmpFlagPriv != 0 {
+		if user == nil || user.privKey == nil {
+			return reply, nil
+		}
+		scoped, err = user.decrypt(scoped, privParams, reply.boots, reply.engineTime)
+		if err == nil {
+			_, scoped, _, err = berRead(scoped)
+		}
+		if err != nil {
+			return reply, fmt.Errorf("Decrypting SNMPv3 message failed: %w", err)
+		}
+	}
+	for i := 0; i < 2 && err == nil; i++ {
+		_, _, scoped, err = berRead(scoped)
+	}
+	if err != nil {
+		return reply, err
+	}
+	pduType, pdu, _, err := berRead(scoped)
+	if err != nil {
+		return reply, err
+	}
+	_, requestID, _, err := berRead(pdu)
+	if err != nil {
+		return reply, err
+	}
+	reply.pduType, reply.requestID = pduType, berReadInt(requestID)
+
+	return reply, nil
+}
+
+// parseSNMPv2cReply returns the PDU type and request ID of an SNMPv2c message.
+func parseSNMPv2cReply(data []byte) (byte, int64, error) {
+	_, msg, _, err := berRead(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := 0; i < 2 && err == nil; i++ {
+		_, _, msg, err = berRead(msg)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	pduType, pdu, _, err := berRead(msg)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, requestID, _, err := berRead(pdu)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pduType, berReadInt(requestID), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	s "strings"
+)
+
+// netLink holds the link details of a network device from /sys/class/net.
+type netLink struct {
+	OperState string
+	Carrier   bool
+	MTU       int
+	Speed     int
+	Duplex    string
+}
+
+// readNetLink reads the link details of a network device. Details the device does not provide,
+// like the speed of virtual devices or of devices without carrier, are left empty.
+func readNetLink(name string) netLink {
+	var result netLink
+
+	result.OperState, _ = host.readSys("class", "net", name, "operstate")
+
+	carrier, err := host.readSys("class", "net", name, "carrier")
+	result.Carrier = err == nil && carrier == "1"
+
+	if mtu, err := host.readSys("class", "net", name, "mtu"); err == nil {
+		result.MTU, _ = strconv.Atoi(mtu)
+	}
+
+	// Devices without link report -1 or fail with EINVAL
+	if speed, err := host.readSys("class", "net", name, "speed"); err == nil {
+		if result.Speed, err = strconv.Atoi(speed); err != nil || result.Speed < 0 {
+			result.Speed = 0
+		}
+	}
+
+	if duplex, err := host.readSys("class", "net", name, "duplex"); err == nil && duplex != "unknown" {
+		result.Duplex = duplex
+	}
+
+	return result
+}
+
+// readAddresses returns the IPv4 and IPv6 addresses of all network devices with prefix length,
+// as listed by "ip -o addr show". It returns nil if the command is not available.
+func readAddresses() map[string][]string {
+	out, err := host.run("ip", "-o", "addr", "show")
+	if err != nil {
+		return nil
+	}
+
+	result := make(map[string][]string)
+	for _, line := range s.Split(string(out), "\n") {
+		// 2: eth0    inet 192.168.1.10/24 brd 192.168.1.255 scope global eth0\       valid_lft ...
+		fields := s.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		// Devices on top of others are listed as e.g. "wwan0@if3"
+		name := s.SplitN(fields[1], "@", 2)[0]
+		result[name] = append(result[name], fields[3])
+	}
+	return result
+}
+
+// netRoles returns the roles of a network device, sorted by name.
+func netRoles(name string) []string {
+	var result []string
+	for role, patterns := range host.netRoles {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				result = append(result, role)
+				break
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// netCapacity returns the nominal capacity of a network device in kbps: the configured capacity
+// of its name, of the first matching pattern or role in alphabetical order or its link speed. It
+// returns 0 if the capacity is unknown.
+func netCapacity(name string, roles []string, speed int) float64 {
+	if capacity, ok := host.netCapacity[name]; ok {
+		return capacity * 1000
+	}
+
+	keys := make([]string, 0, len(host.netCapacity))
+	for key := range host.netCapacity {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		matched, _ := filepath.Match(key, name)
+		for _, role := range roles {
+			matched = matched || role == key
+		}
+		if matched {
+			return host.netCapacity[key] * 1000
+		}
+	}
+
+	return float64(speed) * 1000
+}
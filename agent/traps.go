@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	oidSysUpTime   = oid{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidSnmpTrapOID = oid{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+)
+
+// snmpEngine identifies the daemon as authoritative SNMPv3 engine for unconfirmed traps.
+// The number of boots is persisted in the state directory and increased on every start.
+type snmpEngine struct {
+	id      []byte
+	boots   uint32
+	started time.Time
+	mu      sync.Mutex
+	users   map[snmpUserKey]*snmpUser
+}
+
+// snmpUserKey identifies the credentials of a receiver localized for an engine.
+type snmpUserKey struct {
+	receiver TrapConfig
+	engineID string
+}
+
+// newSNMPEngine loads the engine state. Without a configured engine ID, an ID in text format
+// is derived from the hostname using the enterprise number of net-snmp (RFC 3411).
+func newSNMPEngine(cfg Config) (*snmpEngine, error) {
+	engine := &snmpEngine{started: time.Now()}
+
+	if cfg.SNMPEngineID != "" {
+		id, err := hex.DecodeString(cfg.SNMPEngineID)
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return nil, errors.New("SNMP engine ID must be 5 to 32 bytes in hex")
+		}
+		engine.id = id
+	} else {
+		hostname, _ := os.Hostname()
+		if len(hostname) > 27 {
+			hostname = hostname[:27]
+		}
+		engine.id = append([]byte{0x80, 0x00, 0x1f, 0x88, 0x04}, hostname...)
+	}
+
+	path := filepath.Join(cfg.StateDir, "snmp-engine.json")
+	state := struct {
+		Boots uint32 `json:"boots"`
+	}{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Reading SNMP engine state failed: %w", err)
+	}
+
+	state.Boots++
+	engine.boots = state.Boots
+
+	data, err = json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(cfg.StateDir, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Saving SNMP engine state failed: %w", err)
+	}
+
+	return engine, nil
+}
+
+// time returns the secs since the engine was started.
+func (engine *snmpEngine) time() uint32 {
+	return uint32(time.Since(engine.started).Seconds())
+}
+
+// user returns the credentials of a receiver localized for engineID. Localizing hashes 1 MB per
+// key, so the result is kept for later traps to the same receiver and engine.
+func (engine *snmpEngine) user(cfg TrapConfig, engineID []byte) (*snmpUser, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	key := snmpUserKey{cfg, string(engineID)}
+	if user, ok := engine.users[key]; ok {
+		return user, nil
+	}
+
+	user, err := newSNMPUser(cfg, engineID)
+	if err != nil {
+		return nil, err
+	}
+	if engine.users == nil {
+		engine.users = make(map[snmpUserKey]*snmpUser)
+	}
+	engine.users[key] = user
+	return user, nil
+}
+
+// snmpPDU encodes a PDU of the given type with the request ID and varbinds.
+func snmpPDU(pduType byte, requestID int64, varbinds ...[]byte) []byte {
+	return berTLV(pduType, bytes.Join([][]byte{
+		berInt(berInteger, requestID),
+		berInt(berInteger, 0),
+		berInt(berInteger, 0),
+		berSeq(varbinds...)}, nil))
+}
+
+func snmpVarbind(name oid, value []byte) []byte {
+	return berSeq(berOID(name), value)
+}
+
+func randomID() int64 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return int64(binary.BigEndian.Uint32(buf) & 0x7fffffff)
+}
+
+// trapVarbinds returns the varbinds of the state change notification for an event. Besides the
+// mandatory sysUpTime and snmpTrapOID they describe the rule and carry the metric value.
+//
+//	.0.1   notification: alert state change
+//	.6.1   rule name        .6.5   previous state (0-3)
+//	.6.2   metric           .6.6   value
+//	.6.3   target           .6.7   message
+//	.6.4   state (0-3)
+func trapVarbinds(base oid, engine *snmpEngine, event alertEvent) [][]byte {
+	return [][]byte{
+		snmpVarbind(oidSysUpTime, berUint(berTimeTicks, uint64(time.Since(engine.started)/(10*time.Millisecond)))),
+		snmpVarbind(oidSnmpTrapOID, berOID(base.append(0, 1))),
+		snmpVarbind(base.append(6, 1), berOctets([]byte(event.Rule))),
+		snmpVarbind(base.append(6, 2), berOctets([]byte(event.Metric))),
+		snmpVarbind(base.append(6, 3), berOctets([]byte(event.Target))),
+		snmpVarbind(base.append(6, 4), berInt(berInteger, int64(event.stateCode))),
+		snmpVarbind(base.append(6, 5), berInt(berInteger, int64(event.previousCode))),
+		snmpVarbind(base.append(6, 6), berOctets([]byte(trapValue(event)))),
+		snmpVarbind(base.append(6, 7), berOctets([]byte(event.Message))),
+	}
+}
+
+// trapValue formats the value of an event, which is empty if it is infinite.
+func trapValue(event alertEvent) string {
+	if event.Value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", *event.Value)
+}
+
+// sendTrap sends an event as SNMPv2c or SNMPv3 trap or inform to a receiver. Informs are
+// repeated until the receiver acknowledges them or the retries are exhausted.
+func sendTrap(cfg TrapConfig, engine *snmpEngine, base oid, event alertEvent) error {
+	address := cfg.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "162")
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pduType := byte(snmpTrapV2)
+	if cfg.Inform {
+		pduType = snmpInform
+	}
+	requestID := randomID()
+	pdu := snmpPDU(pduType, requestID, trapVarbinds(base, engine, event)...)
+
+	if cfg.Version != "3" {
+		msg := berSeq(berInt(berInteger, 1), berOctets([]byte(cfg.Community)), pdu)
+		if !cfg.Inform {
+			_, err = conn.Write(msg)
+			return err
+		}
+
+		reply, err := snmpRequest(conn, cfg, msg)
+		if err != nil {
+			return err
+		}
+		replyType, replyID, err := parseSNMPv2cReply(reply)
+		if err != nil {
+			return err
+		} else if replyType != snmpResponse || replyID != requestID {
+			return errors.New("SNMP receiver sent an unexpected reply")
+		}
+		return nil
+	}
+
+	if !cfg.Inform {
+		user, err := engine.user(cfg, engine.id)
+		if err != nil {
+			return err
+		}
+		msg, err := snmpV3Message(user, randomID(), 0, engine.id, engine.boots, engine.time(), pdu)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(msg)
+		return err
+	}
+
+	// Informs are sent to the receiver as authoritative engine, which has to be discovered first
+	probe, err := snmpV3Message(&snmpUser{}, randomID(), snmpFlagReport, nil, 0, 0, snmpPDU(snmpGetRequest, randomID()))
+	if err != nil {
+		return err
+	}
+	reply, err := snmpRequest(conn, cfg, probe)
+	if err != nil {
+		return err
+	}
+	remote, err := parseSNMPv3Reply(reply, nil)
+	if err != nil {
+		return err
+	}
+
+	user, err := engine.user(cfg, remote.engineID)
+	if err != nil {
+		return err
+	}
+
+	// A report (e.g. notInTimeWindow) updates boots and time of the receiver, so retry once
+	for attempt := 0; attempt < 2; attempt++ {
+		msg, err := snmpV3Message(user, randomID(), snmpFlagReport, remote.engineID, remote.boots, remote.engineTime, pdu)
+		if err != nil {
+			return err
+		}
+		reply, err = snmpRequest(conn, cfg, msg)
+		if err != nil {
+			return err
+		}
+		remote, err = parseSNMPv3Reply(reply, user)
+		if err != nil {
+			return err
+		}
+		if remote.pduType == snmpResponse && remote.requestID == requestID {
+			return nil
+		}
+	}
+
+	return errors.New("SNMP receiver did not acknowledge the inform")
+}
+
+// snmpRequest sends msg and waits for the reply of the receiver, resending it on timeout.
+func snmpRequest(conn net.Conn, cfg TrapConfig, msg []byte) ([]byte, error) {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	buf := make([]byte, snmpMaxMsgSize)
+
+	for attempt := 0; attempt <= cfg.Retries; attempt++ {
+		_, err := conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err == nil {
+			return buf[:n], nil
+		} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("SNMP receiver " + cfg.Address + " did not respond")
+}
+
+// deliverTraps sends an event to all configured trap receivers.
+func deliverTraps(traps []TrapConfig, engine *snmpEngine, base oid, event alertEvent) {
+	for _, trap := range traps {
+		err := sendTrap(trap, engine, base, event)
+		if err != nil {
+			log.Printf("Sending trap for event %s to %s failed: %s", event.ID, trap.Address, err)
+		}
+	}
+}
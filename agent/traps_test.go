@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	s "strings"
+	"testing"
+	"time"
+)
+
+var testBase = oid{1, 3, 6, 1, 4, 1, 8072, 9999, 3000}
+
+// startTrapReceiver listens for traps on a local UDP port. Every message is passed to handle,
+// whose result, if any, is sent back to the agent. The messages are sent to the returned channel.
+func startTrapReceiver(t *testing.T, handle func(data []byte) []byte) (net.PacketConn, chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, snmpMaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			data := append([]byte{}, buf[:n]...)
+			received <- data
+			if reply := handle(data); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn, received
+}
+
+func testEvent() alertEvent {
+	value := 60.0
+	return alertEvent{Rule: "cpu-high", Metric: "cpu", State: "WARNING", Value: &value, Message: "CPU usage above 50%", stateCode: 1}
+}
+
+func TestPasswordToKey(t *testing.T) {
+	// RFC 3414, A.3.1 and A.3.2
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	tests := []struct {
+		name string
+		key  []byte
+		want string
+	}{
+		{"MD5", passwordToKey(md5.New, "maplesyrup", engineID), "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", passwordToKey(sha1.New, "maplesyrup", engineID), "6695febc9288e36282235fc7151f128497b38f3f"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.key); got != test.want {
+			t.Errorf("%s key = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseEncryptedReply(t *testing.T) {
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 't', 'e', 's', 't'}
+
+	for _, priv := range []string{"DES", "AES"} {
+		user, err := newSNMPUser(TrapConfig{User: "monitor", AuthProtocol: "SHA", AuthPassword: "authpass1",
+			PrivProtocol: priv, PrivPassword: "privpass1"}, engineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := snmpV3Message(user, 7, 0, engineID, 3, 1234, snmpPDU(snmpResponse, 4711))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(msg, berInt(berInteger, 4711)) {
+			t.Errorf("%s: request ID is sent in plain text", priv)
+		}
+
+		reply, err := parseSNMPv3Reply(msg, user)
+		if err != nil {
+			t.Fatalf("%s: %s", priv, err)
+		}
+		if !bytes.Equal(reply.engineID, engineID) || reply.boots != 3 || reply.engineTime != 1234 {
+			t.Errorf("%s: engine %x, %d boots, time %d", priv, reply.engineID, reply.boots, reply.engineTime)
+		}
+		if reply.pduType != snmpResponse || reply.requestID != 4711 {
+			t.Errorf("%s: PDU type %x with request ID %d, want %x with 4711", priv, reply.pduType, reply.requestID, snmpResponse)
+		}
+
+		// Without privacy key only the security parameters are decoded
+		reply, err = parseSNMPv3Reply(msg, nil)
+		if err != nil || reply.pduType != 0 || reply.boots != 3 {
+			t.Errorf("%s: reply without user = %+v, %v", priv, reply, err)
+		}
+	}
+}
+
+func TestSendTrapV2c(t *testing.T) {
+	conn, received := startTrapReceiver(t, func(data []byte) []byte { return nil })
+	defer conn.Close()
+
+	err := sendTrap(TrapConfig{Address: conn.LocalAddr().String(), Community: "public"}, &snmpEngine{started: time.Now()}, testBase, testEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		pduType, _, err := parseSNMPv2cReply(data)
+		if err != nil || pduType != snmpTrapV2 {
+			t.Errorf("Received PDU type %x, %v, want %x", pduType, err, snmpTrapV2)
+		}
+		if !bytes.Contains(data, berOctets([]byte("public"))) || !bytes.Contains(data, berOctets([]byte("cpu-high"))) {
+			t.Error("Trap lacks community or rule name")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No trap received")
+	}
+}
+
+func TestSendInformV2c(t *testing.T) {
+	for _, offset := range []int64{0, 1} {
+		conn, received := startTrapReceiver(t, func(data []byte) []byte {
+			_, requestID, err := parseSNMPv2cReply(data)
+			if err != nil {
+				return nil
+			}
+			return berSeq(berInt(berInteger, 1), berOctets([]byte("public")), snmpPDU(snmpResponse, requestID+offset))
+		})
+
+		cfg := TrapConfig{Address: conn.LocalAddr().String(), Community: "public", Inform: true, Timeout: 1}
+		err := sendTrap(cfg, &snmpEngine{started: time.Now()}, testBase, testEvent())
+		conn.Close()
+
+		if offset == 0 && err != nil {
+			t.Errorf("Acknowledged inform failed: %s", err)
+		} else if offset != 0 && (err == nil || !s.Contains(err.Error(), "unexpected reply")) {
+			t.Errorf("Inform acknowledged with another request ID returned %v", err)
+		}
+		if pduType, _, _ := parseSNMPv2cReply(<-received); pduType != snmpInform {
+			t.Errorf("Received PDU type %x, want %x", pduType, snmpInform)
+		}
+	}
+}
+
+// TestSendInformV3 sends authPriv informs to a receiver which discovers its engine ID,
+// decrypts the inform and sends back an encrypted response.
+func TestSendInformV3(t *testing.T) {
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 'r', 'e', 'c', 'v'}
+
+	for _, priv := range []string{"DES", "AES"} {
+		cfg := TrapConfig{Version: "3", Inform: true, Timeout: 1, User: "monitor",
+			AuthProtocol: "MD5", AuthPassword: "authpass1", PrivProtocol: priv, PrivPassword: "privpass1"}
+		user, err := newSNMPUser(cfg, engineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, received := startTrapReceiver(t, func(data []byte) []byte {
+			request, err := parseSNMPv3Reply(data, user)
+			if err != nil {
+				t.Errorf("%s: receiver could not parse request: %s", priv, err)
+				return nil
+			}
+
+			// usmStatsUnknownEngineIDs
+			pdu := snmpPDU(snmpReport, request.requestID, snmpVarbind(oid{1, 3, 6, 1, 6, 3, 15, 1, 1, 4, 0}, berUint(0x41, 1)))
+			reply := &snmpUser{}
+			if len(request.engineID) > 0 {
+				if request.pduType != snmpInform {
+					t.Errorf("%s: receiver got PDU type %x, want inform", priv, request.pduType)
+				}
+				pdu, reply = snmpPDU(snmpResponse, request.requestID), user
+			}
+			msg, _ := snmpV3Message(reply, 1, 0, engineID, 5, 300, pdu)
+			return msg
+		})
+
+		cfg.Address = conn.LocalAddr().String()
+		err = sendTrap(cfg, &snmpEngine{id: []byte("local"), started: time.Now()}, testBase, testEvent())
+		conn.Close()
+
+		if err != nil {
+			t.Errorf("%s: encrypted response was not accepted: %s", priv, err)
+		}
+		// Engine discovery and the inform itself
+		if len(received) != 2 {
+			t.Errorf("%s: receiver got %d messages, want 2", priv, len(received))
+		}
+	}
+}
+
+// TestV3MessageAuthParams authenticates a message whose user name contains the zeroed
+// placeholder of the authentication parameters.
+func TestV3MessageAuthParams(t *testing.T) {
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 't', 'e', 's', 't'}
+	name := string(berOctets(make([]byte, snmpAuthParamLen)))
+	user, err := newSNMPUser(TrapConfig{User: name, AuthProtocol: "SHA", AuthPassword: "authpass1"}, engineID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := snmpV3Message(user, 7, 0, engineID, 3, 1234, snmpPDU(snmpResponse, 4711))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// message: version, header, security parameters, scoped PDU
+	fields := make([][]byte, 6)
+	_, content, _, err := berRead(msg)
+	for i := 0; i < 3 && err == nil; i++ {
+		_, fields[i], content, err = berRead(content)
+	}
+	// security parameters: engine ID, boots, time, user name, authentication, privacy
+	if err == nil {
+		_, content, _, err = berRead(fields[2])
+	}
+	for i := 0; i < 5 && err == nil; i++ {
+		_, fields[i], content, err = berRead(content)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fields[3]) != name {
+		t.Errorf("User name = %x, want %x", fields[3], name)
+	}
+
+	authParams := append([]byte(nil), fields[4]...)
+	copy(fields[4], make([]byte, snmpAuthParamLen))
+	mac := hmac.New(sha1.New, user.authKey)
+	mac.Write(msg)
+	if want := mac.Sum(nil)[:snmpAuthParamLen]; !bytes.Equal(authParams, want) {
+		t.Errorf("Authentication parameters = %x, want %x", authParams, want)
+	}
+}
+
+func TestSNMPEngineUser(t *testing.T) {
+	engine := &snmpEngine{id: []byte("local"), started: time.Now()}
+	cfg := TrapConfig{Version: "3", User: "monitor", AuthProtocol: "SHA", AuthPassword: "authpass1"}
+
+	first, err := engine.user(cfg, engine.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := engine.user(cfg, engine.id); user != first {
+		t.Error("Credentials were localized again for the same receiver")
+	}
+	if user, _ := engine.user(cfg, []byte("remote")); user == first || bytes.Equal(user.authKey, first.authKey) {
+		t.Error("Credentials of another engine were reused")
+	}
+	cfg.AuthPassword = "authpass2"
+	if user, _ := engine.user(cfg, engine.id); user == first {
+		t.Error("Credentials of another receiver were reused")
+	}
+	cfg.AuthProtocol = "SHA256"
+	if _, err := engine.user(cfg, engine.id); err == nil {
+		t.Error("Unsupported protocol was accepted")
+	}
+}
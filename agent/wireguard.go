@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	s "strings"
+)
+
+// wgDevice holds the state of a Wireguard interface as reported by the kernel.
+type wgDevice struct {
+	Name       string
+	PublicKey  string
+	ListenPort int
+	FwMark     uint32
+	Peers      []wgPeerState
+}
+
+// wgPeerState holds the state of a Wireguard peer. LastHandshake is given as unix time and is 0
+// if no handshake happened yet, Endpoint is empty if the peer has none and Keepalive is given
+// in secs (0 if disabled).
+type wgPeerState struct {
+	PublicKey     string
+	PresharedKey  bool
+	Endpoint      string
+	AllowedIPs    []string
+	LastHandshake int64
+	RxBytes       uint64
+	TxBytes       uint64
+	Keepalive     int
+}
+
+// wgClient lists Wireguard interfaces and reads their state.
+type wgClient interface {
+	Interfaces() ([]string, error)
+	Device(name string) (wgDevice, error)
+}
+
+// dumpWGClient reads the state of Wireguard interfaces from the output of "wg show <name> dump".
+type dumpWGClient struct{}
+
+func (dumpWGClient) Interfaces() ([]string, error) {
+	out, err := host.run("wg", "show", "interfaces")
+	if err != nil {
+		return nil, fmt.Errorf("Executing \"wg show interfaces\" failed: %w", err)
+	}
+	return s.Fields(string(out)), nil
+}
+
+func (dumpWGClient) Device(name string) (wgDevice, error) {
+	return parseWGDump(name)
+}
+
+// autoWGClient reads the state of Wireguard interfaces via netlink and falls back to the
+// wg command if netlink fails, e.g. on kernels using the userspace implementation.
+type autoWGClient struct{}
+
+// Interfaces lists the interfaces created by the kernel module and falls back to the wg command,
+// which also finds interfaces of the userspace implementation.
+func (autoWGClient) Interfaces() ([]string, error) {
+	result, err := sysfsWGInterfaces()
+	if err == nil && len(result) > 0 {
+		return result, nil
+	}
+
+	return dumpWGClient{}.Interfaces()
+}
+
+func (autoWGClient) Device(name string) (wgDevice, error) {
+	dev, err := netlinkWGClient{}.Device(name)
+	if err == nil {
+		return dev, nil
+	}
+
+	dev, dumpErr := parseWGDump(name)
+	if dumpErr != nil {
+		return dev, fmt.Errorf("Reading Wireguard device %s failed: %s, %w", name, err, dumpErr)
+	}
+	return dev, nil
+}
+
+// sysfsWGInterfaces lists the network devices of type "wireguard" in sysfs.
+func sysfsWGInterfaces() ([]string, error) {
+	var result []string
+
+	devices, err := ioutil.ReadDir(host.sys("class", "net"))
+	if err != nil {
+		return result, fmt.Errorf("Listing network devices failed: %w", err)
+	}
+
+	for _, dev := range devices {
+		uevent, err := ioutil.ReadFile(host.sys("class", "net", dev.Name(), "uevent"))
+		if err != nil {
+			continue
+		}
+		for _, line := range s.Split(string(uevent), "\n") {
+			if s.TrimSpace(line) == "DEVTYPE=wireguard" {
+				result = append(result, dev.Name())
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// wireguardInterfaces returns the configured Wireguard interfaces or, if none are configured,
+// all Wireguard interfaces of the gateway.
+func wireguardInterfaces() ([]string, error) {
+	if len(host.wgInterfaces) > 0 {
+		return host.wgInterfaces, nil
+	}
+
+	result, err := host.wg.Interfaces()
+	if err != nil {
+		return nil, err
+	} else if len(result) == 0 {
+		return nil, errors.New("Could not find any Wireguard interface")
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// newWGClient returns the client of the configured backend ("auto", "netlink" or "wg").
+// If command fixtures are used, the state is always read from recorded dumps.
+func newWGClient(cfg Config) wgClient {
+	if cfg.CommandFixtures != "" {
+		return dumpWGClient{}
+	}
+
+	switch cfg.Wireguard.Backend {
+	case "netlink":
+		return netlinkWGClient{}
+	case "wg":
+		return dumpWGClient{}
+	}
+	return autoWGClient{}
+}
+
+// parseWGDump parses Wireguard device and peer information produced by the "wg show <name> dump"
+// command. The first line describes the interface, every other line a peer.
+func parseWGDump(name string) (wgDevice, error) {
+	result := wgDevice{Name: name}
+	command := "wg show " + name + " dump"
+
+	out, err := host.run("wg", "show", name, "dump")
+	if err != nil {
+		return result, fmt.Errorf("Executing \"%s\" failed: %w", command, err)
+	} else if len(s.TrimSpace(string(out))) == 0 {
+		return result, errors.New("Executing \"" + command + "\" returned empty response")
+	}
+
+	lines := s.Split(s.TrimSpace(string(out)), "\n")
+
+	// private-key public-key listen-port fwmark
+	fields := s.Split(lines[0], "\t")
+	if len(fields) != 4 {
+		return result, errors.New("Interface line of \"" + command + "\" is invalid")
+	}
+	result.PublicKey = fields[1]
+	result.ListenPort, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return result, fmt.Errorf("Parsing listen port of %s failed: %w", name, err)
+	}
+	if fields[3] != "off" {
+		fwmark, err := strconv.ParseUint(s.TrimPrefix(fields[3], "0x"), 16, 32)
+		if err != nil {
+			return result, fmt.Errorf("Parsing fwmark of %s failed: %w", name, err)
+		}
+		result.FwMark = uint32(fwmark)
+	}
+
+	for _, line := range lines[1:] {
+		peer, err := parseWGDumpPeer(s.Split(line, "\t"))
+		if err != nil {
+			return result, fmt.Errorf("Parsing peer of %s failed: %w", name, err)
+		}
+		result.Peers = append(result.Peers, peer)
+	}
+
+	return result, nil
+}
+
+// parseWGDumpPeer parses the fields of a peer line: public-key preshared-key endpoint
+// allowed-ips latest-handshake transfer-rx transfer-tx persistent-keepalive.
+func parseWGDumpPeer(fields []string) (wgPeerState, error) {
+	var result wgPeerState
+
+	if len(fields) != 8 {
+		return result, errors.New("Peer line has " + strconv.Itoa(len(fields)) + " fields instead of 8")
+	}
+
+	result.PublicKey = fields[0]
+	result.PresharedKey = fields[1] != "(none)"
+	if fields[2] != "(none)" {
+		result.Endpoint = fields[2]
+	}
+	if fields[3] != "(none)" && fields[3] != "" {
+		result.AllowedIPs = s.Split(fields[3], ",")
+	}
+
+	var err error
+	result.LastHandshake, err = strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return result, fmt.Errorf("Parsing latest handshake of %s failed: %w", result.PublicKey, err)
+	}
+	result.RxBytes, err = strconv.ParseUint(fields[5], 10, 64)
+	if err != nil {
+		return result, fmt.Errorf("Parsing received bytes of %s failed: %w", result.PublicKey, err)
+	}
+	result.TxBytes, err = strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return result, fmt.Errorf("Parsing transmitted bytes of %s failed: %w", result.PublicKey, err)
+	}
+	if fields[7] != "off" {
+		result.Keepalive, err = strconv.Atoi(fields[7])
+		if err != nil {
+			return result, fmt.Errorf("Parsing keepalive of %s failed: %w", result.PublicKey, err)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,375 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Generic netlink and Wireguard constants (linux/genetlink.h, linux/wireguard.h)
+const (
+	genlIDCtrl             = 0x10
+	genlCtrlCmdGetFamily   = 3
+	genlCtrlAttrFamilyID   = 1
+	genlCtrlAttrFamilyName = 2
+	genlHeaderLen          = 4
+
+	nlaTypeMask  = 0x3fff
+	nlaHeaderLen = 4
+
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+	wgCmdGetDev   = 0
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPublicKey  = 4
+	wgDeviceAListenPort = 6
+	wgDeviceAFwmark     = 7
+	wgDeviceAPeers      = 8
+
+	wgPeerAPublicKey    = 1
+	wgPeerAPresharedKey = 2
+	wgPeerAEndpoint     = 4
+	wgPeerAKeepalive    = 5
+	wgPeerALastHS       = 6
+	wgPeerARxBytes      = 7
+	wgPeerATxBytes      = 8
+	wgPeerAAllowedIPs   = 9
+
+	wgAllowedIPAFamily = 1
+	wgAllowedIPAIPAddr = 2
+	wgAllowedIPACIDR   = 3
+)
+
+// netlinkWGClient reads the state of Wireguard interfaces through the generic netlink
+// API of the kernel module, like "wg" itself does.
+type netlinkWGClient struct{}
+
+func (netlinkWGClient) Interfaces() ([]string, error) {
+	return sysfsWGInterfaces()
+}
+
+func (netlinkWGClient) Device(name string) (wgDevice, error) {
+	result := wgDevice{Name: name}
+
+	conn, err := dialGenetlink()
+	if err != nil {
+		return result, err
+	}
+	defer conn.close()
+
+	family, err := conn.resolveFamily(wgGenlName)
+	if err != nil {
+		return result, err
+	}
+
+	msgs, err := conn.execute(family, wgCmdGetDev, wgGenlVersion, syscall.NLM_F_DUMP,
+		nlAttr(wgDeviceAIfname, append([]byte(name), 0)))
+	if err != nil {
+		return result, fmt.Errorf("Reading Wireguard device %s via netlink failed: %w", name, err)
+	}
+
+	return parseWGNetlinkDevice(name, msgs)
+}
+
+// parseWGNetlinkDevice decodes the attributes of the messages replied to WG_CMD_GET_DEVICE.
+// Devices with many peers are split across messages. A peer continued in the next message is
+// repeated with its public key and the remaining allowed IPs.
+func parseWGNetlinkDevice(name string, msgs [][]byte) (wgDevice, error) {
+	result := wgDevice{Name: name}
+
+	for _, msg := range msgs {
+		attrs, err := parseNLAttrs(msg)
+		if err != nil {
+			return result, err
+		}
+
+		for _, attr := range attrs {
+			switch attr.typ {
+			case wgDeviceAPublicKey:
+				result.PublicKey = base64.StdEncoding.EncodeToString(attr.data)
+			case wgDeviceAListenPort:
+				result.ListenPort = int(nativeEndian.Uint16(attr.data))
+			case wgDeviceAFwmark:
+				result.FwMark = nativeEndian.Uint32(attr.data)
+			case wgDeviceAPeers:
+				peers, err := parseNLAttrs(attr.data)
+				if err != nil {
+					return result, err
+				}
+				for _, p := range peers {
+					peer, err := parseWGNetlinkPeer(p.data)
+					if err != nil {
+						return result, err
+					}
+
+					last := len(result.Peers) - 1
+					if last >= 0 && result.Peers[last].PublicKey == peer.PublicKey {
+						result.Peers[last].AllowedIPs = append(result.Peers[last].AllowedIPs, peer.AllowedIPs...)
+					} else {
+						result.Peers = append(result.Peers, peer)
+					}
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// parseWGNetlinkPeer decodes the nested attributes of a peer.
+func parseWGNetlinkPeer(data []byte) (wgPeerState, error) {
+	var result wgPeerState
+
+	attrs, err := parseNLAttrs(data)
+	if err != nil {
+		return result, err
+	}
+
+	for _, attr := range attrs {
+		switch attr.typ {
+		case wgPeerAPublicKey:
+			result.PublicKey = base64.StdEncoding.EncodeToString(attr.data)
+		case wgPeerAPresharedKey:
+			for _, b := range attr.data {
+				if b != 0 {
+					result.PresharedKey = true
+				}
+			}
+		case wgPeerAEndpoint:
+			result.Endpoint = parseSockaddr(attr.data)
+		case wgPeerAKeepalive:
+			result.Keepalive = int(nativeEndian.Uint16(attr.data))
+		case wgPeerALastHS:
+			if len(attr.data) >= 16 {
+				result.LastHandshake = int64(nativeEndian.Uint64(attr.data[0:8]))
+			}
+		case wgPeerARxBytes:
+			result.RxBytes = nativeEndian.Uint64(attr.data)
+		case wgPeerATxBytes:
+			result.TxBytes = nativeEndian.Uint64(attr.data)
+		case wgPeerAAllowedIPs:
+			ips, err := parseNLAttrs(attr.data)
+			if err != nil {
+				return result, err
+			}
+			for _, ip := range ips {
+				allowed, err := parseWGAllowedIP(ip.data)
+				if err != nil {
+					return result, err
+				}
+				result.AllowedIPs = append(result.AllowedIPs, allowed)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// parseWGAllowedIP decodes an allowed IP into CIDR notation.
+func parseWGAllowedIP(data []byte) (string, error) {
+	attrs, err := parseNLAttrs(data)
+	if err != nil {
+		return "", err
+	}
+
+	var ip net.IP
+	var mask int
+	for _, attr := range attrs {
+		switch attr.typ {
+		case wgAllowedIPAIPAddr:
+			ip = net.IP(attr.data)
+		case wgAllowedIPACIDR:
+			if len(attr.data) > 0 {
+				mask = int(attr.data[0])
+			}
+		}
+	}
+	if ip == nil {
+		return "", errors.New("Allowed IP without address")
+	}
+	return ip.String() + "/" + strconv.Itoa(mask), nil
+}
+
+// parseSockaddr decodes a struct sockaddr_in or sockaddr_in6 into host:port.
+func parseSockaddr(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	port := int(binary.BigEndian.Uint16(data[2:4]))
+
+	switch nativeEndian.Uint16(data[0:2]) {
+	case syscall.AF_INET:
+		if len(data) >= 8 {
+			return net.JoinHostPort(net.IP(data[4:8]).String(), strconv.Itoa(port))
+		}
+	case syscall.AF_INET6:
+		if len(data) >= 24 {
+			return net.JoinHostPort(net.IP(data[8:24]).String(), strconv.Itoa(port))
+		}
+	}
+	return ""
+}
+
+// nlAttribute is a netlink attribute with its type stripped of the nested and byte order flags.
+type nlAttribute struct {
+	typ  uint16
+	data []byte
+}
+
+func nlAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	result := make([]byte, nlAlign(nlaHeaderLen+len(data)))
+	nativeEndian.PutUint16(result[0:2], uint16(nlaHeaderLen+len(data)))
+	nativeEndian.PutUint16(result[2:4], typ)
+	copy(result[nlaHeaderLen:], data)
+	return result
+}
+
+func parseNLAttrs(data []byte) ([]nlAttribute, error) {
+	var result []nlAttribute
+
+	for len(data) >= nlaHeaderLen {
+		length := int(nativeEndian.Uint16(data[0:2]))
+		if length < nlaHeaderLen || length > len(data) {
+			return nil, errors.New("Netlink attribute is truncated")
+		}
+		result = append(result, nlAttribute{
+			typ:  nativeEndian.Uint16(data[2:4]) & nlaTypeMask,
+			data: data[nlaHeaderLen:length],
+		})
+
+		if nlAlign(length) >= len(data) {
+			break
+		}
+		data = data[nlAlign(length):]
+	}
+
+	return result, nil
+}
+
+// genetlinkConn is a generic netlink socket.
+type genetlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialGenetlink() (*genetlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, fmt.Errorf("Opening netlink socket failed: %w", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Binding netlink socket failed: %w", err)
+	}
+
+	return &genetlinkConn{fd: fd, seq: uint32(os.Getpid())}, nil
+}
+
+func (conn *genetlinkConn) close() {
+	syscall.Close(conn.fd)
+}
+
+// resolveFamily returns the ID of the generic netlink family with the given name.
+func (conn *genetlinkConn) resolveFamily(name string) (uint16, error) {
+	msgs, err := conn.execute(genlIDCtrl, genlCtrlCmdGetFamily, 1, 0,
+		nlAttr(genlCtrlAttrFamilyName, append([]byte(name), 0)))
+	if err == syscall.ENOENT {
+		return 0, errors.New("Netlink family " + name + " is not available")
+	} else if err != nil {
+		return 0, fmt.Errorf("Resolving netlink family %s failed: %w", name, err)
+	}
+
+	for _, msg := range msgs {
+		attrs, err := parseNLAttrs(msg)
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.typ == genlCtrlAttrFamilyID && len(attr.data) >= 2 {
+				return nativeEndian.Uint16(attr.data), nil
+			}
+		}
+	}
+	return 0, errors.New("Netlink family " + name + " is not available")
+}
+
+// execute sends a generic netlink request and returns the attributes of all messages
+// of the reply, which ends with an acknowledgement or, for dumps, a done message.
+func (conn *genetlinkConn) execute(family uint16, cmd uint8, version uint8, flags uint16, attrs ...[]byte) ([][]byte, error) {
+	conn.seq++
+
+	var payload []byte
+	for _, attr := range attrs {
+		payload = append(payload, attr...)
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+genlHeaderLen, syscall.NLMSG_HDRLEN+genlHeaderLen+len(payload))
+	msg = append(msg, payload...)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], family)
+	nativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(msg[8:12], conn.seq)
+	msg[syscall.NLMSG_HDRLEN] = cmd
+	msg[syscall.NLMSG_HDRLEN+1] = version
+
+	err := syscall.Sendto(conn.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	var result [][]byte
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		n, _, err := syscall.Recvfrom(conn.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reply := range replies {
+			if reply.Header.Seq != conn.seq {
+				continue
+			}
+
+			switch reply.Header.Type {
+			case syscall.NLMSG_DONE:
+				return result, nil
+			case syscall.NLMSG_ERROR:
+				if len(reply.Data) < 4 {
+					return nil, errors.New("Netlink error message is truncated")
+				}
+				errno := int32(nativeEndian.Uint32(reply.Data[0:4]))
+				if errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// Acknowledgement of a request without dump
+				if flags&syscall.NLM_F_DUMP == 0 {
+					return result, nil
+				}
+			default:
+				if len(reply.Data) >= genlHeaderLen {
+					result = append(result, append([]byte{}, reply.Data[genlHeaderLen:]...))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// wgGetDeviceReply holds the attributes of the two messages replied to WG_CMD_GET_DEVICE for
+// wg0 with two peers, as sent by a little-endian kernel. The second peer does not fit into the
+// first message and is continued with its remaining allowed IPs in the second one.
+var wgGetDeviceReply = [][]byte{{
+	// WGDEVICE_A_IFINDEX 5
+	0x08, 0x00, 0x01, 0x00, 0x05, 0x00, 0x00, 0x00,
+	// WGDEVICE_A_IFNAME "wg0"
+	0x08, 0x00, 0x02, 0x00, 0x77, 0x67, 0x30, 0x00,
+	// WGDEVICE_A_PRIVATE_KEY
+	0x24, 0x00, 0x03, 0x00, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+	0x11, 0x11, 0x11, 0x11,
+	// WGDEVICE_A_PUBLIC_KEY
+	0x24, 0x00, 0x04, 0x00, 0x3b, 0x9a, 0xa1, 0x42, 0xfe, 0xfa, 0x44, 0xaa, 0xb8, 0x3a, 0xb1, 0xc0,
+	0x90, 0x9f, 0x69, 0x29, 0xfd, 0x53, 0x65, 0x6b, 0x89, 0x5e, 0xc2, 0xfc, 0x0e, 0x47, 0xd4, 0x12,
+	0xea, 0x62, 0xba, 0x54,
+	// WGDEVICE_A_LISTEN_PORT 51820, 2 bytes padding
+	0x06, 0x00, 0x06, 0x00, 0x6c, 0xca, 0x00, 0x00,
+	// WGDEVICE_A_FWMARK 0x1234
+	0x08, 0x00, 0x07, 0x00, 0x34, 0x12, 0x00, 0x00,
+	// WGDEVICE_A_PEERS (nested)
+	0x80, 0x01, 0x08, 0x80,
+	//   peer 0 (nested)
+	0xbc, 0x00, 0x00, 0x80,
+	//     WGPEER_A_PUBLIC_KEY
+	0x24, 0x00, 0x01, 0x00, 0xf6, 0x45, 0x51, 0xfc, 0xd6, 0xf0, 0x78, 0x23, 0xcb, 0x87, 0x97, 0x1c,
+	0xfb, 0x91, 0x44, 0x64, 0x25, 0xda, 0x18, 0x28, 0x6b, 0x3a, 0xb1, 0xef, 0x93, 0x5e, 0x0c, 0xbd,
+	0x7a, 0x69, 0xf6, 0x8a,
+	//     WGPEER_A_PRESHARED_KEY (none)
+	0x24, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_ENDPOINT 203.0.113.10:51820
+	0x14, 0x00, 0x04, 0x00, 0x02, 0x00, 0xca, 0x6c, 0xcb, 0x00, 0x71, 0x0a, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL 25, 2 bytes padding
+	0x06, 0x00, 0x05, 0x00, 0x19, 0x00, 0x00, 0x00,
+	//     WGPEER_A_LAST_HANDSHAKE_TIME
+	0x14, 0x00, 0x06, 0x00, 0x00, 0xf1, 0x53, 0x65, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_RX_BYTES
+	0x0c, 0x00, 0x07, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_TX_BYTES
+	0x0c, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_ALLOWEDIPS (nested)
+	0x20, 0x00, 0x09, 0x80,
+	//       allowed IP 0 (nested)
+	0x1c, 0x00, 0x00, 0x80,
+	//         family, 2 bytes padding
+	0x06, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00,
+	//         address 10.0.0.2
+	0x08, 0x00, 0x02, 0x00, 0x0a, 0x00, 0x00, 0x02,
+	//         cidr 32, 3 bytes padding
+	0x05, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x00,
+	//     WGPEER_A_PROTOCOL_VERSION
+	0x08, 0x00, 0x0a, 0x00, 0x01, 0x00, 0x00, 0x00,
+	//   peer 1 (nested)
+	0xc0, 0x00, 0x01, 0x80,
+	//     WGPEER_A_PUBLIC_KEY
+	0x24, 0x00, 0x01, 0x00, 0x39, 0x46, 0xca, 0x64, 0xff, 0x78, 0xd9, 0x3c, 0xa6, 0x10, 0x90, 0xa4,
+	0x37, 0xcb, 0xb6, 0xb3, 0xd2, 0xca, 0x0d, 0x48, 0x8f, 0x5f, 0x9c, 0xcf, 0x30, 0x59, 0x60, 0x83,
+	0x68, 0xb2, 0x76, 0x93,
+	//     WGPEER_A_PRESHARED_KEY
+	0x24, 0x00, 0x02, 0x00, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42,
+	0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42,
+	0x42, 0x42, 0x42, 0x42,
+	//     WGPEER_A_ENDPOINT [2001:db8::10]:41237
+	0x20, 0x00, 0x04, 0x00, 0x0a, 0x00, 0xa1, 0x15, 0x00, 0x00, 0x00, 0x00, 0x20, 0x01, 0x0d, 0xb8,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL 0, 2 bytes padding
+	0x06, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_LAST_HANDSHAKE_TIME
+	0x14, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_RX_BYTES
+	0x0c, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_TX_BYTES
+	0x0c, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	//     WGPEER_A_ALLOWEDIPS (nested)
+	0x20, 0x00, 0x09, 0x80,
+	//       allowed IP 0 (nested)
+	0x1c, 0x00, 0x00, 0x80,
+	//         family, 2 bytes padding
+	0x06, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00,
+	//         address 10.0.0.3
+	0x08, 0x00, 0x02, 0x00, 0x0a, 0x00, 0x00, 0x03,
+	//         cidr 32, 3 bytes padding
+	0x05, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x00,
+}, {
+	// WGDEVICE_A_IFINDEX 5
+	0x08, 0x00, 0x01, 0x00, 0x05, 0x00, 0x00, 0x00,
+	// WGDEVICE_A_IFNAME "wg0"
+	0x08, 0x00, 0x02, 0x00, 0x77, 0x67, 0x30, 0x00,
+	// WGDEVICE_A_PEERS (nested)
+	0x74, 0x00, 0x08, 0x80,
+	//   peer 1 continued (nested)
+	0x70, 0x00, 0x00, 0x80,
+	//     WGPEER_A_PUBLIC_KEY
+	0x24, 0x00, 0x01, 0x00, 0x39, 0x46, 0xca, 0x64, 0xff, 0x78, 0xd9, 0x3c, 0xa6, 0x10, 0x90, 0xa4,
+	0x37, 0xcb, 0xb6, 0xb3, 0xd2, 0xca, 0x0d, 0x48, 0x8f, 0x5f, 0x9c, 0xcf, 0x30, 0x59, 0x60, 0x83,
+	0x68, 0xb2, 0x76, 0x93,
+	//     WGPEER_A_ALLOWEDIPS (nested)
+	0x48, 0x00, 0x09, 0x80,
+	//       allowed IP 0 (nested)
+	0x1c, 0x00, 0x00, 0x80,
+	//         family, 2 bytes padding
+	0x06, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00,
+	//         address 192.168.10.0
+	0x08, 0x00, 0x02, 0x00, 0xc0, 0xa8, 0x0a, 0x00,
+	//         cidr 24, 3 bytes padding
+	0x05, 0x00, 0x03, 0x00, 0x18, 0x00, 0x00, 0x00,
+	//       allowed IP 1 (nested)
+	0x28, 0x00, 0x01, 0x80,
+	//         family, 2 bytes padding
+	0x06, 0x00, 0x01, 0x00, 0x0a, 0x00, 0x00, 0x00,
+	//         address fd00::
+	0x14, 0x00, 0x02, 0x00, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	//         cidr 64, 3 bytes padding
+	0x05, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x00,
+}}
+
+func TestParseWGNetlinkDevice(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("Reply was captured on a little-endian host")
+	}
+
+	device, err := parseWGNetlinkDevice("wg0", wgGetDeviceReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := wgDevice{
+		Name:       "wg0",
+		PublicKey:  "O5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=",
+		ListenPort: 51820,
+		FwMark:     0x1234,
+		Peers: []wgPeerState{{
+			PublicKey:     "9kVR/NbweCPLh5cc+5FEZCXaGChrOrHvk14MvXpp9oo=",
+			Endpoint:      "203.0.113.10:51820",
+			AllowedIPs:    []string{"10.0.0.2/32"},
+			LastHandshake: 1700000000,
+			RxBytes:       1048576,
+			TxBytes:       524288,
+			Keepalive:     25,
+		}, {
+			PublicKey:    "OUbKZP942TymEJCkN8u2s9LKDUiPX5zPMFlgg2iydpM=",
+			PresharedKey: true,
+			Endpoint:     "[2001:db8::10]:41237",
+			AllowedIPs:   []string{"10.0.0.3/32", "192.168.10.0/24", "fd00::/64"},
+		}},
+	}
+	if !reflect.DeepEqual(device, want) {
+		t.Errorf("parseWGNetlinkDevice() =\n%+v\nwant\n%+v", device, want)
+	}
+}
+
+func TestParseNLAttrs(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("Attributes are given in little-endian")
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		types []uint16
+		sizes []int
+		fails bool
+	}{
+		{"empty", nil, nil, nil, false},
+		{"padded", []byte{0x05, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x06, 0x00, 0x02, 0x00, 0x6c, 0xca, 0x00, 0x00}, []uint16{1, 2}, []int{1, 2}, false},
+		{"last attribute unpadded", []byte{0x05, 0x00, 0x03, 0x00, 0x20}, []uint16{3}, []int{1}, false},
+		{"nested and byte order flags", []byte{0x04, 0x00, 0x08, 0x80, 0x04, 0x00, 0x09, 0x40}, []uint16{8, 9}, []int{0, 0}, false},
+		{"trailing bytes", []byte{0x04, 0x00, 0x01, 0x00, 0x00, 0x00}, []uint16{1}, []int{0}, false},
+		{"length beyond data", []byte{0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}, nil, nil, true},
+		{"length below header", []byte{0x02, 0x00, 0x01, 0x00}, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		attrs, err := parseNLAttrs(test.data)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if len(attrs) != len(test.types) {
+			t.Errorf("%s: got %d attributes, want %d", test.name, len(attrs), len(test.types))
+			continue
+		}
+		for i, attr := range attrs {
+			if attr.typ != test.types[i] || len(attr.data) != test.sizes[i] {
+				t.Errorf("%s: attribute %d has type %d with %d bytes, want %d with %d", test.name, i, attr.typ, len(attr.data), test.types[i], test.sizes[i])
+			}
+		}
+	}
+
+	// Truncated nested attributes of a captured reply are rejected
+	if _, err := parseWGNetlinkDevice("wg0", [][]byte{wgGetDeviceReply[0][:200]}); err == nil {
+		t.Error("Truncated reply was parsed")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// netlinkWGClient is only available on linux.
+type netlinkWGClient struct{}
+
+func (netlinkWGClient) Interfaces() ([]string, error) {
+	return sysfsWGInterfaces()
+}
+
+func (netlinkWGClient) Device(name string) (wgDevice, error) {
+	return wgDevice{Name: name}, errors.New("Reading Wireguard devices via netlink is only supported on linux")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	s "strings"
+	"testing"
+)
+
+// staticRunner returns the same output for every command.
+type staticRunner string
+
+func (r staticRunner) Run(name string, args ...string) ([]byte, error) {
+	return []byte(r), nil
+}
+
+func TestParseWGDumpPeer(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		want  wgPeerState
+		fails bool
+	}{
+		{
+			name: "IPv4 endpoint with keepalive",
+			line: "OUbKZP942TymEJCkN8u2s9LKDUiPX5zPMFlgg2iydpM=\tTbdiDHZpxZ0q4Dvtm4vTQM0oegGNBs3UNiwQSR/awj4=\t198.51.100.22:41237\t10.0.0.3/32,192.168.10.0/24\t1699999880\t20971520\t3145728\t25",
+			want: wgPeerState{PublicKey: "OUbKZP942TymEJCkN8u2s9LKDUiPX5zPMFlgg2iydpM=", PresharedKey: true, Endpoint: "198.51.100.22:41237",
+				AllowedIPs: []string{"10.0.0.3/32", "192.168.10.0/24"}, LastHandshake: 1699999880, RxBytes: 20971520, TxBytes: 3145728, Keepalive: 25},
+		},
+		{
+			name: "IPv6 endpoint",
+			line: "9kVR/NbweCPLh5cc+5FEZCXaGChrOrHvk14MvXpp9oo=\t(none)\t[2001:db8::10]:51820\t10.0.0.2/32,fd00::2/128\t1700000000\t1048576\t524288\toff",
+			want: wgPeerState{PublicKey: "9kVR/NbweCPLh5cc+5FEZCXaGChrOrHvk14MvXpp9oo=", Endpoint: "[2001:db8::10]:51820",
+				AllowedIPs: []string{"10.0.0.2/32", "fd00::2/128"}, LastHandshake: 1700000000, RxBytes: 1048576, TxBytes: 524288},
+		},
+		{
+			name: "never connected",
+			line: "Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\t(none)\t(none)\t(none)\t0\t0\t0\toff",
+			want: wgPeerState{PublicKey: "Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0="},
+		},
+		{
+			name:  "missing field",
+			line:  "Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\t(none)\t(none)\t(none)\t0\t0\t0",
+			fails: true,
+		},
+		{
+			name:  "invalid keepalive",
+			line:  "Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\t(none)\t(none)\t(none)\t0\t0\t0\tsometimes",
+			fails: true,
+		},
+		{
+			name:  "negative transfer",
+			line:  "Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\t(none)\t(none)\t(none)\t0\t-1\t0\toff",
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		peer, err := parseWGDumpPeer(s.Split(test.line, "\t"))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: parsed as %+v", test.name, peer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(peer, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, peer, test.want)
+		}
+	}
+}
+
+func TestParseWGDump(t *testing.T) {
+	runner := host.runner
+	defer func() { host.runner = runner }()
+
+	tests := []struct {
+		name   string
+		dump   string
+		port   int
+		fwmark uint32
+		peers  int
+		fails  bool
+	}{
+		{"fwmark off", "cHJpdmF0ZQ==\tO5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=\t51820\toff\n" +
+			"Q7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\t(none)\t(none)\t10.0.0.4/32\t0\t0\t0\toff\n", 51820, 0, 1, false},
+		{"fwmark in hex", "(none)\tO5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=\t0\t0xca6c\n", 0, 0xca6c, 0, false},
+		{"empty", "\n", 0, 0, 0, true},
+		{"invalid interface line", "O5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=\t51820\n", 0, 0, 0, true},
+		{"invalid peer line", "(none)\tO5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=\t51820\toff\nQ7sA0M53kKU7kSVrNwyIeyR5GlU5pvv7cMWHDoyRrl0=\n", 0, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		host.runner = staticRunner(test.dump)
+		device, err := parseWGDump("wg0")
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: parsed as %+v", test.name, device)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if device.Name != "wg0" || device.PublicKey != "O5qhQv76RKq4OrHAkJ9pKf1TZWuJXsL8DkfUEupiulQ=" ||
+			device.ListenPort != test.port || device.FwMark != test.fwmark || len(device.Peers) != test.peers {
+			t.Errorf("%s: got %+v", test.name, device)
+		}
+	}
+}
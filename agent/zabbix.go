@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	s "strings"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+const (
+	zabbixHeader      = "ZBXD\x01"
+	zabbixNotSupport  = "ZBX_NOTSUPPORTED\x00"
+	zabbixMaxDataSize = 65536
+)
+
+// serveZabbix answers a single Zabbix passive check request. Requests and responses are framed
+// by the "ZBXD\x01" header followed by the data length as 64-bit little-endian integer.
+func serveZabbix(rd *bufio.Reader, w io.Writer) error {
+	key, err := readZabbixRequest(rd)
+	if err != nil {
+		return err
+	}
+
+	value, err := getZabbixItem(key)
+	if err != nil {
+		value = zabbixNotSupport + err.Error()
+	}
+
+	packet := make([]byte, len(zabbixHeader)+8+len(value))
+	copy(packet, zabbixHeader)
+	binary.LittleEndian.PutUint64(packet[len(zabbixHeader):], uint64(len(value)))
+	copy(packet[len(zabbixHeader)+8:], value)
+
+	_, err = w.Write(packet)
+	return err
+}
+
+// readZabbixRequest reads a framed request and returns the requested item key.
+func readZabbixRequest(rd *bufio.Reader) (string, error) {
+	header := make([]byte, len(zabbixHeader)+8)
+	_, err := io.ReadFull(rd, header)
+	if err != nil {
+		return "", fmt.Errorf("Reading Zabbix request failed: %w", err)
+	}
+
+	if string(header[:len(zabbixHeader)]) != zabbixHeader {
+		return "", errors.New("Zabbix request has an unsupported header")
+	}
+
+	// Newer Zabbix versions split the length into data length and reserved bytes
+	length := binary.LittleEndian.Uint32(header[len(zabbixHeader):])
+	if length > zabbixMaxDataSize {
+		return "", errors.New("Zabbix request exceeds maximum size")
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(rd, data)
+	if err != nil {
+		return "", fmt.Errorf("Reading Zabbix request failed: %w", err)
+	}
+
+	return s.TrimSpace(string(data)), nil
+}
+
+// parseZabbixKey splits an item key of the form "name[param1,param2]" into name and parameters.
+// Parameters may be quoted to contain commas or brackets.
+func parseZabbixKey(key string) (string, []string, error) {
+	var params []string
+
+	i := s.IndexByte(key, '[')
+	if i < 0 {
+		return key, params, nil
+	} else if !s.HasSuffix(key, "]") {
+		return "", params, errors.New("Invalid item key " + key)
+	}
+
+	name := key[:i]
+	raw := key[i+1 : len(key)-1]
+
+	var current s.Builder
+	quoted := false
+	for j := 0; j < len(raw); j++ {
+		switch {
+		case raw[j] == '"':
+			quoted = !quoted
+		case raw[j] == '\\' && quoted && j+1 < len(raw) && raw[j+1] == '"':
+			current.WriteByte('"')
+			j++
+		case raw[j] == ',' && !quoted:
+			params = append(params, s.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(raw[j])
+		}
+	}
+	params = append(params, s.TrimSpace(current.String()))
+
+	return name, params, nil
+}
+
+// zabbixParam returns the parameter at index i or def, if it is missing or empty.
+func zabbixParam(params []string, i int, def string) string {
+	if i < len(params) && params[i] != "" {
+		return params[i]
+	}
+	return def
+}
+
+// getZabbixItem returns the current value of the item with the given key.
+func getZabbixItem(key string) (string, error) {
+	name, params, err := parseZabbixKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	switch name {
+	case "agent.ping":
+		return "1", nil
+	case "agent.version":
+		return version, nil
+	case "agent.hostname", "system.hostname":
+		return os.Hostname()
+	case "system.uptime":
+		uptime, err := getUptime()
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(uptime.Uptime.Seconds())), nil
+	case "system.cpu.util":
+		cpu, err := getCPUUsage()
+		if err != nil {
+			return "", err
+		}
+		switch zabbixParam(params, 1, "user") {
+		case "user":
+			return formatZabbixFloat(cpu.User), nil
+		case "system":
+			return formatZabbixFloat(cpu.System), nil
+		case "idle":
+			return formatZabbixFloat(cpu.Idle), nil
+		}
+		return "", errors.New("Unsupported CPU state " + params[1])
+	case "vm.memory.utilization":
+		mem, err := getMemUsage()
+		if err != nil {
+			return "", err
+		}
+		return formatZabbixFloat(mem.Used), nil
+	case "net.if.in", "net.if.out":
+		device := zabbixParam(params, 0, "")
+		stats, err := readNetDev()
+		if err != nil {
+			return "", err
+		}
+		for _, stat := range stats {
+			if stat.Name == device {
+				return zabbixNetCounter(stat, name == "net.if.in", zabbixParam(params, 1, "bytes"))
+			}
+		}
+		return "", errors.New("Could not find device with name " + device)
+	case "wireguard.peer.handshake", "wireguard.peer.rx", "wireguard.peer.tx":
+		peers, err := getWireguard()
+		if err != nil {
+			return "", err
+		}
+		peer, err := lib.SelectPeer(peers, zabbixParam(params, 0, ""))
+		if err != nil {
+			return "", err
+		}
+		switch name {
+		case "wireguard.peer.handshake":
+			age, ok := lib.HandshakeAge(peer, host.now().Unix())
+			if !ok {
+				return "", errors.New("Peer has never connected")
+			}
+			return strconv.FormatInt(age, 10), nil
+		case "wireguard.peer.rx":
+			return formatZabbixFloat(peer.PeerRate.Rx), nil
+		}
+		return formatZabbixFloat(peer.PeerRate.Tx), nil
+	}
+
+	return "", errors.New("Unsupported item key")
+}
+
+// zabbixNetCounter returns a counter of a network device like the Zabbix agent does for net.if.in
+// and net.if.out. Rates are left to the "Change per second" preprocessing of the item.
+func zabbixNetCounter(stat netDevStat, in bool, mode string) (string, error) {
+	counters := map[string][2]uint64{
+		"bytes":    {stat.RxBytes, stat.TxBytes},
+		"packets":  {stat.RxPackets, stat.TxPackets},
+		"errors":   {stat.RxErrors, stat.TxErrors},
+		"dropped":  {stat.RxDrops, stat.TxDrops},
+		"overruns": {stat.RxFifo, stat.TxFifo},
+	}
+	counter, ok := counters[mode]
+	if !ok {
+		return "", errors.New("Unsupported mode " + mode)
+	}
+	if in {
+		return strconv.FormatUint(counter[0], 10), nil
+	}
+	return strconv.FormatUint(counter[1], 10), nil
+}
+
+func formatZabbixFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseZabbixKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		params []string
+	}{
+		{"agent.ping", "agent.ping", nil},
+		{"net.if.in[eth0]", "net.if.in", []string{"eth0"}},
+		{"system.cpu.util[,system]", "system.cpu.util", []string{"", "system"}},
+		{`wireguard.peer.rx["name:plant, berlin"]`, "wireguard.peer.rx", []string{"name:plant, berlin"}},
+		{`x["a\"b",c]`, "x", []string{`a"b`, "c"}},
+	}
+	for _, test := range tests {
+		name, params, err := parseZabbixKey(test.key)
+		if err != nil || name != test.name || len(params) != len(test.params) {
+			t.Errorf("%s: %s %q %v", test.key, name, params, err)
+			continue
+		}
+		for i := range params {
+			if params[i] != test.params[i] {
+				t.Errorf("%s: parameter %d = %q, want %q", test.key, i, params[i], test.params[i])
+			}
+		}
+	}
+
+	if _, _, err := parseZabbixKey("net.if.in[eth0"); err == nil {
+		t.Error("Key without closing bracket was accepted")
+	}
+}
+
+func TestZabbixNetItems(t *testing.T) {
+	saved := *host
+	defer func() { *host = saved }()
+	host.procRoot = filepath.Join("testdata", "g3000", "proc")
+
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"net.if.in[eth0]", "9812734112"},
+		{"net.if.out[eth0,bytes]", "2123987123"},
+		{"net.if.in[eth0,packets]", "12873123"},
+		{"net.if.in[eth0,dropped]", "12"},
+		{"net.if.in[eth1,errors]", "3"},
+		{"net.if.out[eth1,overruns]", "0"},
+	}
+	// Counters are read from the first sample of the fixture
+	for _, test := range tests {
+		host.procSamples = newFixtureSequence()
+		value, err := getZabbixItem(test.key)
+		if err != nil || value != test.value {
+			t.Errorf("%s = %s, %v, want %s", test.key, value, err, test.value)
+		}
+	}
+
+	for _, key := range []string{"net.if.in[eth9]", "net.if.in[eth0,frames]"} {
+		if value, err := getZabbixItem(key); err == nil {
+			t.Errorf("%s = %s, want error", key, value)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/ilkeskin/icinga-g3000/lib"
@@ -93,101 +96,121 @@ func CheckMemory(args CLIArguments) {
 	}
 }
 
-// CheckUpstream checks current upstream of a selected network device
+// CheckUpstream checks current upstream of the selected network devices
 func CheckUpstream(args CLIArguments) {
-	var netArr []lib.NetUsage
-
-	res, err := lib.QueryData(*args.Hostname, *args.Port, "/network", *args.Timeout)
-
-	config := &ms.DecoderConfig{
-		TagName: "json",
-		Result:  &netArr,
+	nicArr, err := queryNetDevices(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
 	}
-	decoder, err := mapstructure.NewDecoder(config)
-	decoder.Decode(res)
 
-	var upstream float64
-	for i := range netArr {
-		if netArr[i].Name == *args.NetDevice {
-			upstream = netArr[i].Rx
-		}
+	state, output, err := checkNetValue(args, nicArr, "upstream", "kbps", true, func(nic lib.NetUsage) float64 { return nic.Tx })
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
 	}
+	GlobalReturnCode = state
+	fmt.Print(lib.StateName(GlobalReturnCode) + " - " + output + "\n")
+}
 
-	output, err := lib.ParseNetUsage(netArr, *args.NetDevice)
+// CheckDownstream checks current donwstream of the selected network devices
+func CheckDownstream(args CLIArguments) {
+	nicArr, err := queryNetDevices(args)
 	if err != nil {
 		fmt.Printf("UNKNOWN - %s\n", err)
 		return
 	}
-	GlobalReturnCode = exitOk
 
-	if args.Warning != nil && upstream > *args.Warning {
-		GlobalReturnCode = exitWarning
+	state, output, err := checkNetValue(args, nicArr, "downstream", "kbps", true, func(nic lib.NetUsage) float64 { return nic.Rx })
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
 	}
+	GlobalReturnCode = state
+	fmt.Print(lib.StateName(GlobalReturnCode) + " - " + output + "\n")
+}
 
-	if args.Critical != nil && upstream > *args.Critical {
-		GlobalReturnCode = exitCritical
+// checkNetValue evaluates a value of the selected network devices against the thresholds. Data
+// rates are also reported as utilisation of the capacity of the devices, to which thresholds given
+// in percent apply. Several devices are either added up and evaluated once ("sum") or evaluated on
+// their own with perfdata labels prefixed by the device name ("each"), the worst state is returned.
+func checkNetValue(args CLIArguments, nicArr []lib.NetUsage, label string, unit string, rate bool, value func(lib.NetUsage) float64) (int, string, error) {
+	if len(nicArr) == 1 {
+		return evaluateNetValue(args, nicArr[0].Name, label, unit, rate, value(nicArr[0]), nicArr[0].Capacity)
 	}
 
-	switch GlobalReturnCode {
-	case exitOk:
-		fmt.Print("OK - " + output[0] + "\n")
-	case exitWarning:
-		fmt.Print("WARNING - " + output[0] + "\n")
-	case exitCritical:
-		fmt.Print("CRITICAL - " + output[0] + "\n")
-	default:
-		GlobalReturnCode = exitUnknown
-		fmt.Print("UNKNOWN - Could not get upstream of device " + *args.NetDevice + "\n")
+	var names []string
+	for _, nic := range nicArr {
+		names = append(names, nic.Name)
 	}
-}
+	output := "devices " + strings.Join(names, ", ") + ":"
 
-// CheckDownstream checks current donwstream of a selected network device
-func CheckDownstream(args CLIArguments) {
-	var netArr []lib.NetUsage
-
-	res, err := lib.QueryData(*args.Hostname, *args.Port, "/network", *args.Timeout)
-
-	config := &ms.DecoderConfig{
-		TagName: "json",
-		Result:  &netArr,
+	if *args.Aggregate == "sum" {
+		var sum, capacity float64
+		unknown := false
+		for _, nic := range nicArr {
+			sum += value(nic)
+			capacity += nic.Capacity
+			unknown = unknown || nic.Capacity == 0
+		}
+		// The sum is only known if the capacity of every device is
+		if unknown {
+			capacity = 0
+		}
+		state, perfdata, err := evaluateNetValue(args, strings.Join(names, ", "), label, unit, rate, sum, capacity)
+		if err != nil {
+			return exitUnknown, "", err
+		}
+		return state, output + " " + perfdata, nil
 	}
-	decoder, err := mapstructure.NewDecoder(config)
-	decoder.Decode(res)
 
-	var upstream float64
-	for i := range netArr {
-		if netArr[i].Name == *args.NetDevice {
-			upstream = netArr[i].Rx
+	state := exitOk
+	for _, nic := range nicArr {
+		s, perfdata, err := evaluateNetValue(args, nic.Name, nic.Name+"-"+label, unit, rate, value(nic), nic.Capacity)
+		if err != nil {
+			return exitUnknown, "", err
+		}
+		if s > state {
+			state = s
 		}
+		output += " " + perfdata
 	}
+	return state, output, nil
+}
 
-	output, err := lib.ParseNetUsage(netArr, *args.NetDevice)
-	if err != nil {
-		fmt.Printf("UNKNOWN - %s\n", err)
-		return
+// evaluateNetValue evaluates a value of a network device against the thresholds and returns its
+// perfdata. Thresholds given in percent apply to the utilisation of the capacity by data rates,
+// they fail if the capacity is unknown.
+func evaluateNetValue(args CLIArguments, name string, label string, unit string, rate bool, value float64, capacity float64) (int, string, error) {
+	warning, critical := args.Warning, args.Critical
+	if args.WarnPct {
+		warning = nil
 	}
-
-	GlobalReturnCode = exitOk
-
-	if args.Warning != nil && upstream > *args.Warning {
-		GlobalReturnCode = exitWarning
+	if args.CritPct {
+		critical = nil
 	}
+	state := lib.Evaluate(value, warning, critical)
+	perfdata := fmt.Sprintf("'%s'=%.2f%s", label, value, unit)
 
-	if args.Critical != nil && upstream > *args.Critical {
-		GlobalReturnCode = exitCritical
+	if !rate || capacity <= 0 {
+		if args.WarnPct || args.CritPct {
+			return exitUnknown, "", errors.New("Capacity of device " + name + " is unknown, thresholds in percent need a capacity configured on the agent")
+		}
+		return state, perfdata, nil
 	}
 
-	switch GlobalReturnCode {
-	case exitOk:
-		fmt.Print("OK - " + output[1] + "\n")
-	case exitWarning:
-		fmt.Print("WARNING - " + output[1] + "\n")
-	case exitCritical:
-		fmt.Print("CRITICAL - " + output[1] + "\n")
-	default:
-		GlobalReturnCode = exitUnknown
-		fmt.Print("UNKNOWN - Could not get upstream of device " + *args.NetDevice + "\n")
+	warning, critical = nil, nil
+	if args.WarnPct {
+		warning = args.Warning
+	}
+	if args.CritPct {
+		critical = args.Critical
 	}
+	utilisation := value / capacity * 100
+	if s := lib.Evaluate(utilisation, warning, critical); s > state {
+		state = s
+	}
+	return state, perfdata + fmt.Sprintf(" '%s-utilisation'=%.2f%%", label, utilisation), nil
 }
 
 // CheckPeerHandshake checks secs since last handshake for a given WireGuard peer
@@ -203,15 +226,22 @@ func CheckPeerHandshake(args CLIArguments) {
 	decoder, err := mapstructure.NewDecoder(config)
 	decoder.Decode(res)
 
-	peer, err := lib.GetPeerByIndex(peerArr, *args.Peer)
-	output, err := lib.ParsePeer(peerArr, *args.Peer)
+	if args.Interface != nil {
+		peerArr = lib.FilterPeersByInterface(peerArr, *args.Interface)
+	}
+
+	peer, err := lib.SelectPeer(peerArr, *args.Peer)
 	if err != nil {
 		fmt.Printf("UNKNOWN - %s\n", err)
 		return
 	}
+	output := lib.FormatPeer(peer)
 
 	//fmt.Printf("Epoch is %d\nSecs since last handshake are %d\n", time.Now().Unix(), peer.LastHS)
-	secSinceHS := float64(time.Now().Unix() - peer.LastHS)
+	secSinceHS := math.Inf(1)
+	if age, ok := lib.HandshakeAge(peer, time.Now().Unix()); ok {
+		secSinceHS = float64(age)
+	}
 	GlobalReturnCode = exitOk
 
 	if args.Warning != nil && secSinceHS > *args.Warning {
@@ -248,14 +278,17 @@ func CheckPeerUpstream(args CLIArguments) {
 	decoder, err := mapstructure.NewDecoder(config)
 	decoder.Decode(res)
 
-	peer, err := lib.GetPeerByIndex(peerArr, *args.Peer)
-	output, err := lib.ParsePeer(peerArr, *args.Peer)
-	GlobalReturnCode = exitOk
+	if args.Interface != nil {
+		peerArr = lib.FilterPeersByInterface(peerArr, *args.Interface)
+	}
 
+	peer, err := lib.SelectPeer(peerArr, *args.Peer)
 	if err != nil {
 		fmt.Printf("UNKNOWN - %s\n", err)
 		return
 	}
+	output := lib.FormatPeer(peer)
+	GlobalReturnCode = exitOk
 
 	if args.Warning != nil && peer.PeerRate.Tx > *args.Warning {
 		GlobalReturnCode = exitWarning
@@ -291,14 +324,17 @@ func CheckPeerDownstream(args CLIArguments) {
 	decoder, err := mapstructure.NewDecoder(config)
 	decoder.Decode(res)
 
-	peer, err := lib.GetPeerByIndex(peerArr, *args.Peer)
-	output, err := lib.ParsePeer(peerArr, *args.Peer)
-	GlobalReturnCode = exitOk
+	if args.Interface != nil {
+		peerArr = lib.FilterPeersByInterface(peerArr, *args.Interface)
+	}
 
+	peer, err := lib.SelectPeer(peerArr, *args.Peer)
 	if err != nil {
 		fmt.Printf("UNKNOWN - %s\n", err)
 		return
 	}
+	output := lib.FormatPeer(peer)
+	GlobalReturnCode = exitOk
 
 	if args.Warning != nil && peer.PeerRate.Rx > *args.Warning {
 		GlobalReturnCode = exitWarning
@@ -320,3 +356,408 @@ func CheckPeerDownstream(args CLIArguments) {
 		fmt.Print("UNKNOWN - Could not get peer downstream\n")
 	}
 }
+
+// queryNetDevices queries the network devices of the agent and returns those selected by the
+// device argument, see lib.SelectNetDevices.
+func queryNetDevices(args CLIArguments) ([]lib.NetUsage, error) {
+	var netArr []lib.NetUsage
+
+	res, err := lib.QueryData(*args.Hostname, *args.Port, "/network", *args.Timeout)
+	if err != nil {
+		return netArr, err
+	}
+
+	config := &ms.DecoderConfig{
+		TagName: "json",
+		Result:  &netArr,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err == nil {
+		err = decoder.Decode(res)
+	}
+	if err != nil {
+		return netArr, err
+	}
+
+	return lib.SelectNetDevices(netArr, *args.NetDevice)
+}
+
+// CheckNetErrors checks the error rate, including FIFO overruns, of the selected network devices
+func CheckNetErrors(args CLIArguments) {
+	nicArr, err := queryNetDevices(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	if len(nicArr) > 1 {
+		state, output, err := checkNetValue(args, nicArr, "errors", "", false, lib.NetErrors)
+		if err != nil {
+			fmt.Printf("UNKNOWN - %s\n", err)
+			return
+		}
+		GlobalReturnCode = state
+		fmt.Print(lib.StateName(GlobalReturnCode) + " - " + output + "\n")
+		return
+	}
+
+	GlobalReturnCode = lib.Evaluate(lib.NetErrors(nicArr[0]), args.Warning, args.Critical)
+	fmt.Print(lib.StateName(GlobalReturnCode) + " - " + lib.FormatNetErrors(nicArr[0]) + "\n")
+}
+
+// CheckNetLink checks the links of the selected network devices, see lib.NetLinkState. Several
+// devices are always checked on their own, the details of every device follow the summary.
+func CheckNetLink(args CLIArguments) {
+	nicArr, err := queryNetDevices(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	// Agents before link details were added report no operstate
+	for _, nic := range nicArr {
+		if nic.OperState == "" && nic.Change != "vanished" {
+			fmt.Print("UNKNOWN - Agent reports no link details of device " + nic.Name + "\n")
+			return
+		}
+	}
+
+	if len(nicArr) == 1 {
+		GlobalReturnCode = lib.NetLinkState(nicArr[0])
+		fmt.Print(lib.StateName(GlobalReturnCode) + " - " + lib.FormatNetLink(nicArr[0]) + "\n")
+		return
+	}
+
+	var perfdata []string
+	failed := 0
+	GlobalReturnCode = exitOk
+	for _, nic := range nicArr {
+		state := lib.NetLinkState(nic)
+		if state > GlobalReturnCode {
+			GlobalReturnCode = state
+		}
+		if state != exitOk {
+			failed++
+		}
+		perfdata = append(perfdata, lib.NetLinkPerfdata(nic, nic.Name+"-"))
+	}
+
+	fmt.Printf("%s - %d of %d links up: %s\n", lib.StateName(GlobalReturnCode), len(nicArr)-failed, len(nicArr), strings.Join(perfdata, " "))
+	for _, nic := range nicArr {
+		fmt.Printf("[%s] %s\n", lib.StateName(lib.NetLinkState(nic)), lib.DescribeNetLink(nic))
+	}
+}
+
+// queryPeers queries the Wireguard peers of the agent, only those of the interface argument if set.
+func queryPeers(args CLIArguments) ([]lib.WGPeer, error) {
+	var peerArr []lib.WGPeer
+
+	res, err := lib.QueryData(*args.Hostname, *args.Port, "/wireguard", *args.Timeout)
+	if err != nil {
+		return peerArr, err
+	}
+
+	config := &ms.DecoderConfig{
+		TagName: "json",
+		Result:  &peerArr,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err == nil {
+		err = decoder.Decode(res)
+	}
+	if err != nil {
+		return peerArr, err
+	}
+
+	if args.Interface != nil {
+		peerArr = lib.FilterPeersByInterface(peerArr, *args.Interface)
+	}
+	return peerArr, nil
+}
+
+// queryPeer queries the Wireguard peers of the agent and returns the one selected by the peer
+// and interface arguments.
+func queryPeer(args CLIArguments) (lib.WGPeer, error) {
+	peerArr, err := queryPeers(args)
+	if err != nil {
+		return lib.WGPeer{}, err
+	}
+
+	return lib.SelectPeer(peerArr, *args.Peer)
+}
+
+// CheckPeerState checks the state of a given WireGuard peer, see lib.ClassifyPeer
+func CheckPeerState(args CLIArguments) {
+	peer, err := queryPeer(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	// Agents before the classification was added report no state
+	if peer.State == "" {
+		peer.State = lib.ClassifyPeer(peer, time.Now().Unix())
+	}
+
+	GlobalReturnCode = lib.PeerStateCode(peer.State)
+	if GlobalReturnCode == exitUnknown {
+		fmt.Print("UNKNOWN - Unknown state " + peer.State + " of " + lib.PeerLabel(peer) + "\n")
+		return
+	}
+	fmt.Print(lib.StateName(GlobalReturnCode) + " - " + lib.FormatPeerState(peer) + "\n")
+}
+
+// CheckPeerLatency checks round trip time and loss of the latest latency probe of a given WireGuard peer
+func CheckPeerLatency(args CLIArguments) {
+	peer, err := queryPeer(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	if peer.Latency == nil {
+		fmt.Print("UNKNOWN - No latency probed for " + lib.PeerLabel(peer) + ", are probes enabled?\n")
+		return
+	}
+	if peer.Latency.Error != "" {
+		fmt.Printf("UNKNOWN - Probing %s failed: %s\n", lib.PeerLabel(peer), peer.Latency.Error)
+		return
+	}
+
+	// Without answers there is no round trip time, the loss decides alone
+	GlobalReturnCode = lib.Evaluate(peer.Latency.Loss, args.LossWarn, args.LossCrit)
+	if peer.Latency.Received > 0 {
+		if state := lib.Evaluate(peer.Latency.Avg, args.Warning, args.Critical); state > GlobalReturnCode {
+			GlobalReturnCode = state
+		}
+	}
+	fmt.Print(lib.StateName(GlobalReturnCode) + " - " + lib.FormatLatency(peer, *peer.Latency) + "\n")
+}
+
+// CheckPeerFlaps checks how often the handshake of a given WireGuard peer went stale within a window
+func CheckPeerFlaps(args CLIArguments) {
+	var flapArr []lib.WGFlaps
+
+	peer, err := queryPeer(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	path := fmt.Sprintf("/wireguard/events?window=%d", int64(args.Window.Seconds()))
+	res, err := lib.QueryData(*args.Hostname, *args.Port, path, *args.Timeout)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	config := &ms.DecoderConfig{
+		TagName: "json",
+		Result:  &flapArr,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err == nil {
+		err = decoder.Decode(res)
+	}
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	for _, flaps := range flapArr {
+		if flaps.Interface != peer.Interface || flaps.PublicKey != peer.PublicKey {
+			continue
+		}
+
+		output := lib.FormatFlaps(peer, flaps, *args.Window, time.Now().Unix())
+		GlobalReturnCode = lib.Evaluate(float64(flaps.Flaps), args.Warning, args.Critical)
+		fmt.Print(lib.StateName(GlobalReturnCode) + " - " + output + "\n")
+		return
+	}
+
+	fmt.Print("UNKNOWN - No events recorded for " + lib.PeerLabel(peer) + "\n")
+}
+
+// CheckPeerDrift compares the WireGuard peers with the inventory given by file or on the command line
+func CheckPeerDrift(args CLIArguments) {
+	var expected []lib.ExpectedPeer
+
+	if args.Inventory != nil {
+		inventory, err := lib.LoadInventory(*args.Inventory)
+		if err != nil {
+			fmt.Printf("UNKNOWN - %s\n", err)
+			return
+		}
+		expected = append(expected, inventory...)
+	}
+	for _, value := range args.Expected {
+		peer, err := lib.ParseExpectedPeer(value)
+		if err != nil {
+			fmt.Printf("UNKNOWN - %s\n", err)
+			return
+		}
+		expected = append(expected, peer)
+	}
+
+	if args.Interface != nil {
+		var filtered []lib.ExpectedPeer
+		for _, peer := range expected {
+			if peer.Interface == "" || peer.Interface == *args.Interface {
+				filtered = append(filtered, peer)
+			}
+		}
+		expected = filtered
+	}
+	if len(expected) == 0 {
+		fmt.Print("UNKNOWN - No expected peers given, use --inventory or --expect\n")
+		return
+	}
+
+	peerArr, err := queryPeers(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	drifts := lib.DiffPeers(expected, peerArr)
+	counts := make(map[string]int)
+	GlobalReturnCode = exitOk
+	for _, drift := range drifts {
+		counts[drift.Kind]++
+		if drift.State > GlobalReturnCode {
+			GlobalReturnCode = drift.State
+		}
+	}
+
+	perfdata := fmt.Sprintf("'missing'=%d 'unexpected'=%d 'changed'=%d",
+		counts["missing"], counts["unexpected"], counts["allowed-ips"]+counts["endpoint"])
+	if len(drifts) == 0 {
+		fmt.Printf("OK - %d peers match the inventory: %s\n", len(expected), perfdata)
+		return
+	}
+
+	fmt.Printf("%s - %d differences to the inventory: %s\n", lib.StateName(GlobalReturnCode), len(drifts), perfdata)
+	for _, drift := range drifts {
+		fmt.Printf("[%s] %s\n", lib.StateName(drift.State), drift.Detail)
+	}
+}
+
+// CheckLint checks the WireGuard configuration for problems found by the agent
+func CheckLint(args CLIArguments) {
+	var findingArr []lib.WGLintFinding
+
+	res, err := lib.QueryData(*args.Hostname, *args.Port, "/wireguard/lint", *args.Timeout)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	config := &ms.DecoderConfig{
+		TagName: "json",
+		Result:  &findingArr,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err == nil {
+		err = decoder.Decode(res)
+	}
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	var details []string
+	counts := make(map[string]int)
+	GlobalReturnCode = exitOk
+	for _, finding := range findingArr {
+		if args.Interface != nil && finding.Interface != *args.Interface {
+			continue
+		}
+
+		state := exitWarning
+		if finding.Severity == "critical" {
+			state = exitCritical
+		}
+		if state > GlobalReturnCode {
+			GlobalReturnCode = state
+		}
+		counts[finding.Severity]++
+		details = append(details, fmt.Sprintf("[%s] %s: %s", lib.StateName(state), finding.Check, finding.Message))
+	}
+
+	perfdata := fmt.Sprintf("'critical'=%d 'warning'=%d", counts["critical"], counts["warning"])
+	if len(details) == 0 {
+		fmt.Printf("OK - No problems found in the WireGuard configuration: %s\n", perfdata)
+		return
+	}
+
+	fmt.Printf("%s - %d problems found in the WireGuard configuration: %s\n", lib.StateName(GlobalReturnCode), len(details), perfdata)
+	for _, detail := range details {
+		fmt.Println(detail)
+	}
+}
+
+// CheckPeerQuota checks the traffic of a given WireGuard peer in the current day or month against a limit
+func CheckPeerQuota(args CLIArguments) {
+	var trafficArr []lib.WGTraffic
+
+	peer, err := queryPeer(args)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	res, err := lib.QueryData(*args.Hostname, *args.Port, "/wireguard/traffic", *args.Timeout)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	config := &ms.DecoderConfig{
+		TagName: "json",
+		Result:  &trafficArr,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err == nil {
+		err = decoder.Decode(res)
+	}
+	if err != nil {
+		fmt.Printf("UNKNOWN - %s\n", err)
+		return
+	}
+
+	for _, traffic := range trafficArr {
+		if traffic.Interface != peer.Interface || traffic.PublicKey != peer.PublicKey {
+			continue
+		}
+
+		// The agent names periods in its local time and reports the current ones
+		buckets, current, when := traffic.Months, traffic.Month, "this month"
+		if *args.Period == "day" {
+			buckets, current, when = traffic.Days, traffic.Day, "today"
+		}
+		if current == "" {
+			fmt.Print("UNKNOWN - Agent does not report the current period, please update it\n")
+			return
+		}
+		used := periodTraffic(buckets, current)
+
+		percent := float64(used) / float64(*args.Limit) * 100
+		GlobalReturnCode = lib.Evaluate(percent, args.Warning, args.Critical)
+		fmt.Printf("%s - %s transferred %s of %s %s: 'traffic'=%dB 'quota'=%.2f%%\n",
+			lib.StateName(GlobalReturnCode), lib.PeerLabel(peer), lib.FormatSize(used), lib.FormatSize(*args.Limit), when, used, percent)
+		return
+	}
+
+	fmt.Print("UNKNOWN - No traffic accounted for " + lib.PeerLabel(peer) + "\n")
+}
+
+// periodTraffic returns the traffic accounted in the given period. Without a bucket for it, no
+// traffic was accounted yet.
+func periodTraffic(buckets []lib.TrafficBucket, period string) uint64 {
+	for _, bucket := range buckets {
+		if bucket.Period == period {
+			return bucket.Rx + bucket.Tx
+		}
+	}
+	return 0
+}
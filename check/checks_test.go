@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ilkeskin/icinga-g3000/lib"
+)
+
+func TestEvaluateNetValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		warning  float64
+		critical float64
+		warnPct  bool
+		critPct  bool
+		rate     bool
+		value    float64
+		capacity float64
+		state    int
+		output   string
+		err      bool
+	}{
+		{"below thresholds", 400, 800, false, false, true, 300, 1000, exitOk, "'upstream'=300.00kbps 'upstream-utilisation'=30.00%", false},
+		{"absolute warning", 400, 800, false, false, true, 500, 1000, exitWarning, "'upstream'=500.00kbps 'upstream-utilisation'=50.00%", false},
+		{"absolute critical", 400, 800, false, false, true, 900, 1000, exitCritical, "'upstream'=900.00kbps 'upstream-utilisation'=90.00%", false},
+		{"percent warning", 40, 80, true, true, true, 500, 1000, exitWarning, "'upstream'=500.00kbps 'upstream-utilisation'=50.00%", false},
+		{"percent critical", 40, 80, true, true, true, 900, 1000, exitCritical, "'upstream'=900.00kbps 'upstream-utilisation'=90.00%", false},
+		{"percent below thresholds", 40, 80, true, true, true, 300, 1000, exitOk, "'upstream'=300.00kbps 'upstream-utilisation'=30.00%", false},
+		{"percent warning absolute critical", 40, 800, true, false, true, 500, 1000, exitWarning, "'upstream'=500.00kbps 'upstream-utilisation'=50.00%", false},
+		{"absolute warning percent critical", 400, 80, false, true, true, 900, 1000, exitCritical, "'upstream'=900.00kbps 'upstream-utilisation'=90.00%", false},
+		{"unknown capacity", 400, 800, false, false, true, 500, 0, exitWarning, "'upstream'=500.00kbps", false},
+		{"percent with unknown capacity", 40, 80, true, true, true, 500, 0, exitUnknown, "", true},
+		{"percent warning with unknown capacity", 40, 800, true, false, true, 500, 0, exitUnknown, "", true},
+		{"no rate", 400, 800, false, false, false, 500, 1000, exitWarning, "'upstream'=500.00kbps", false},
+		{"percent without rate", 40, 80, true, true, false, 500, 1000, exitUnknown, "", true},
+	}
+
+	for _, test := range tests {
+		args := CLIArguments{Warning: &test.warning, Critical: &test.critical, WarnPct: test.warnPct, CritPct: test.critPct}
+		state, output, err := evaluateNetValue(args, "eth0", "upstream", "kbps", test.rate, test.value, test.capacity)
+		if state != test.state || output != test.output || (err != nil) != test.err {
+			t.Errorf("%s: evaluateNetValue() = %d, %q, %v, want %d, %q", test.name, state, output, err, test.state, test.output)
+		}
+	}
+}
+
+func TestCheckNetValue(t *testing.T) {
+	eth0 := lib.NetUsage{Name: "eth0", Tx: 300, Capacity: 1000}
+	eth1 := lib.NetUsage{Name: "eth1", Tx: 900, Capacity: 1000}
+	wwan0 := lib.NetUsage{Name: "wwan0", Tx: 50}
+
+	tests := []struct {
+		name      string
+		nicArr    []lib.NetUsage
+		aggregate string
+		warning   float64
+		critical  float64
+		percent   bool
+		state     int
+		output    string
+		err       bool
+	}{
+		{"single device", []lib.NetUsage{eth0}, "each", 400, 800, false, exitOk,
+			"'upstream'=300.00kbps 'upstream-utilisation'=30.00%", false},
+		{"each worst state", []lib.NetUsage{eth0, eth1}, "each", 400, 800, false, exitCritical,
+			"devices eth0, eth1: 'eth0-upstream'=300.00kbps 'eth0-upstream-utilisation'=30.00% 'eth1-upstream'=900.00kbps 'eth1-upstream-utilisation'=90.00%", false},
+		{"each percent", []lib.NetUsage{eth0, eth1}, "each", 20, 95, true, exitWarning,
+			"devices eth0, eth1: 'eth0-upstream'=300.00kbps 'eth0-upstream-utilisation'=30.00% 'eth1-upstream'=900.00kbps 'eth1-upstream-utilisation'=90.00%", false},
+		{"each unknown capacity", []lib.NetUsage{eth0, wwan0}, "each", 400, 800, false, exitOk,
+			"devices eth0, wwan0: 'eth0-upstream'=300.00kbps 'eth0-upstream-utilisation'=30.00% 'wwan0-upstream'=50.00kbps", false},
+		{"each percent with unknown capacity", []lib.NetUsage{eth0, wwan0}, "each", 40, 80, true, exitUnknown, "", true},
+		{"sum", []lib.NetUsage{eth0, eth1}, "sum", 1000, 1500, false, exitWarning,
+			"devices eth0, eth1: 'upstream'=1200.00kbps 'upstream-utilisation'=60.00%", false},
+		{"sum percent", []lib.NetUsage{eth0, eth1}, "sum", 40, 80, true, exitWarning,
+			"devices eth0, eth1: 'upstream'=1200.00kbps 'upstream-utilisation'=60.00%", false},
+		{"sum unknown capacity", []lib.NetUsage{eth0, eth1, wwan0}, "sum", 1000, 1500, false, exitWarning,
+			"devices eth0, eth1, wwan0: 'upstream'=1250.00kbps", false},
+		{"sum unknown first capacity", []lib.NetUsage{wwan0, eth0, eth1}, "sum", 1000, 1500, false, exitWarning,
+			"devices wwan0, eth0, eth1: 'upstream'=1250.00kbps", false},
+		{"sum percent with unknown capacity", []lib.NetUsage{eth0, eth1, wwan0}, "sum", 40, 80, true, exitUnknown, "", true},
+	}
+
+	for _, test := range tests {
+		args := CLIArguments{Warning: &test.warning, Critical: &test.critical, Aggregate: &test.aggregate, WarnPct: test.percent, CritPct: test.percent}
+		state, output, err := checkNetValue(args, test.nicArr, "upstream", "kbps", true, func(nic lib.NetUsage) float64 { return nic.Tx })
+		if state != test.state || output != test.output || (err != nil) != test.err {
+			t.Errorf("%s: checkNetValue() = %d, %q, %v, want %d, %q", test.name, state, output, err, test.state, test.output)
+		}
+	}
+}
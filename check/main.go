@@ -3,17 +3,21 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ilkeskin/icinga-g3000/lib"
 	"github.com/urfave/cli/v2"
 )
 
 const version = "0.0.1"
 
 const (
-	exitOk       = 0
-	exitWarning  = 1
-	exitCritical = 2
-	exitUnknown  = 3
+	exitOk       = lib.StateOk
+	exitWarning  = lib.StateWarning
+	exitCritical = lib.StateCritical
+	exitUnknown  = lib.StateUnknown
 )
 
 // GlobalReturnCode holds last issued exit code
@@ -27,7 +31,18 @@ type CLIArguments struct {
 	Critical  *float64
 	Timeout   *int
 	NetDevice *string
-	Peer      *int64
+	Peer      *string
+	Interface *string
+	Window    *time.Duration
+	Inventory *string
+	Expected  []string
+	Limit     *uint64
+	Period    *string
+	Aggregate *string
+	WarnPct   bool
+	CritPct   bool
+	LossWarn  *float64
+	LossCrit  *float64
 	Verbose   bool
 }
 
@@ -42,6 +57,46 @@ func setRequired(hostname string, port int, timeout int) CLIArguments {
 	return args
 }
 
+// networkArgs returns the arguments of the network subcommands: the device, how several matching
+// devices are aggregated and the thresholds. Thresholds of data rates may be given as percentage
+// of the capacity, if percent is set.
+func networkArgs(c *cli.Context, percent bool) CLIArguments {
+	args := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+	if c.IsSet("device") {
+		args.setNetDevice(c.String("device"))
+	} else {
+		cli.ShowCommandHelp(c, "network")
+		os.Exit(exitUnknown)
+	}
+
+	if c.String("aggregate") != "each" && c.String("aggregate") != "sum" {
+		fmt.Println("Aggregate must be each or sum")
+		os.Exit(exitUnknown)
+	}
+	args.setAggregate(c.String("aggregate"))
+
+	if c.IsSet("warning") && percent {
+		args.setWarning(percentThreshold(c, "warning"))
+		if isPercent(c, "warning") {
+			args.setWarningPercent()
+		}
+	} else if c.IsSet("warning") {
+		args.setWarning(threshold(c, "warning"))
+	}
+
+	if c.IsSet("critical") && percent {
+		args.setCritical(percentThreshold(c, "critical"))
+		if isPercent(c, "critical") {
+			args.setCriticalPercent()
+		}
+	} else if c.IsSet("critical") {
+		args.setCritical(threshold(c, "critical"))
+	}
+
+	return args
+}
+
 func (args *CLIArguments) setWarning(warning float64) {
 	args.Warning = &warning
 }
@@ -54,14 +109,80 @@ func (args *CLIArguments) setNetDevice(netdevice string) {
 	args.NetDevice = &netdevice
 }
 
-func (args *CLIArguments) setPeer(peer int64) {
+func (args *CLIArguments) setPeer(peer string) {
 	args.Peer = &peer
 }
 
+func (args *CLIArguments) setInterface(iface string) {
+	args.Interface = &iface
+}
+
+func (args *CLIArguments) setWindow(window time.Duration) {
+	args.Window = &window
+}
+
+func (args *CLIArguments) setInventory(inventory string) {
+	args.Inventory = &inventory
+}
+
+func (args *CLIArguments) setLimit(limit uint64) {
+	args.Limit = &limit
+}
+
+func (args *CLIArguments) setPeriod(period string) {
+	args.Period = &period
+}
+
+func (args *CLIArguments) setAggregate(aggregate string) {
+	args.Aggregate = &aggregate
+}
+
+func (args *CLIArguments) setLossWarning(warning float64) {
+	args.LossWarn = &warning
+}
+
+func (args *CLIArguments) setLossCritical(critical float64) {
+	args.LossCrit = &critical
+}
+
+func (args *CLIArguments) setWarningPercent() {
+	args.WarnPct = true
+}
+
+func (args *CLIArguments) setCriticalPercent() {
+	args.CritPct = true
+}
+
 func (args *CLIArguments) setVerbose() {
 	args.Verbose = true
 }
 
+// threshold returns the value of a threshold flag. Only data rates of network devices can be
+// checked against percentages, see percentThreshold.
+func threshold(c *cli.Context, name string) float64 {
+	if isPercent(c, name) {
+		fmt.Println("The " + name + " threshold " + c.String(name) + " cannot be given in percent")
+		os.Exit(exitUnknown)
+	}
+	return percentThreshold(c, name)
+}
+
+// percentThreshold returns the value of a threshold flag, which may be given as percentage. A
+// trailing percent sign is ignored, see isPercent.
+func percentThreshold(c *cli.Context, name string) float64 {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(c.String(name)), "%"), 64)
+	if err != nil {
+		fmt.Println("Invalid " + name + " threshold " + c.String(name))
+		os.Exit(exitUnknown)
+	}
+	return value
+}
+
+// isPercent reports whether a threshold flag is given as percentage, e.g. "80%".
+func isPercent(c *cli.Context, name string) bool {
+	return strings.HasSuffix(strings.TrimSpace(c.String(name)), "%")
+}
+
 func checkRequiredFlags(args *CLIArguments) bool {
 	if args.Hostname == nil || *args.Hostname == "" {
 		fmt.Println("No hostname or IP address was set")
@@ -101,11 +222,11 @@ func main() {
 					cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 					if c.IsSet("warning") {
-						cliArgs.setWarning(c.Float64("warning"))
+						cliArgs.setWarning(threshold(c, "warning"))
 					}
 
 					if c.IsSet("critical") {
-						cliArgs.setCritical(c.Float64("critical"))
+						cliArgs.setCritical(threshold(c, "critical"))
 					}
 
 					if !checkRequiredFlags(&cliArgs) {
@@ -127,11 +248,11 @@ func main() {
 					cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 					if c.IsSet("warning") {
-						cliArgs.setWarning(c.Float64("warning"))
+						cliArgs.setWarning(threshold(c, "warning"))
 					}
 
 					if c.IsSet("critical") {
-						cliArgs.setCritical(c.Float64("critical"))
+						cliArgs.setCritical(threshold(c, "critical"))
 					}
 
 					if !checkRequiredFlags(&cliArgs) {
@@ -153,11 +274,11 @@ func main() {
 					cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 					if c.IsSet("warning") {
-						cliArgs.setWarning(c.Float64("warning"))
+						cliArgs.setWarning(threshold(c, "warning"))
 					}
 
 					if c.IsSet("critical") {
-						cliArgs.setCritical(c.Float64("critical"))
+						cliArgs.setCritical(threshold(c, "critical"))
 					}
 
 					if !checkRequiredFlags(&cliArgs) {
@@ -173,15 +294,22 @@ func main() {
 			&cli.Command{
 				Name:        "network",
 				Aliases:     []string{"net", "n"},
-				Usage:       "get network usage (in kbps) of a NIC",
-				Description: "retrieves the current network usage split into kbps up- and downstream",
+				Usage:       "get network usage (in kbps), errors and link state of a NIC",
+				Description: "retrieves the current network usage split into kbps up- and downstream together with the utilisation of the capacity, the error rates and the link state. Thresholds of up- and downstream given in percent, e.g. 80%, apply to the utilisation",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:        "device",
 						Aliases:     []string{"d"},
 						Value:       "eth0",
 						DefaultText: "eth0",
-						Usage:       "Specifies the device that should be queried",
+						Usage:       "Specifies the device that should be queried: a name, a glob like 'wwan*', a regex as 're:wwan[0-9]+' or a role configured on the agent like wan or 'role:lte'",
+					},
+					&cli.StringFlag{
+						Name:        "aggregate",
+						Aliases:     []string{"a"},
+						Value:       "each",
+						DefaultText: "each",
+						Usage:       "Specifies how several matching devices are checked: each on its own or their sum",
 					},
 				},
 				Subcommands: []*cli.Command{
@@ -191,22 +319,7 @@ func main() {
 						Usage:       "get NIC upstream (in kbps)",
 						Description: "retrieves current upstream in kbps for a given network device",
 						Action: func(c *cli.Context) error {
-							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
-
-							if c.IsSet("device") {
-								cliArgs.setNetDevice(c.String("device"))
-							} else {
-								cli.ShowCommandHelp(c, "network")
-								os.Exit(exitUnknown)
-							}
-
-							if c.IsSet("warning") {
-								cliArgs.setWarning(c.Float64("warning"))
-							}
-
-							if c.IsSet("critical") {
-								cliArgs.setCritical(c.Float64("critical"))
-							}
+							cliArgs := networkArgs(c, true)
 
 							if !checkRequiredFlags(&cliArgs) {
 								os.Exit(exitUnknown)
@@ -224,28 +337,49 @@ func main() {
 						Usage:       "get NIC donwstream (in kbps)",
 						Description: "retrieves current downstream in kbps for a given network device",
 						Action: func(c *cli.Context) error {
-							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+							cliArgs := networkArgs(c, true)
 
-							if c.IsSet("device") {
-								cliArgs.setNetDevice(c.String("device"))
-							} else {
-								cli.ShowCommandHelp(c, "network")
+							if !checkRequiredFlags(&cliArgs) {
 								os.Exit(exitUnknown)
 							}
 
-							if c.IsSet("warning") {
-								cliArgs.setWarning(c.Float64("warning"))
-							}
+							CheckDownstream(cliArgs)
 
-							if c.IsSet("critical") {
-								cliArgs.setCritical(c.Float64("critical"))
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "errors",
+						Aliases:     []string{"err", "e"},
+						Usage:       "get NIC errors (per s)",
+						Description: "retrieves current receive and transmit errors including FIFO overruns per second for a given network device, drops are reported as perfdata",
+						Action: func(c *cli.Context) error {
+							cliArgs := networkArgs(c, false)
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
 							}
 
+							CheckNetErrors(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "link",
+						Aliases:     []string{"l"},
+						Usage:       "get NIC link state, speed and duplex",
+						Description: "retrieves the operational state, carrier, speed, duplex, MTU and addresses of a given network device. Links that are down or have no carrier are CRITICAL, dormant links WARNING",
+						Action: func(c *cli.Context) error {
+							cliArgs := networkArgs(c, false)
+
 							if !checkRequiredFlags(&cliArgs) {
 								os.Exit(exitUnknown)
 							}
 
-							CheckDownstream(cliArgs)
+							CheckNetLink(cliArgs)
 
 							os.Exit(GlobalReturnCode)
 							return nil
@@ -257,14 +391,19 @@ func main() {
 				Name:        "wireguard",
 				Aliases:     []string{"wg", "w"},
 				Usage:       "get WireGuard related information",
-				Description: "retrieves up- and downstream speeds and time since the last handshake for a specified WireGuard peer",
+				Description: "retrieves up- and downstream speeds, time since the last handshake and state for a specified WireGuard peer",
 				Flags: []cli.Flag{
-					&cli.IntFlag{
+					&cli.StringFlag{
 						Name:        "peer",
 						Aliases:     []string{"P"},
-						Value:       1,
+						Value:       "1",
 						DefaultText: "1",
-						Usage:       "Specifies the WireGuard peer which should be queried. Peers are identified by the last octet of their IP address",
+						Usage:       "Specifies the WireGuard peer which should be queried by its name (name:plant-berlin), public key, an IP address or prefix of its allowed IPs or (deprecated) the last octet of its IP address",
+					},
+					&cli.StringFlag{
+						Name:    "interface",
+						Aliases: []string{"i"},
+						Usage:   "Specifies the WireGuard interface of the peer, e.g. wg1. By default peers of all interfaces are considered",
 					},
 				},
 				Subcommands: []*cli.Command{
@@ -277,17 +416,21 @@ func main() {
 							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 							if c.IsSet("peer") {
-								cliArgs.setPeer(c.Int64("peer"))
+								cliArgs.setPeer(c.String("peer"))
 							} else {
 								os.Exit(exitUnknown)
 							}
 
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
 							if c.IsSet("warning") {
-								cliArgs.setWarning(c.Float64("warning"))
+								cliArgs.setWarning(threshold(c, "warning"))
 							}
 
 							if c.IsSet("critical") {
-								cliArgs.setCritical(c.Float64("critical"))
+								cliArgs.setCritical(threshold(c, "critical"))
 							}
 
 							if !checkRequiredFlags(&cliArgs) {
@@ -300,6 +443,255 @@ func main() {
 							return nil
 						},
 					},
+					&cli.Command{
+						Name:        "state",
+						Aliases:     []string{"st"},
+						Usage:       "get state of the peer (up, idle, stale, never-connected or down)",
+						Description: "retrieves the state of the selected WireGuard peer, classified by the agent from its latest handshake, keepalive and traffic. Up and idle peers are OK, stale and never connected peers WARNING and peers that are down CRITICAL",
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("peer") {
+								cliArgs.setPeer(c.String("peer"))
+							} else {
+								os.Exit(exitUnknown)
+							}
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckPeerState(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "drift",
+						Aliases:     []string{"dr"},
+						Usage:       "compare peers with an inventory",
+						Description: "compares the running WireGuard peers with the expected ones. Missing peers and changed allowed IPs are CRITICAL, unexpected peers and changed endpoints WARNING",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "inventory",
+								Usage: "Specifies a JSON or YAML file holding the expected peers",
+							},
+							&cli.StringSliceFlag{
+								Name:  "expect",
+								Usage: "Specifies an expected peer as <public key>[:<allowed IP>,...][@<endpoint>], can be repeated",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							if c.IsSet("inventory") {
+								cliArgs.setInventory(c.String("inventory"))
+							}
+							cliArgs.Expected = c.StringSlice("expect")
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckPeerDrift(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "lint",
+						Usage:       "check configuration for problems",
+						Description: "reports problems of the WireGuard configuration found by the agent: duplicated public keys, overlapping allowed IPs, peers behind NAT without persistent keepalive and allowed IPs without route",
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckLint(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "quota",
+						Aliases:     []string{"q"},
+						Usage:       "get traffic of the current day or month in percent of a limit",
+						Description: "retrieves the traffic of the selected WireGuard peer in the current day or month, as accounted by the agent daemon, and compares it with the limit. Warning and critical thresholds are given in percent of the limit (default: 80 and 100)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "limit",
+								Usage: "Specifies the traffic limit, e.g. 500MB, 50GB or 1.5TiB",
+							},
+							&cli.StringFlag{
+								Name:        "period",
+								Value:       "month",
+								DefaultText: "month",
+								Usage:       "Specifies the accounting period, day or month",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("peer") {
+								cliArgs.setPeer(c.String("peer"))
+							} else {
+								os.Exit(exitUnknown)
+							}
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							limit, err := lib.ParseSize(c.String("limit"))
+							if err != nil || limit == 0 {
+								fmt.Println("No limit was set or limit is invalid")
+								os.Exit(exitUnknown)
+							}
+							cliArgs.setLimit(limit)
+
+							if c.String("period") != "day" && c.String("period") != "month" {
+								fmt.Println("Period must be day or month")
+								os.Exit(exitUnknown)
+							}
+							cliArgs.setPeriod(c.String("period"))
+
+							cliArgs.setWarning(80)
+							if c.IsSet("warning") {
+								cliArgs.setWarning(threshold(c, "warning"))
+							}
+
+							cliArgs.setCritical(100)
+							if c.IsSet("critical") {
+								cliArgs.setCritical(threshold(c, "critical"))
+							}
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckPeerQuota(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "flaps",
+						Aliases:     []string{"fl"},
+						Usage:       "get number of flaps within a window",
+						Description: "retrieves how often the handshake of the selected WireGuard peer went stale within the window and its last endpoint change, as recorded by the agent daemon",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:        "window",
+								Value:       time.Hour,
+								DefaultText: "1h",
+								Usage:       "Specifies the time window flaps are counted in, e.g. 30m or 24h",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("peer") {
+								cliArgs.setPeer(c.String("peer"))
+							} else {
+								os.Exit(exitUnknown)
+							}
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							cliArgs.setWindow(c.Duration("window"))
+
+							if c.IsSet("warning") {
+								cliArgs.setWarning(threshold(c, "warning"))
+							}
+
+							if c.IsSet("critical") {
+								cliArgs.setCritical(threshold(c, "critical"))
+							}
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckPeerFlaps(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
+					&cli.Command{
+						Name:        "latency",
+						Aliases:     []string{"lat"},
+						Usage:       "get round trip time (in ms) and loss (in %) of probes through the tunnel",
+						Description: "retrieves the latest latency probe of the selected WireGuard peer by the agent daemon. Warning and critical thresholds apply to the average round trip time, loss thresholds to the share of unanswered probes",
+						Flags: []cli.Flag{
+							&cli.Float64Flag{
+								Name:  "loss-warning",
+								Usage: "Specifies the loss in percent above which the state is WARNING",
+							},
+							&cli.Float64Flag{
+								Name:  "loss-critical",
+								Usage: "Specifies the loss in percent above which the state is CRITICAL",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
+
+							if c.IsSet("peer") {
+								cliArgs.setPeer(c.String("peer"))
+							} else {
+								os.Exit(exitUnknown)
+							}
+
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
+							if c.IsSet("warning") {
+								cliArgs.setWarning(threshold(c, "warning"))
+							}
+
+							if c.IsSet("critical") {
+								cliArgs.setCritical(threshold(c, "critical"))
+							}
+
+							if c.IsSet("loss-warning") {
+								cliArgs.setLossWarning(c.Float64("loss-warning"))
+							}
+
+							if c.IsSet("loss-critical") {
+								cliArgs.setLossCritical(c.Float64("loss-critical"))
+							}
+
+							if !checkRequiredFlags(&cliArgs) {
+								os.Exit(exitUnknown)
+							}
+
+							CheckPeerLatency(cliArgs)
+
+							os.Exit(GlobalReturnCode)
+							return nil
+						},
+					},
 					&cli.Command{
 						Name:        "downstream",
 						Aliases:     []string{"down", "d"},
@@ -309,17 +701,21 @@ func main() {
 							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 							if c.IsSet("peer") {
-								cliArgs.setPeer(c.Int64("peer"))
+								cliArgs.setPeer(c.String("peer"))
 							} else {
 								os.Exit(exitUnknown)
 							}
 
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
 							if c.IsSet("warning") {
-								cliArgs.setWarning(c.Float64("warning"))
+								cliArgs.setWarning(threshold(c, "warning"))
 							}
 
 							if c.IsSet("critical") {
-								cliArgs.setCritical(c.Float64("critical"))
+								cliArgs.setCritical(threshold(c, "critical"))
 							}
 
 							if !checkRequiredFlags(&cliArgs) {
@@ -341,17 +737,21 @@ func main() {
 							cliArgs := setRequired(c.String("hostname"), c.Int("port"), c.Int("timeout"))
 
 							if c.IsSet("peer") {
-								cliArgs.setPeer(c.Int64("peer"))
+								cliArgs.setPeer(c.String("peer"))
 							} else {
 								os.Exit(exitUnknown)
 							}
 
+							if c.IsSet("interface") {
+								cliArgs.setInterface(c.String("interface"))
+							}
+
 							if c.IsSet("warning") {
-								cliArgs.setWarning(c.Float64("warning"))
+								cliArgs.setWarning(threshold(c, "warning"))
 							}
 
 							if c.IsSet("critical") {
-								cliArgs.setCritical(c.Float64("critical"))
+								cliArgs.setCritical(threshold(c, "critical"))
 							}
 
 							if !checkRequiredFlags(&cliArgs) {
@@ -389,15 +789,15 @@ func main() {
 				DefaultText: "90",
 				Usage:       "Specifies the timeout for requests",
 			},
-			&cli.Float64Flag{
+			&cli.StringFlag{
 				Name:    "warning",
 				Aliases: []string{"w"},
-				Usage:   "Specifies the warning threshold",
+				Usage:   "Specifies the warning threshold, network rates accept percentages of the capacity like 80%",
 			},
-			&cli.Float64Flag{
+			&cli.StringFlag{
 				Name:    "critical",
 				Aliases: []string{"c"},
-				Usage:   "Specifies the critical threshold",
+				Usage:   "Specifies the critical threshold, network rates accept percentages of the capacity like 95%",
 			},
 			&cli.BoolFlag{
 				Name:        "verbose",
@@ -4,7 +4,7 @@ go 1.13
 
 require (
 	github.com/fatih/structs v1.1.0
-	github.com/mackerelio/go-osstat v0.1.0
 	github.com/mitchellh/mapstructure v1.3.3
 	github.com/urfave/cli/v2 v2.2.0
+	gopkg.in/yaml.v2 v2.4.0
 )
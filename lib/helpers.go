@@ -1,11 +1,15 @@
 package lib
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
 	s "strconv"
 	"strings"
 	"time"
@@ -13,6 +17,58 @@ import (
 	"github.com/fatih/structs"
 )
 
+// Icinga service states as returned by check plugins
+const (
+	StateOk       = 0
+	StateWarning  = 1
+	StateCritical = 2
+	StateUnknown  = 3
+)
+
+// StateName returns the plugin output prefix for a given service state.
+func StateName(state int) string {
+	switch state {
+	case StateOk:
+		return "OK"
+	case StateWarning:
+		return "WARNING"
+	case StateCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Wireguard peer states as classified by ClassifyPeer
+const (
+	PeerUp             = "up"
+	PeerIdle           = "idle"
+	PeerStale          = "stale"
+	PeerNeverConnected = "never-connected"
+	PeerDown           = "down"
+)
+
+// Timers of the Wireguard protocol in secs. A session is rejected REJECT_AFTER_TIME after its
+// handshake, a new handshake is attempted for REKEY_ATTEMPT_TIME before packets are dropped.
+const (
+	RejectAfterTime  = 180
+	RekeyAttemptTime = 90
+)
+
+// Evaluate compares a value against the optional warning and critical thresholds
+// and returns the resulting service state.
+func Evaluate(value float64, warning *float64, critical *float64) int {
+	if critical != nil && value > *critical {
+		return StateCritical
+	}
+
+	if warning != nil && value > *warning {
+		return StateWarning
+	}
+
+	return StateOk
+}
+
 /*// QueryData issues a HTTP-GET request on a specified host and port and
 // unmarshals the received JSON body into the shared data structure.
 func QueryData(host string, port int, path string) (DataModel, error) {
@@ -51,6 +107,15 @@ func QueryData(host string, port int, path string, timeout int) (interface{}, er
 		return nil, errors.New("Could not read body from HTTP response")
 	}
 
+	if resp.StatusCode == 500 {
+		var errModel ErrorModel
+		err = json.Unmarshal(body, &errModel)
+		if err != nil || errModel.Error == "" {
+			return nil, errors.New("Agent responded with an internal error")
+		}
+		return nil, errors.New(errModel.Error)
+	}
+
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		return nil, err
@@ -58,8 +123,6 @@ func QueryData(host string, port int, path string, timeout int) (interface{}, er
 
 	if resp.StatusCode == 200 {
 		return result, nil
-	} else if resp.StatusCode == 500 {
-		return nil, errors.New(result.(ErrorModel).Error)
 	}
 
 	return nil, errors.New("Unknown status code in HTTP response")
@@ -173,6 +236,138 @@ func ParseNetUsage(data []NetUsage, nicname string) ([2]string, error) {
 	return result, errors.New("Could not find device with name " + nicname)
 }
 
+// SelectNetDevices returns the devices addressed by selector, which is either
+//   - "re:" followed by a regular expression matching the whole device name,
+//   - "role:" followed by a role assigned to devices by the agent configuration,
+//   - a glob pattern like "wwan*" (see path.Match),
+//   - the name of a device or
+//   - a role, if no device has that name.
+//
+// Selectors matching no device are rejected.
+func SelectNetDevices(data []NetUsage, selector string) ([]NetUsage, error) {
+	var matches []NetUsage
+
+	selector = strings.TrimSpace(selector)
+	match := func(name string, roles []string) bool { return name == selector }
+	switch {
+	case strings.HasPrefix(selector, "re:"):
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(selector, "re:") + ")$")
+		if err != nil {
+			return matches, fmt.Errorf("Invalid device pattern %s: %w", selector, err)
+		}
+		match = func(name string, roles []string) bool { return re.MatchString(name) }
+	case strings.HasPrefix(selector, "role:"):
+		role := strings.TrimPrefix(selector, "role:")
+		match = func(name string, roles []string) bool { return hasRole(roles, role) }
+	case strings.ContainsAny(selector, "*?["):
+		if _, err := path.Match(selector, ""); err != nil {
+			return matches, fmt.Errorf("Invalid device pattern %s: %w", selector, err)
+		}
+		match = func(name string, roles []string) bool {
+			ok, _ := path.Match(selector, name)
+			return ok
+		}
+	default:
+		for i := range data {
+			if data[i].Name == selector {
+				return data[i : i+1], nil
+			}
+		}
+		match = func(name string, roles []string) bool { return hasRole(roles, selector) }
+	}
+
+	for i := range data {
+		if match(data[i].Name, data[i].Roles) {
+			matches = append(matches, data[i])
+		}
+	}
+	if len(matches) == 0 {
+		return matches, errors.New("Could not find device matching " + selector)
+	}
+	return matches, nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetErrors returns the errors per sec of a NIC, including FIFO overruns.
+func NetErrors(nic NetUsage) float64 {
+	return nic.RxErrors + nic.TxErrors + nic.RxFifo + nic.TxFifo
+}
+
+// FormatNetErrors describes the error, drop and FIFO overrun rates of a NIC.
+func FormatNetErrors(nic NetUsage) string {
+	return fmt.Sprintf("device %s has %.2f errors/s, %.2f drops/s: 'errors'=%.2f 'rx-errors'=%.2f 'tx-errors'=%.2f 'rx-drops'=%.2f 'tx-drops'=%.2f 'rx-fifo'=%.2f 'tx-fifo'=%.2f 'rx-packets'=%.2f 'tx-packets'=%.2f",
+		nic.Name, NetErrors(nic), nic.RxDrops+nic.TxDrops, NetErrors(nic), nic.RxErrors, nic.TxErrors,
+		nic.RxDrops, nic.TxDrops, nic.RxFifo, nic.TxFifo, nic.RxPackets, nic.TxPackets)
+}
+
+// NetLinkState returns the state of the link of a NIC. Links that are down or have no carrier and
+// vanished devices are CRITICAL, dormant links (e.g. waiting for 802.1X authentication) and links
+// in test mode WARNING. Virtual devices like Wireguard or PPP report the operstate "unknown" and
+// are up with carrier.
+func NetLinkState(nic NetUsage) int {
+	if nic.Change == "vanished" {
+		return StateCritical
+	}
+
+	switch nic.OperState {
+	case "up", "unknown":
+		if nic.Carrier {
+			return StateOk
+		}
+		return StateCritical
+	case "dormant", "testing":
+		return StateWarning
+	}
+	return StateCritical
+}
+
+// FormatNetLink describes the link of a NIC followed by its perfdata.
+func FormatNetLink(nic NetUsage) string {
+	return DescribeNetLink(nic) + ": " + NetLinkPerfdata(nic, "")
+}
+
+// DescribeNetLink describes the link of a NIC.
+func DescribeNetLink(nic NetUsage) string {
+	if nic.Change == "vanished" {
+		return "device " + nic.Name + " vanished"
+	}
+
+	result := fmt.Sprintf("device %s is %s", nic.Name, nic.OperState)
+	if !nic.Carrier {
+		result += " without carrier"
+	}
+	if nic.Speed > 0 {
+		result += fmt.Sprintf(", %d Mbit/s", nic.Speed)
+	}
+	if nic.Duplex != "" {
+		result += " " + nic.Duplex + " duplex"
+	}
+	if nic.MTU > 0 {
+		result += fmt.Sprintf(", MTU %d", nic.MTU)
+	}
+	if len(nic.Addresses) > 0 {
+		result += ", " + strings.Join(nic.Addresses, " ")
+	}
+	return result
+}
+
+// NetLinkPerfdata returns the perfdata of the link of a NIC, with labels prefixed by prefix.
+func NetLinkPerfdata(nic NetUsage, prefix string) string {
+	carrier := 0
+	if nic.Carrier {
+		carrier = 1
+	}
+	return fmt.Sprintf("'%scarrier'=%d '%sspeed'=%d '%smtu'=%d", prefix, carrier, prefix, nic.Speed, prefix, nic.MTU)
+}
+
 /*// ParsePeer parses the Wireguard related metrics of a specified peer retrieved from the agent
 // into a format that is understood by Icingas API and returns them as a string.
 func ParsePeer(data DataModel, peerIndex int64) (string, error) {
@@ -200,40 +395,298 @@ func ParsePeer(data DataModel, peerIndex int64) (string, error) {
 
 // ParsePeer parses the Wireguard related metrics of a specified peer retrieved from the agent
 // into a format that is understood by Icingas API and returns them as a string.
-func ParsePeer(data []WGPeer, index int64) ([3]string, error) {
+func ParsePeer(data []WGPeer, selector string) ([3]string, error) {
 	var result [3]string
 
-	peer, err := GetPeerByIndex(data, index)
+	peer, err := SelectPeer(data, selector)
 	if err != nil {
 		return result, err
 	}
 
-	result[0] = fmt.Sprintf("'lasths'=%ds", time.Now().Unix()-peer.LastHS)
-	result[1] = fmt.Sprintf("'upstream'=%.2fkbps", peer.PeerRate.Tx)
-	result[2] = fmt.Sprintf("'downstream'=%.2fkbps", peer.PeerRate.Rx)
+	return FormatPeer(peer), nil
+}
 
-	return result, nil
+// sizeUnits holds the multipliers of the units accepted by ParseSize.
+var sizeUnits = map[string]float64{
+	"": 1, "B": 1,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	"KIB": 1 << 10, "MIB": 1 << 20, "GIB": 1 << 30, "TIB": 1 << 40,
 }
 
-// GetPeerByIndex returns peer with given index based on the last octet of its internal IP address
-func GetPeerByIndex(peerArr []WGPeer, index int64) (WGPeer, error) {
-	var result WGPeer
+// ParseSize parses an amount of data like "50GB" (decimal units) or "1.5GiB" (binary units) into Bytes.
+func ParseSize(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+
+	number, err := s.ParseFloat(value[:i], 64)
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(value[i:]))]
+	if err != nil || !ok || number < 0 {
+		return 0, errors.New("Invalid size " + value + ", expected e.g. 500MB or 50GB")
+	}
+	return uint64(number * unit), nil
+}
+
+// FormatSize formats an amount of data in Bytes with decimal units, e.g. "12.35GB".
+func FormatSize(bytes uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	value, unit := float64(bytes), 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.2f%s", value, units[unit])
+}
+
+// FormatPeer formats the Wireguard related metrics of a single peer into a format that is
+// understood by Icingas API: seconds since the last handshake, upstream and downstream
+// together with the total traffic. Each is prefixed by the peer description (see PeerLabel).
+func FormatPeer(peer WGPeer) [3]string {
+	var result [3]string
+	label := PeerLabel(peer)
+
+	if age, ok := HandshakeAge(peer, time.Now().Unix()); ok {
+		result[0] = fmt.Sprintf("%s: 'lasths'=%ds", label, age)
+	} else {
+		result[0] = label + ": never connected"
+	}
+	result[1] = fmt.Sprintf("%s: 'upstream'=%.2fkbps 'tx-total'=%dB", label, peer.PeerRate.Tx, peer.Transfer.Tx)
+	result[2] = fmt.Sprintf("%s: 'downstream'=%.2fkbps 'rx-total'=%dB", label, peer.PeerRate.Rx, peer.Transfer.Rx)
+
+	return result
+}
+
+// FormatPeerState describes the state of a peer (see ClassifyPeer) together with the seconds
+// since its last handshake.
+func FormatPeerState(peer WGPeer) string {
+	state := peer.State
+	if state == "" {
+		state = ClassifyPeer(peer, time.Now().Unix())
+	}
+
+	age, ok := HandshakeAge(peer, time.Now().Unix())
+	if !ok {
+		return PeerLabel(peer) + " has never connected"
+	}
+	return fmt.Sprintf("%s is %s: 'lasths'=%ds", PeerLabel(peer), state, age)
+}
+
+// FormatFlaps describes the flaps of a peer within the given window together with its last
+// endpoint change.
+func FormatFlaps(peer WGPeer, flaps WGFlaps, window time.Duration, now int64) string {
+	result := fmt.Sprintf("%s flapped %d times in %s", PeerLabel(peer), flaps.Flaps, window)
+	if change := flaps.LastEndpointChange; change != nil {
+		result += fmt.Sprintf(", endpoint changed from %s to %s %ds ago", endpointName(change.From), endpointName(change.To), now-change.Time)
+	}
+	return result + fmt.Sprintf(": 'flaps'=%d 'endpoint-changes'=%d", flaps.Flaps, flaps.EndpointChanges)
+}
+
+func endpointName(endpoint string) string {
+	if endpoint == "" {
+		return "(none)"
+	}
+	return endpoint
+}
+
+// FormatLatency describes the latest latency probe of a peer. Round trip times are omitted from
+// the perfdata if no probe was answered.
+func FormatLatency(peer WGPeer, latency PeerLatency) string {
+	if latency.Received == 0 {
+		return fmt.Sprintf("%s did not answer %d %s probes to %s: 'loss'=%.0f%%",
+			PeerLabel(peer), latency.Sent, latency.Method, latency.Target, latency.Loss)
+	}
+	return fmt.Sprintf("%s rtt avg %.2fms (min %.2fms, max %.2fms), %.0f%% loss: 'rtt'=%.3fms 'rtt-min'=%.3fms 'rtt-max'=%.3fms 'loss'=%.0f%%",
+		PeerLabel(peer), latency.Avg, latency.Min, latency.Max, latency.Loss, latency.Avg, latency.Min, latency.Max, latency.Loss)
+}
+
+// HandshakeAge returns the secs since the latest handshake with the peer. It returns false if the
+// peer never completed a handshake.
+func HandshakeAge(peer WGPeer, now int64) (int64, bool) {
+	if peer.LastHS == 0 {
+		return 0, false
+	}
+	return now - peer.LastHS, true
+}
+
+// ClassifyPeer derives the state of a peer from its latest handshake, keepalive and the time its
+// transfer counters were last seen changing (see WGPeer.Busy):
+//   - "never-connected" if it never completed a handshake,
+//   - "up" if its session is valid (handshake within REJECT_AFTER_TIME),
+//   - "idle" if its session expired, because neither side had anything to send since. A peer
+//     the gateway has data for is sent handshake initiations every REKEY_TIMEOUT, which change
+//     the counters, so it is not idle,
+//   - "stale" if its session expired although keepalives or traffic should have renewed it,
+//     but a new handshake may still be in progress (within REKEY_ATTEMPT_TIME) and
+//   - "down" if renewing the session failed.
+func ClassifyPeer(peer WGPeer, now int64) string {
+	age, ok := HandshakeAge(peer, now)
+	switch {
+	case !ok:
+		return PeerNeverConnected
+	case age <= RejectAfterTime:
+		return PeerUp
+	case peer.Keepalive == 0 && peer.Busy < peer.LastHS+RejectAfterTime:
+		return PeerIdle
+	case age <= RejectAfterTime+RekeyAttemptTime:
+		return PeerStale
+	}
+	return PeerDown
+}
+
+// PeerStateCode returns the service state for a peer state: OK if the peer is up or idle, WARNING
+// if it is stale or never connected and CRITICAL if it is down.
+func PeerStateCode(state string) int {
+	switch state {
+	case PeerUp, PeerIdle:
+		return StateOk
+	case PeerStale, PeerNeverConnected:
+		return StateWarning
+	case PeerDown:
+		return StateCritical
+	}
+	return StateUnknown
+}
+
+// PeerLabel describes a peer by its name and first allowed IP, e.g. "peer plant-berlin (10.0.0.2/32) on wg0".
+// Peers without name are described by their first allowed IP or, lacking one, by their public key.
+func PeerLabel(peer WGPeer) string {
+	allowed := peerAllowedIPs(peer)
+	if len(allowed) == 0 || allowed[0] == "" || allowed[0] == "(none)" {
+		allowed = []string{peer.PublicKey}
+	}
+
+	result := "peer " + allowed[0]
+	if peer.Name != "" {
+		result = "peer " + peer.Name + " (" + allowed[0] + ")"
+	}
+	if peer.Interface != "" {
+		result += " on " + peer.Interface
+	}
+	return result
+}
+
+// FilterPeersByInterface returns the peers of the Wireguard interface with the given name.
+func FilterPeersByInterface(peerArr []WGPeer, iface string) []WGPeer {
+	var result []WGPeer
 
 	for i := range peerArr {
-		ip := strings.Split(peerArr[i].IntIPAddr, "/")
-		ip = strings.Split(ip[0], ".")
+		if peerArr[i].Interface == iface {
+			result = append(result, peerArr[i])
+		}
+	}
 
-		idx, err := s.ParseInt(ip[len(ip)-1], 10, 8)
+	return result
+}
+
+// SelectPeer returns the peer addressed by selector, which is either
+//   - "name:" followed by the name of the peer,
+//   - the public key of the peer,
+//   - a prefix in CIDR notation equal to one of its allowed IPs,
+//   - an IPv4 or IPv6 address routed to the peer (longest matching allowed IP) or
+//   - the last octet of its first IPv4 allowed IP (index, deprecated).
+//
+// Selectors matching several peers, e.g. of different interfaces, are rejected.
+func SelectPeer(peerArr []WGPeer, selector string) (WGPeer, error) {
+	var matches []WGPeer
+
+	selector = strings.TrimSpace(selector)
+	key, err := base64.StdEncoding.DecodeString(selector)
+	switch {
+	case strings.HasPrefix(selector, "name:"):
+		name := strings.TrimSpace(strings.TrimPrefix(selector, "name:"))
+		for i := range peerArr {
+			if peerArr[i].Name != "" && strings.EqualFold(peerArr[i].Name, name) {
+				matches = append(matches, peerArr[i])
+			}
+		}
+	case err == nil && len(key) == 32:
+		for i := range peerArr {
+			if peerArr[i].PublicKey == selector {
+				matches = append(matches, peerArr[i])
+			}
+		}
+	case strings.Contains(selector, "/"):
+		_, prefix, err := net.ParseCIDR(selector)
 		if err != nil {
-			return result, err
+			return WGPeer{}, errors.New("Invalid peer prefix " + selector)
+		}
+		for i := range peerArr {
+			for _, allowed := range peerAllowedIPs(peerArr[i]) {
+				_, network, err := net.ParseCIDR(allowed)
+				if err == nil && network.String() == prefix.String() {
+					matches = append(matches, peerArr[i])
+					break
+				}
+			}
 		}
+	case net.ParseIP(selector) != nil:
+		ip, longest := net.ParseIP(selector), -1
+		for i := range peerArr {
+			for _, allowed := range peerAllowedIPs(peerArr[i]) {
+				_, network, err := net.ParseCIDR(allowed)
+				if err != nil || !network.Contains(ip) {
+					continue
+				}
+				ones, _ := network.Mask.Size()
+				if ones > longest {
+					matches, longest = []WGPeer{peerArr[i]}, ones
+				} else if ones == longest {
+					matches = append(matches, peerArr[i])
+				}
+			}
+		}
+	default:
+		index, err := s.ParseInt(selector, 10, 64)
+		if err != nil {
+			return WGPeer{}, errors.New("Invalid peer " + selector + ", expected name, public key, IP address, prefix or index")
+		}
+		return GetPeerByIndex(peerArr, index)
+	}
 
-		//fmt.Printf("Testing %d against given index %d: %t\n", idx, index, idx == index)
+	if len(matches) == 0 {
+		return WGPeer{}, errors.New("Could not find peer " + selector)
+	} else if len(matches) > 1 {
+		return WGPeer{}, fmt.Errorf("Peer %s is ambiguous, it matches %d peers", selector, len(matches))
+	}
+	return matches[0], nil
+}
 
-		if idx == index {
-			result = peerArr[i]
-			// fmt.Println(result)
-			return result, nil
+// peerAllowedIPs returns the allowed IPs of a peer, falling back to the internal IP
+// reported by older agents.
+func peerAllowedIPs(peer WGPeer) []string {
+	if len(peer.AllowedIPs) > 0 {
+		return peer.AllowedIPs
+	}
+
+	var result []string
+	for _, allowed := range strings.Split(peer.IntIPAddr, ",") {
+		result = append(result, strings.TrimSpace(allowed))
+	}
+	return result
+}
+
+// GetPeerByIndex returns peer with given index based on the last octet of its first IPv4 allowed IP.
+// It is only kept for backwards compatibility, as indexes are ambiguous across subnets.
+func GetPeerByIndex(peerArr []WGPeer, index int64) (WGPeer, error) {
+	var result WGPeer
+
+	for i := range peerArr {
+		for _, allowed := range peerAllowedIPs(peerArr[i]) {
+			ip := net.ParseIP(strings.Split(allowed, "/")[0]).To4()
+			if ip == nil {
+				continue
+			}
+
+			if int64(ip[3]) == index {
+				return peerArr[i], nil
+			}
+			break
 		}
 	}
 
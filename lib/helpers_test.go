@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassifyPeer(t *testing.T) {
+	const hs = 1000000
+	tests := []struct {
+		name      string
+		lastHS    int64
+		keepalive int
+		busy      int64
+		age       int64
+		want      string
+	}{
+		{"never connected", 0, 25, 0, 0, PeerNeverConnected},
+		{"fresh handshake", hs, 0, 0, 0, PeerUp},
+		{"session valid", hs, 0, 0, 180, PeerUp},
+		{"session expired without traffic", hs, 0, 0, 181, PeerIdle},
+		{"traffic before expiry", hs, 0, hs + 179, 181, PeerIdle},
+		{"traffic after expiry", hs, 0, hs + 180, 181, PeerStale},
+		{"initiations within rekey attempt time", hs, 0, hs + 200, 270, PeerStale},
+		{"initiations beyond rekey attempt time", hs, 0, hs + 200, 271, PeerDown},
+		{"idle long after expiry", hs, 0, hs + 10, 100000, PeerIdle},
+		{"keepalive session valid", hs, 25, 0, 180, PeerUp},
+		{"keepalive session expired", hs, 25, 0, 181, PeerStale},
+		{"keepalive within rekey attempt time", hs, 25, 0, 270, PeerStale},
+		{"keepalive beyond rekey attempt time", hs, 25, 0, 271, PeerDown},
+	}
+
+	for _, test := range tests {
+		peer := WGPeer{LastHS: test.lastHS, Keepalive: test.keepalive, Busy: test.busy}
+		if got := ClassifyPeer(peer, hs+test.age); got != test.want {
+			t.Errorf("%s: state %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPeerStateCode(t *testing.T) {
+	tests := map[string]int{
+		PeerUp:             StateOk,
+		PeerIdle:           StateOk,
+		PeerStale:          StateWarning,
+		PeerNeverConnected: StateWarning,
+		PeerDown:           StateCritical,
+		"":                 StateUnknown,
+		"rebooting":        StateUnknown,
+	}
+	for state, want := range tests {
+		if got := PeerStateCode(state); got != want {
+			t.Errorf("State %q: code %d, want %d", state, got, want)
+		}
+	}
+}
+
+func TestSelectNetDevices(t *testing.T) {
+	data := []NetUsage{
+		{Name: "eth0", Roles: []string{"wan"}},
+		{Name: "eth1", Roles: []string{"lan"}},
+		{Name: "lan", Roles: []string{"bridge"}},
+		{Name: "wwan0", Roles: []string{"wan", "lte"}},
+		{Name: "veth0"},
+	}
+
+	tests := []struct {
+		selector string
+		want     []string
+		err      bool
+	}{
+		{"eth0", []string{"eth0"}, false},
+		{" eth0 ", []string{"eth0"}, false},
+		{"eth", nil, true},
+		{"wan", []string{"eth0", "wwan0"}, false},
+		{"lan", []string{"lan"}, false},
+		{"role:lan", []string{"eth1"}, false},
+		{"role:WAN", []string{"eth0", "wwan0"}, false},
+		{"role:wwan0", nil, true},
+		{"re:eth", nil, true},
+		{"re:eth.", []string{"eth0", "eth1"}, false},
+		{"re:eth0|wwan0", []string{"eth0", "wwan0"}, false},
+		{"re:.*eth0", []string{"eth0", "veth0"}, false},
+		{"re:[", nil, true},
+		{"wwan*", []string{"wwan0"}, false},
+		{"eth?", []string{"eth0", "eth1"}, false},
+		{"*eth*", []string{"eth0", "eth1", "veth0"}, false},
+		{"[", nil, true},
+		{"ppp*", nil, true},
+	}
+
+	for _, test := range tests {
+		nics, err := SelectNetDevices(data, test.selector)
+		var names []string
+		for _, nic := range nics {
+			names = append(names, nic.Name)
+		}
+		if (err != nil) != test.err || strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("SelectNetDevices(%q) = %v, %v, want %v", test.selector, names, err, test.want)
+		}
+	}
+}
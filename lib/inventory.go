@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ExpectedPeer describes a Wireguard peer of the inventory. Interface, allowed IPs and endpoint are
+// only compared if set, an endpoint without port matches any port.
+type ExpectedPeer struct {
+	Interface  string   `json:"interface" yaml:"interface"`
+	PublicKey  string   `json:"public_key" yaml:"public_key"`
+	Name       string   `json:"name" yaml:"name"`
+	AllowedIPs []string `json:"allowed_ips" yaml:"allowed_ips"`
+	Endpoint   string   `json:"endpoint" yaml:"endpoint"`
+}
+
+// PeerDrift describes a difference between the running peers and the inventory. Kind is
+// "missing", "unexpected", "allowed-ips" or "endpoint".
+type PeerDrift struct {
+	Kind   string
+	State  int
+	Detail string
+}
+
+// LoadInventory reads the expected peers from a file holding an array of peers, which is parsed
+// as YAML if its extension is .yaml or .yml and as JSON otherwise.
+func LoadInventory(path string) ([]ExpectedPeer, error) {
+	var result []ExpectedPeer
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return result, fmt.Errorf("Reading inventory failed: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &result)
+	default:
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		return result, fmt.Errorf("Parsing inventory %s failed: %w", path, err)
+	}
+	return result, nil
+}
+
+// ParseExpectedPeer parses a peer given on the command line as
+// "<public key>[:<allowed IP>,...][@<endpoint>]", e.g. "9kVR...9oo=:10.0.0.2/32@203.0.113.10".
+func ParseExpectedPeer(value string) (ExpectedPeer, error) {
+	var result ExpectedPeer
+
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "@"); i >= 0 {
+		value, result.Endpoint = value[:i], value[i+1:]
+	}
+	if i := strings.Index(value, ":"); i >= 0 {
+		for _, allowed := range strings.Split(value[i+1:], ",") {
+			result.AllowedIPs = append(result.AllowedIPs, strings.TrimSpace(allowed))
+		}
+		value = value[:i]
+	}
+	result.PublicKey = strings.TrimSpace(value)
+
+	if result.PublicKey == "" {
+		return result, errors.New("Expected peer has no public key")
+	}
+	return result, nil
+}
+
+// DiffPeers compares the running peers with the inventory. Missing peers and changed allowed IPs
+// are CRITICAL, as traffic is no longer routed to the right peer, unexpected peers and changed
+// endpoints are WARNING.
+func DiffPeers(expected []ExpectedPeer, peerArr []WGPeer) []PeerDrift {
+	var result []PeerDrift
+
+	running := make(map[string]WGPeer)
+	for _, peer := range peerArr {
+		running[peer.Interface+" "+peer.PublicKey] = peer
+	}
+
+	known := make(map[string]bool)
+	for _, want := range expected {
+		found := false
+		for key, peer := range running {
+			if peer.PublicKey != want.PublicKey || (want.Interface != "" && peer.Interface != want.Interface) {
+				continue
+			}
+			found, known[key] = true, true
+
+			if peer.Name == "" {
+				peer.Name = want.Name
+			}
+			label := PeerLabel(peer)
+
+			if len(want.AllowedIPs) > 0 && !sameAllowedIPs(want.AllowedIPs, peerAllowedIPs(peer)) {
+				result = append(result, PeerDrift{"allowed-ips", StateCritical, fmt.Sprintf("%s has allowed IPs %s instead of %s",
+					label, strings.Join(peerAllowedIPs(peer), ", "), strings.Join(want.AllowedIPs, ", "))})
+			}
+			if want.Endpoint != "" && !sameEndpoint(want.Endpoint, peer.ExtIPAddr) {
+				result = append(result, PeerDrift{"endpoint", StateWarning, fmt.Sprintf("%s has endpoint %s instead of %s",
+					label, peer.ExtIPAddr, want.Endpoint)})
+			}
+		}
+
+		if !found {
+			label := "peer " + want.PublicKey
+			if want.Name != "" {
+				label = "peer " + want.Name + " (" + want.PublicKey + ")"
+			}
+			if want.Interface != "" {
+				label += " on " + want.Interface
+			}
+			result = append(result, PeerDrift{"missing", StateCritical, label + " is missing"})
+		}
+	}
+
+	for _, peer := range peerArr {
+		if !known[peer.Interface+" "+peer.PublicKey] {
+			result = append(result, PeerDrift{"unexpected", StateWarning, fmt.Sprintf("%s (%s) is not in the inventory", PeerLabel(peer), peer.PublicKey)})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].State > result[j].State })
+	return result
+}
+
+// sameAllowedIPs reports whether both lists hold the same prefixes in any order.
+func sameAllowedIPs(a []string, b []string) bool {
+	normalize := func(prefixes []string) []string {
+		var result []string
+		for _, prefix := range prefixes {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(prefix))
+			if err != nil {
+				result = append(result, strings.TrimSpace(prefix))
+			} else {
+				result = append(result, network.String())
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	x, y := normalize(a), normalize(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameEndpoint reports whether the endpoint of a peer matches the expected one. An expected
+// endpoint without port matches any port.
+func sameEndpoint(want string, endpoint string) bool {
+	if want == endpoint {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(endpoint)
+	return err == nil && strings.Trim(want, "[]") == host
+}
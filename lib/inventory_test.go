@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	berlinKey  = "9kVR/NbweCPLh5cc+5FEZCXaGChrOrHvk14MvXpp9oo="
+	hamburgKey = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+	munichKey  = "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA="
+)
+
+func TestLoadInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []ExpectedPeer{{Interface: "wg0", PublicKey: berlinKey, Name: "plant-berlin", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "203.0.113.10"}}
+	tests := []struct {
+		file    string
+		content string
+		err     bool
+	}{
+		{"peers.json", `[{"interface": "wg0", "public_key": "` + berlinKey + `", "name": "plant-berlin", "allowed_ips": ["10.0.0.2/32"], "endpoint": "203.0.113.10"}]`, false},
+		{"peers.yaml", "- interface: wg0\n  public_key: " + berlinKey + "\n  name: plant-berlin\n  allowed_ips: [10.0.0.2/32]\n  endpoint: 203.0.113.10\n", false},
+		{"peers.YML", "- interface: wg0\n  public_key: " + berlinKey + "\n  name: plant-berlin\n  allowed_ips:\n    - 10.0.0.2/32\n  endpoint: 203.0.113.10\n", false},
+		{"flow.yml", `[{"interface": "wg0", "public_key": "` + berlinKey + `", "name": "plant-berlin", "allowed_ips": ["10.0.0.2/32"], "endpoint": "203.0.113.10"}]`, false},
+		{"yaml.json", "- interface: wg0\n", true},
+		{"broken.yaml", "- interface: [wg0\n", true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		peers, err := LoadInventory(path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: LoadInventory() = %v, want error", test.file, peers)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(peers, want) {
+			t.Errorf("%s: LoadInventory() = %v, %v, want %v", test.file, peers, err, want)
+		}
+	}
+
+	if _, err := LoadInventory(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("LoadInventory() of missing file succeeded")
+	}
+}
+
+func TestParseExpectedPeer(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ExpectedPeer
+		err   bool
+	}{
+		{berlinKey, ExpectedPeer{PublicKey: berlinKey}, false},
+		{" " + berlinKey + " ", ExpectedPeer{PublicKey: berlinKey}, false},
+		{berlinKey + ":10.0.0.2/32", ExpectedPeer{PublicKey: berlinKey, AllowedIPs: []string{"10.0.0.2/32"}}, false},
+		{berlinKey + ":10.0.0.2/32, 192.168.10.0/24", ExpectedPeer{PublicKey: berlinKey, AllowedIPs: []string{"10.0.0.2/32", "192.168.10.0/24"}}, false},
+		{berlinKey + ":fd00::2/128,10.0.0.2/32", ExpectedPeer{PublicKey: berlinKey, AllowedIPs: []string{"fd00::2/128", "10.0.0.2/32"}}, false},
+		{berlinKey + "@203.0.113.10", ExpectedPeer{PublicKey: berlinKey, Endpoint: "203.0.113.10"}, false},
+		{berlinKey + ":10.0.0.2/32@203.0.113.10:51820", ExpectedPeer{PublicKey: berlinKey, AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "203.0.113.10:51820"}, false},
+		{berlinKey + ":fd00::2/128@[2001:db8::10]:51820", ExpectedPeer{PublicKey: berlinKey, AllowedIPs: []string{"fd00::2/128"}, Endpoint: "[2001:db8::10]:51820"}, false},
+		{berlinKey + "@2001:db8::10", ExpectedPeer{PublicKey: berlinKey, Endpoint: "2001:db8::10"}, false},
+		{"", ExpectedPeer{}, true},
+		{":10.0.0.2/32@203.0.113.10", ExpectedPeer{}, true},
+	}
+
+	for _, test := range tests {
+		peer, err := ParseExpectedPeer(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseExpectedPeer(%q) = %v, want error", test.value, peer)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(peer, test.want) {
+			t.Errorf("ParseExpectedPeer(%q) = %v, %v, want %v", test.value, peer, err, test.want)
+		}
+	}
+}
+
+func TestSameEndpoint(t *testing.T) {
+	tests := []struct {
+		want     string
+		endpoint string
+		same     bool
+	}{
+		{"203.0.113.10:51820", "203.0.113.10:51820", true},
+		{"203.0.113.10", "203.0.113.10:51820", true},
+		{"203.0.113.10", "203.0.113.10:4500", true},
+		{"203.0.113.10:51820", "203.0.113.10:4500", false},
+		{"203.0.113.10", "203.0.113.11:51820", false},
+		{"203.0.113.1", "203.0.113.10:51820", false},
+		{"[2001:db8::10]:51820", "[2001:db8::10]:51820", true},
+		{"2001:db8::10", "[2001:db8::10]:51820", true},
+		{"[2001:db8::10]", "[2001:db8::10]:51820", true},
+		{"[2001:db8::10]:51820", "[2001:db8::10]:4500", false},
+		{"2001:db8::11", "[2001:db8::10]:51820", false},
+		{"203.0.113.10", "(none)", false},
+	}
+
+	for _, test := range tests {
+		if same := sameEndpoint(test.want, test.endpoint); same != test.same {
+			t.Errorf("sameEndpoint(%q, %q) = %t, want %t", test.want, test.endpoint, same, test.same)
+		}
+	}
+}
+
+func TestDiffPeers(t *testing.T) {
+	running := []WGPeer{
+		{Interface: "wg0", PublicKey: berlinKey, Name: "plant-berlin", AllowedIPs: []string{"10.0.0.2/32"}, ExtIPAddr: "203.0.113.10:51820"},
+		{Interface: "wg0", PublicKey: hamburgKey, AllowedIPs: []string{"10.0.0.3/32", "fd00::3/128"}, ExtIPAddr: "[2001:db8::3]:51820"},
+	}
+
+	tests := []struct {
+		name     string
+		expected []ExpectedPeer
+		want     []PeerDrift
+	}{
+		{"matching", []ExpectedPeer{
+			{Interface: "wg0", PublicKey: berlinKey, AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "203.0.113.10"},
+			{PublicKey: hamburgKey, AllowedIPs: []string{"fd00::3/128", "10.0.0.3/32"}, Endpoint: "[2001:db8::3]:51820"},
+		}, nil},
+		{"only public keys", []ExpectedPeer{{PublicKey: berlinKey}, {PublicKey: hamburgKey}}, nil},
+		{"unnormalized allowed IPs", []ExpectedPeer{
+			{PublicKey: berlinKey, AllowedIPs: []string{" 10.0.0.2/32"}},
+			{PublicKey: hamburgKey, AllowedIPs: []string{"10.0.0.3/32", "fd00:0::3/128"}},
+		}, nil},
+		{"missing", []ExpectedPeer{{PublicKey: berlinKey}, {PublicKey: hamburgKey}, {Interface: "wg1", PublicKey: munichKey, Name: "plant-munich"}}, []PeerDrift{
+			{"missing", StateCritical, "peer plant-munich (" + munichKey + ") on wg1 is missing"},
+		}},
+		{"other interface", []ExpectedPeer{{Interface: "wg1", PublicKey: berlinKey}, {PublicKey: hamburgKey}}, []PeerDrift{
+			{"missing", StateCritical, "peer " + berlinKey + " on wg1 is missing"},
+			{"unexpected", StateWarning, "peer plant-berlin (10.0.0.2/32) on wg0 (" + berlinKey + ") is not in the inventory"},
+		}},
+		{"unexpected", []ExpectedPeer{{PublicKey: berlinKey}}, []PeerDrift{
+			{"unexpected", StateWarning, "peer 10.0.0.3/32 on wg0 (" + hamburgKey + ") is not in the inventory"},
+		}},
+		{"allowed IP drift", []ExpectedPeer{
+			{PublicKey: berlinKey, AllowedIPs: []string{"10.0.0.2/32", "192.168.10.0/24"}},
+			{PublicKey: hamburgKey, Name: "plant-hamburg", AllowedIPs: []string{"10.0.0.3/32", "fd00::4/128"}},
+		}, []PeerDrift{
+			{"allowed-ips", StateCritical, "peer plant-berlin (10.0.0.2/32) on wg0 has allowed IPs 10.0.0.2/32 instead of 10.0.0.2/32, 192.168.10.0/24"},
+			{"allowed-ips", StateCritical, "peer plant-hamburg (10.0.0.3/32) on wg0 has allowed IPs 10.0.0.3/32, fd00::3/128 instead of 10.0.0.3/32, fd00::4/128"},
+		}},
+		{"endpoint drift", []ExpectedPeer{
+			{PublicKey: berlinKey, Endpoint: "203.0.113.11"},
+			{PublicKey: hamburgKey, Endpoint: "2001:db8::4"},
+		}, []PeerDrift{
+			{"endpoint", StateWarning, "peer plant-berlin (10.0.0.2/32) on wg0 has endpoint 203.0.113.10:51820 instead of 203.0.113.11"},
+			{"endpoint", StateWarning, "peer 10.0.0.3/32 on wg0 has endpoint [2001:db8::3]:51820 instead of 2001:db8::4"},
+		}},
+		{"critical first", []ExpectedPeer{
+			{PublicKey: berlinKey, Endpoint: "203.0.113.11:51820"},
+			{PublicKey: munichKey},
+		}, []PeerDrift{
+			{"missing", StateCritical, "peer " + munichKey + " is missing"},
+			{"endpoint", StateWarning, "peer plant-berlin (10.0.0.2/32) on wg0 has endpoint 203.0.113.10:51820 instead of 203.0.113.11:51820"},
+			{"unexpected", StateWarning, "peer 10.0.0.3/32 on wg0 (" + hamburgKey + ") is not in the inventory"},
+		}},
+	}
+
+	for _, test := range tests {
+		drifts := DiffPeers(test.expected, running)
+		if !reflect.DeepEqual(drifts, test.want) {
+			t.Errorf("%s: DiffPeers() = %v, want %v", test.name, drifts, test.want)
+		}
+	}
+}
@@ -23,11 +23,34 @@ type MemUsage struct {
 	//SwapFree  float64 `json:"swap-free"`
 }
 
-// NetUsage holds network usage
+// NetUsage holds network usage. Rx and Tx are given in kbps, packet, error, drop and FIFO overrun
+// rates per sec. Speed is the link speed in Mbit/s (0 if unknown, e.g. for virtual devices or
+// devices without carrier), Addresses hold the IPv4 and IPv6 addresses with prefix length, Roles
+// the aliases assigned to the device by the agent configuration (e.g. "wan"). Capacity is the
+// nominal capacity in kbps from the configuration or the link speed (0 if unknown). Change
+// flags devices that "appeared" or "vanished" while the rates were sampled and devices whose
+// counters were "reset".
 type NetUsage struct {
-	Name string  `json:"device"`
-	Rx   float64 `json:"rx"`
-	Tx   float64 `json:"tx"`
+	Name      string   `json:"device"`
+	Rx        float64  `json:"rx"`
+	Tx        float64  `json:"tx"`
+	RxPackets float64  `json:"rx-packets"`
+	TxPackets float64  `json:"tx-packets"`
+	RxErrors  float64  `json:"rx-errors"`
+	TxErrors  float64  `json:"tx-errors"`
+	RxDrops   float64  `json:"rx-drops"`
+	TxDrops   float64  `json:"tx-drops"`
+	RxFifo    float64  `json:"rx-fifo"`
+	TxFifo    float64  `json:"tx-fifo"`
+	OperState string   `json:"operstate"`
+	Carrier   bool     `json:"carrier"`
+	MTU       int      `json:"mtu"`
+	Speed     int      `json:"speed"`
+	Capacity  float64  `json:"capacity"`
+	Duplex    string   `json:"duplex,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Change    string   `json:"change,omitempty"`
 }
 
 // PeerRate holds Wireguard peers date rates
@@ -36,12 +59,119 @@ type PeerRate struct {
 	Tx float64 `json:"tx"`
 }
 
-// WGPeer holds wireguard peer information
+// PeerTransfer holds the Bytes received from and transmitted to a Wireguard peer since the
+// interface was created
+type PeerTransfer struct {
+	Rx uint64 `json:"rx"`
+	Tx uint64 `json:"tx"`
+}
+
+// WGPeer holds wireguard peer information. IntIPAddr holds all allowed IPs joined by commas
+// and is kept for older versions of check_g3000. Name and Metadata (e.g. site, customer, contact)
+// are only set for peers named by the agent configuration. Keepalive is given in secs (0 if disabled).
+// Change flags peers that "appeared" or "vanished" while the data rates were sampled and peers
+// whose counters were "reset" by a restart of the interface. Busy is the start of the latest sampling
+// interval in which the transfer counters were seen changing (0 if unknown), State is the
+// classification of the peer by ClassifyPeer, Latency is only set if the agent probes peers.
 type WGPeer struct {
-	IntIPAddr string   `json:"internal-ip"`
-	ExtIPAddr string   `json:"external-ip"`
-	LastHS    int64    `json:"latest-handshake"`
-	PeerRate  PeerRate `json:"data-rates"`
+	Interface    string            `json:"interface"`
+	Name         string            `json:"name,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	PublicKey    string            `json:"public-key"`
+	PresharedKey bool              `json:"preshared-key"`
+	AllowedIPs   []string          `json:"allowed-ips"`
+	IntIPAddr    string            `json:"internal-ip"`
+	ExtIPAddr    string            `json:"external-ip"`
+	Keepalive    int               `json:"persistent-keepalive"`
+	LastHS       int64             `json:"latest-handshake"`
+	Transfer     PeerTransfer      `json:"transfer"`
+	PeerRate     PeerRate          `json:"data-rates"`
+	Busy         int64             `json:"busy,omitempty"`
+	Change       string            `json:"change,omitempty"`
+	State        string            `json:"state"`
+	Latency      *PeerLatency      `json:"latency,omitempty"`
+}
+
+// PeerLatency holds the result of the latest latency probe of a Wireguard peer by the agent daemon.
+// Loss is given in percent, round trip times in ms (0 if no probe was answered). Error is set if
+// the peer could not be probed at all, e.g. without permission to send ICMP.
+type PeerLatency struct {
+	Time     int64   `json:"time"`
+	Method   string  `json:"method"`
+	Target   string  `json:"target"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"`
+	Min      float64 `json:"rtt-min"`
+	Avg      float64 `json:"rtt-avg"`
+	Max      float64 `json:"rtt-max"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// WGInterface holds wireguard interface information. FwMark is 0 if not set, Transfer is the sum
+// of the traffic of all peers.
+type WGInterface struct {
+	Name       string       `json:"name"`
+	PublicKey  string       `json:"public-key"`
+	ListenPort int          `json:"listen-port"`
+	FwMark     uint32       `json:"fwmark"`
+	Peers      int          `json:"peers"`
+	Transfer   PeerTransfer `json:"transfer"`
+}
+
+// WGEvent holds a change of a Wireguard peer recorded by the agent daemon. Type is "fresh" or
+// "stale" if the latest handshake got younger or older than REJECT_AFTER_TIME, or "endpoint" if
+// the endpoint of the peer changed from From to To.
+type WGEvent struct {
+	Time      int64  `json:"time"`
+	Interface string `json:"interface"`
+	PublicKey string `json:"public-key"`
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+}
+
+// WGFlaps summarizes the events of a Wireguard peer within a time window. Flaps counts the
+// transitions from a fresh to a stale handshake, sessions of idle peers expiring are not counted.
+type WGFlaps struct {
+	Interface          string    `json:"interface"`
+	PublicKey          string    `json:"public-key"`
+	Name               string    `json:"name,omitempty"`
+	Flaps              int       `json:"flaps"`
+	EndpointChanges    int       `json:"endpoint-changes"`
+	LastEndpointChange *WGEvent  `json:"last-endpoint-change,omitempty"`
+	Events             []WGEvent `json:"events"`
+}
+
+// WGLintFinding describes a problem of the Wireguard configuration found by the agent. Severity is
+// "warning" or "critical", Check names the rule that found it.
+type WGLintFinding struct {
+	Severity  string `json:"severity"`
+	Check     string `json:"check"`
+	Interface string `json:"interface"`
+	PublicKey string `json:"public-key,omitempty"`
+	Message   string `json:"message"`
+}
+
+// TrafficBucket holds the Bytes received from and transmitted to a Wireguard peer within a period,
+// given as "2006-01-02" for days and "2006-01" for months in local time of the gateway.
+type TrafficBucket struct {
+	Period string `json:"period"`
+	Rx     uint64 `json:"rx"`
+	Tx     uint64 `json:"tx"`
+}
+
+// WGTraffic holds the daily and monthly traffic of a Wireguard peer accounted by the agent daemon,
+// oldest period first. Day and Month name the current periods in the local time of the agent.
+type WGTraffic struct {
+	Interface string          `json:"interface"`
+	PublicKey string          `json:"public-key"`
+	Name      string          `json:"name,omitempty"`
+	Day       string          `json:"day"`
+	Month     string          `json:"month"`
+	Days      []TrafficBucket `json:"days"`
+	Months    []TrafficBucket `json:"months"`
 }
 
 /*// DataModel defines the structure of the JSON response